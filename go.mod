@@ -2,4 +2,7 @@ module wal
 
 go 1.23.1
 
-require google.golang.org/protobuf v1.36.3
+require (
+	github.com/klauspost/compress v1.18.0
+	google.golang.org/protobuf v1.36.3
+)
@@ -0,0 +1,96 @@
+package wal
+
+import (
+	"fmt"
+)
+
+// recentCache keeps the last entries written in a fixed size ring buffer
+// It is filled on write, so it is independent of the segment files and survives rotations
+type recentCache struct {
+	entries []*Entry
+	next    int // position of the next entry to overwrite
+	count   int // number of entries held, up to len(entries)
+}
+
+func newRecentCache(size int) *recentCache {
+	return &recentCache{entries: make([]*Entry, size)}
+}
+
+func (c *recentCache) add(entry *Entry) {
+	c.entries[c.next] = entry
+	c.next = (c.next + 1) % len(c.entries)
+	if c.count < len(c.entries) {
+		c.count++
+	}
+}
+
+// last returns the last n entries oldest first
+// It returns false if the cache doesn't hold n entries
+func (c *recentCache) last(n int) ([]*Entry, bool) {
+	if n > c.count {
+		return nil, false
+	}
+	entries := make([]*Entry, 0, n)
+	start := c.next - n + len(c.entries)
+	for i := 0; i < n; i++ {
+		entries = append(entries, c.entries[(start+i)%len(c.entries)])
+	}
+	return entries, true
+}
+
+// since returns the entries after seqNo oldest first
+// It returns false if the cache doesn't go back far enough to hold all of them
+func (c *recentCache) since(seqNo uint64) ([]*Entry, bool) {
+	if c.count == 0 {
+		return nil, false
+	}
+	start := c.next - c.count + len(c.entries)
+	if c.entries[start%len(c.entries)].SeqNo > seqNo+1 {
+		return nil, false
+	}
+	entries := []*Entry{}
+	for i := 0; i < c.count; i++ {
+		if entry := c.entries[(start+i)%len(c.entries)]; entry.SeqNo > seqNo {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, true
+}
+
+// dropBefore forgets the cached entries below seqNo, like the ones evicted from the log
+func (c *recentCache) dropBefore(seqNo uint64) {
+	for c.count > 0 {
+		oldest := c.entries[(c.next-c.count+len(c.entries))%len(c.entries)]
+		if oldest.SeqNo >= seqNo {
+			return
+		}
+		c.count--
+	}
+}
+
+// LastN returns the last n entries of the log oldest first, or all of them if the log is shorter
+// They are served from the recent entries cache when it holds enough entries, otherwise from disk
+func (wal *WriteAheadLog) LastN(n int) ([]*Entry, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("invalid number of entries %d", n)
+	}
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.recentCache != nil {
+		if entries, ok := wal.recentCache.last(n); ok {
+			return entries, nil
+		}
+	}
+	if err := wal.bufWriter.Flush(); err != nil {
+		return nil, err
+	}
+	entries, err := wal.readAllEntries(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) > n {
+		entries = entries[len(entries)-n:]
+	}
+	return entries, nil
+}
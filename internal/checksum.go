@@ -0,0 +1,162 @@
+package wal
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// ChecksumFunc returns a new hash computing the checksum of an entry
+type ChecksumFunc func() hash.Hash32
+
+// CRC32IEEE computes the entry checksums with CRC-32 and the IEEE polynomial, it's the default
+var CRC32IEEE ChecksumFunc = crc32.NewIEEE
+
+// CRC32C computes the entry checksums with CRC-32 and the Castagnoli polynomial
+var CRC32C ChecksumFunc = func() hash.Hash32 {
+	return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+}
+
+// ChecksumType selects a built-in checksum algorithm. Entries record the type they were written with,
+// so they are verified with it whatever the WAL reading them is configured with
+type ChecksumType uint32
+
+const (
+	// ChecksumConfigured leaves the checksum to Options.Checksum. New entries only get it with a custom
+	// Options.Checksum, entries written before the type was recorded have it too
+	ChecksumConfigured ChecksumType = iota
+	// ChecksumCRC32Castagnoli is CRC-32 with the Castagnoli polynomial, hardware accelerated on most CPUs
+	ChecksumCRC32Castagnoli
+	// ChecksumCRC64ECMA is CRC-64 with the ECMA polynomial, its high 32 bits are stored in ChecksumHigh
+	ChecksumCRC64ECMA
+	// ChecksumCRC32IEEE is CRC-32 with the IEEE polynomial, the default
+	ChecksumCRC32IEEE
+)
+
+// entryChecksums returns the checksum of an entry, in the algorithm of its ChecksumType or checksum for the others
+// The high 32 bits are 0 unless the algorithm is a 64-bit one
+func entryChecksums(checksum ChecksumFunc, entry *Entry, seqNo uint64) (uint32, uint32) {
+	switch ChecksumType(entry.ChecksumType) {
+	case ChecksumCRC32IEEE:
+		checksum = CRC32IEEE
+	case ChecksumCRC32Castagnoli:
+		checksum = CRC32C
+	case ChecksumCRC64ECMA:
+		hash := crc64.New(crc64.MakeTable(crc64.ECMA))
+		writeChecksumInput(hash, entry, seqNo)
+		sum := hash.Sum64()
+		return uint32(sum), uint32(sum >> 32)
+	}
+	hash := checksum()
+	writeChecksumInput(hash, entry, seqNo)
+	return hash.Sum32(), 0
+}
+
+// stampChecksum sets the checksum of an entry, computed with the algorithm of its ChecksumType or checksum
+func stampChecksum(checksum ChecksumFunc, entry *Entry, seqNo uint64) {
+	entry.Checksum, entry.ChecksumHigh = entryChecksums(checksum, entry, seqNo)
+}
+
+// RechecksumLog converts the entries of a closed log from one checksum algorithm to another
+// Every entry is validated with from and gets a checksum computed with to, the segments are rewritten
+// in place and stay sealed or compressed. A pending ReplaceAll is completed first so its segments are converted too
+// Each segment is replaced atomically and entries already valid under to are kept as they are,
+// so after a crash the conversion can simply run again. It returns ErrLogOpen while a WAL has dir open
+// The entries are decoded with the default ProtobufCodec
+func RechecksumLog(dir string, from, to ChecksumFunc) error {
+	lock, err := lockLogDir(dir, true)
+	if err != nil {
+		return err
+	}
+	defer unlockLogDir(lock)
+
+	if err := finishReplace(osFS{}, dir); err != nil {
+		return fmt.Errorf("failed to complete the replacement of the log: %w", err)
+	}
+	logFiles, err := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	if err != nil {
+		return err
+	}
+	for _, logFile := range logFiles {
+		if err := rechecksumSegment(logFile, from, to); err != nil {
+			return fmt.Errorf("failed to convert segment %s: %w", logFile, err)
+		}
+	}
+	return nil
+}
+
+// rechecksumSegment rewrites a segment file with the checksums of its entries computed with to
+func rechecksumSegment(path string, from, to ChecksumFunc) error {
+	content, err := readSegmentFile(path)
+	if err != nil {
+		return err
+	}
+	if err := checkSegmentFooter(content); err != nil {
+		return err
+	}
+	// The entries are verified below, they may be valid under either algorithm
+	sr, err := newSegmentReader(io.NopCloser(bytes.NewReader(content)), path, ProtobufCodec{}, nil)
+	if err != nil {
+		return err
+	}
+	// Entries already converted by an interrupted run are kept, the others are verified with from
+	// or the built-in algorithm of their ChecksumType
+	convert := func(entry *Entry) error {
+		if ChecksumType(entry.ChecksumType) == ChecksumConfigured && verifyChecksum(to, entry) {
+			return nil
+		}
+		if err := validateChecksum(from, entry); err != nil {
+			return err
+		}
+		// The entry takes the checksum of to, not the one of its own algorithm
+		entry.ChecksumType = uint32(ChecksumConfigured)
+		stampChecksum(to, entry, entry.SeqNo)
+		return nil
+	}
+	entries := []*Entry{}
+	for {
+		entry, err := sr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := convert(entry); err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+	if sr.segmentMeta != nil {
+		if err := convert(sr.segmentMeta); err != nil {
+			return err
+		}
+		entries = append([]*Entry{sr.segmentMeta}, entries...)
+	}
+
+	data, err := encodeSegment(entries, ProtobufCodec{}, sr.header.framing(), hasSegmentFooter(content), isCompressedSegment(path))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(osFS{}, path, data)
+}
+
+// readSegmentFile returns the uncompressed content of a segment file
+func readSegmentFile(path string) ([]byte, error) {
+	content, err := os.ReadFile(path)
+	if err != nil || !isCompressedSegment(path) {
+		return content, err
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	return io.ReadAll(zr)
+}
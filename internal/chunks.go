@@ -0,0 +1,80 @@
+package wal
+
+import (
+	"fmt"
+)
+
+// WriteLarge writes a payload that may be larger than a segment
+// Payloads over MaxEntrySize are split into chained entries carrying a chunk index and a "more chunks" flag,
+// the chunks are written back to back and may span segments
+// Readers reassemble the chunks and return the payload as a single entry
+func (wal *WriteAheadLog) WriteLarge(data []byte) error {
+	if wal.validate != nil {
+		if err := wal.validate(data); err != nil {
+			return err
+		}
+	}
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return fmt.Errorf("WAL is closed, cannot write data")
+	}
+	if len(data) <= wal.maxEntrySize {
+		return wal.appendEntry(&Entry{Data: data})
+	}
+	for chunkIndex := 0; len(data) > 0; chunkIndex++ {
+		size := min(len(data), wal.maxEntrySize)
+		entry := &Entry{
+			Data:       data[:size:size], // the checksum appends to the payload, keep it off the next chunk
+			ChunkIndex: uint32(chunkIndex),
+			MoreChunks: size < len(data),
+		}
+		if err := wal.appendEntry(entry); err != nil {
+			return fmt.Errorf("failed to write chunk %d: %w", chunkIndex, err)
+		}
+		data = data[size:]
+	}
+	return nil
+}
+
+// chunkAssembler joins the chunks written by WriteLarge back into a single entry
+// A chain that is interrupted, like the tail of a write cut short by a crash, is dropped
+type chunkAssembler struct {
+	first *Entry // first chunk of the chain being assembled
+	data  []byte // payload assembled so far
+	next  uint32 // index of the next expected chunk
+
+	checksum ChecksumFunc // recomputes the checksum of the reassembled entry
+}
+
+// add takes the next entry of the log and returns the entry to hand to the reader, if any
+// The reassembled entry keeps the sequence number and the flags of the first chunk
+func (ca *chunkAssembler) add(entry *Entry) (*Entry, bool) {
+	if entry.ChunkIndex == 0 {
+		ca.first = nil
+		if !entry.MoreChunks {
+			return entry, true
+		}
+		ca.first = entry
+		ca.data = append([]byte{}, entry.Data...)
+		ca.next = 1
+		return nil, false
+	}
+	if ca.first == nil || entry.ChunkIndex != ca.next {
+		ca.first = nil
+		return nil, false
+	}
+	ca.data = append(ca.data, entry.Data...)
+	ca.next++
+	if entry.MoreChunks {
+		return nil, false
+	}
+
+	assembled := ca.first.clone()
+	assembled.Data = ca.data
+	assembled.MoreChunks = false
+	stampChecksum(ca.checksum, assembled, assembled.SeqNo)
+	ca.first, ca.data = nil, nil
+	return assembled, true
+}
@@ -0,0 +1,123 @@
+package wal
+
+import (
+	"bytes"
+	wal_pb "wal/proto"
+
+	pb "google.golang.org/protobuf/proto"
+)
+
+// Entry is an entry of the log independent of its serialization, the readers return it and the codecs store it
+// The fields after IsCheckpoint are the rest of the metadata kept by the WAL, a codec must keep them
+// all for the checksums to verify
+type Entry struct {
+	SeqNo              uint64
+	Data               []byte
+	Checksum           uint32
+	IsCheckpoint       bool
+	TimestampUnixNano  int64
+	IsBarrier          bool
+	ChunkIndex         uint32
+	MoreChunks         bool
+	UserVersion        uint32
+	Nonce              uint64
+	IsSegmentMeta      bool
+	IsCompressed       bool
+	UncompressedLength uint32
+	TxnId              uint64
+	TxnCommit          bool
+	ChecksumType       uint32
+	ChecksumHigh       uint32
+	Compression        uint32
+	CipherNonce        []byte
+	TimestampChecked   bool
+	HeaderChecked      bool
+}
+
+// EntryCodec serializes the body of an entry, its metadata and payload
+// The size prefix and the segment framing around it don't depend on the codec
+// Unmarshal must return the entry given to Marshal
+// It replaces the Codec interface encoding an EntryMeta and the payload apart, see the README
+type EntryCodec interface {
+	Marshal(entry *Entry) ([]byte, error)
+	Unmarshal(b []byte) (*Entry, error)
+}
+
+// ProtobufCodec encodes entries as the WAL_DATA protobuf message, it's the default codec
+type ProtobufCodec struct{}
+
+// Marshal encodes the entry as a WAL_DATA message, the optional flags are only set when true
+func (ProtobufCodec) Marshal(entry *Entry) ([]byte, error) {
+	message := &wal_pb.WAL_DATA{
+		LogSeqNo:           entry.SeqNo,
+		Data:               entry.Data,
+		Checksum:           entry.Checksum,
+		TimestampUnixNano:  entry.TimestampUnixNano,
+		ChunkIndex:         entry.ChunkIndex,
+		UserVersion:        entry.UserVersion,
+		Nonce:              entry.Nonce,
+		UncompressedLength: entry.UncompressedLength,
+		TxnId:              entry.TxnId,
+		ChecksumType:       entry.ChecksumType,
+		ChecksumHigh:       entry.ChecksumHigh,
+		Compression:        entry.Compression,
+		CipherNonce:        entry.CipherNonce,
+	}
+	flags := []struct {
+		set   bool
+		field **bool
+	}{
+		{entry.IsCheckpoint, &message.IsCheckpoint},
+		{entry.IsBarrier, &message.IsBarrier},
+		{entry.MoreChunks, &message.MoreChunks},
+		{entry.IsSegmentMeta, &message.IsSegmentMeta},
+		{entry.IsCompressed, &message.IsCompressed},
+		{entry.TxnCommit, &message.TxnCommit},
+		{entry.TimestampChecked, &message.TimestampChecked},
+		{entry.HeaderChecked, &message.HeaderChecked},
+	}
+	for _, flag := range flags {
+		if flag.set {
+			*flag.field = pb.Bool(true)
+		}
+	}
+	return pb.Marshal(message)
+}
+
+func (ProtobufCodec) Unmarshal(b []byte) (*Entry, error) {
+	message := &wal_pb.WAL_DATA{}
+	if err := pb.Unmarshal(b, message); err != nil {
+		return nil, err
+	}
+	return &Entry{
+		SeqNo:              message.GetLogSeqNo(),
+		Data:               message.GetData(),
+		Checksum:           message.GetChecksum(),
+		IsCheckpoint:       message.GetIsCheckpoint(),
+		TimestampUnixNano:  message.GetTimestampUnixNano(),
+		IsBarrier:          message.GetIsBarrier(),
+		ChunkIndex:         message.GetChunkIndex(),
+		MoreChunks:         message.GetMoreChunks(),
+		UserVersion:        message.GetUserVersion(),
+		Nonce:              message.GetNonce(),
+		IsSegmentMeta:      message.GetIsSegmentMeta(),
+		IsCompressed:       message.GetIsCompressed(),
+		UncompressedLength: message.GetUncompressedLength(),
+		TxnId:              message.GetTxnId(),
+		TxnCommit:          message.GetTxnCommit(),
+		ChecksumType:       message.GetChecksumType(),
+		ChecksumHigh:       message.GetChecksumHigh(),
+		Compression:        message.GetCompression(),
+		CipherNonce:        message.GetCipherNonce(),
+		TimestampChecked:   message.GetTimestampChecked(),
+		HeaderChecked:      message.GetHeaderChecked(),
+	}, nil
+}
+
+// clone returns a copy of the entry, its payload and nonce included
+func (entry *Entry) clone() *Entry {
+	cloned := *entry
+	cloned.Data = bytes.Clone(entry.Data)
+	cloned.CipherNonce = bytes.Clone(entry.CipherNonce)
+	return &cloned
+}
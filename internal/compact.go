@@ -0,0 +1,130 @@
+package wal
+
+import (
+	"fmt"
+)
+
+// CompactCheckpoints keeps the latest keep checkpoint markers and demotes the older ones to regular entries
+// The demoted entries stay in the log with their payload, only their checkpoint flag is cleared
+// Segments holding a demoted checkpoint are rewritten in place
+func (wal *WriteAheadLog) CompactCheckpoints(keep int) error {
+	if keep < 0 {
+		return fmt.Errorf("invalid number of checkpoints to keep %d", keep)
+	}
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if err := wal.bufWriter.Flush(); err != nil {
+		return err
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return err
+	}
+
+	// Find the segment of every checkpoint, oldest first
+	type checkpoint struct {
+		seqNo   uint64
+		logFile string
+	}
+	checkpoints := []checkpoint{}
+	for _, logFile := range logFiles {
+		entries, err := wal.readSegment(logFile)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			if entry.IsCheckpoint {
+				checkpoints = append(checkpoints, checkpoint{seqNo: entry.SeqNo, logFile: logFile})
+			}
+		}
+	}
+	if len(checkpoints) <= keep {
+		return nil
+	}
+
+	demote := map[uint64]bool{}
+	demoteFiles := []string{}
+	for _, cp := range checkpoints[:len(checkpoints)-keep] {
+		demote[cp.seqNo] = true
+		if len(demoteFiles) == 0 || demoteFiles[len(demoteFiles)-1] != cp.logFile {
+			demoteFiles = append(demoteFiles, cp.logFile)
+		}
+	}
+	for _, logFile := range demoteFiles {
+		err := wal.rewriteSegment(logFile, func(entries []*Entry) []*Entry {
+			for _, entry := range entries {
+				if demote[entry.SeqNo] {
+					entry.IsCheckpoint = false
+					// The checksum of entries flagged HeaderChecked covers the flag
+					stampChecksum(wal.checksum, entry, entry.SeqNo)
+				}
+			}
+			return entries
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if wal.recentCache != nil {
+		// The cached entries may have been returned by LastN or Tail, they are replaced rather than changed
+		for i, entry := range wal.recentCache.entries {
+			if entry != nil && demote[entry.SeqNo] {
+				demoted := entry.clone()
+				demoted.IsCheckpoint = false
+				stampChecksum(wal.checksum, demoted, demoted.SeqNo)
+				wal.recentCache.entries[i] = demoted
+			}
+		}
+	}
+	// Count again on the next call, all the checkpoints may have been demoted
+	wal.sinceCheckpointKnown = false
+	return nil
+}
+
+// PurgeBeforeCheckpoint deletes the segments whose entries all precede the most recent checkpoint,
+// recovery starts at the checkpoint and doesn't need them. The active segment is never deleted
+// It returns the number of bytes reclaimed
+func (wal *WriteAheadLog) PurgeBeforeCheckpoint() (int64, error) {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return 0, fmt.Errorf("WAL is closed, cannot purge data")
+	}
+	if wal.lastCheckpointSeqNo == 0 {
+		return 0, nil
+	}
+	if err := wal.bufWriter.Flush(); err != nil {
+		return 0, err
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return 0, err
+	}
+	var reclaimed int64
+	for len(logFiles) > 1 {
+		nextFirstSeqNo, ok, err := wal.segmentFirstSeqNo(logFiles[1])
+		if err != nil {
+			return reclaimed, err
+		}
+		if !ok || nextFirstSeqNo > wal.lastCheckpointSeqNo {
+			break
+		}
+		// The checkpoint is in a later segment, all the entries of the oldest one precede it
+		fileInfo, err := wal.fs.Stat(logFiles[0])
+		if err != nil {
+			return reclaimed, err
+		}
+		if err := wal.removeOldestSegment(logFiles[0]); err != nil {
+			return reclaimed, fmt.Errorf("failed to purge segment %s: %w", logFiles[0], err)
+		}
+		reclaimed += fileInfo.Size()
+		if wal.recentCache != nil {
+			wal.recentCache.dropBefore(nextFirstSeqNo)
+		}
+		logFiles = logFiles[1:]
+	}
+	return reclaimed, nil
+}
@@ -0,0 +1,103 @@
+package wal
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// zstdEncoder compresses the payloads with Zstandard, EncodeAll is safe for concurrent use
+var zstdEncoder = sync.OnceValues(func() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil)
+})
+
+// compressEntry replaces the payload of an entry with its compressed bytes, CompressionNone stands for
+// the DEFLATE of CompressEntries, recorded as 0. The checksum is computed afterwards, over the compressed bytes
+func compressEntry(entry *Entry, compression Compression) error {
+	var compressed bytes.Buffer
+	switch compression {
+	case CompressionZstd:
+		encoder, err := zstdEncoder()
+		if err != nil {
+			return err
+		}
+		compressed.Write(encoder.EncodeAll(entry.Data, nil))
+	case CompressionGzip:
+		gw := gzip.NewWriter(&compressed)
+		if _, err := gw.Write(entry.Data); err != nil {
+			return err
+		}
+		if err := gw.Close(); err != nil {
+			return err
+		}
+	default:
+		fw, err := flate.NewWriter(&compressed, flate.DefaultCompression)
+		if err != nil {
+			return err
+		}
+		if _, err := fw.Write(entry.Data); err != nil {
+			return err
+		}
+		if err := fw.Close(); err != nil {
+			return err
+		}
+	}
+	entry.UncompressedLength = uint32(len(entry.Data))
+	entry.Data = compressed.Bytes()
+	entry.IsCompressed = true
+	entry.Compression = uint32(compression)
+	return nil
+}
+
+// decompressor returns a reader of the decompressed payload of an entry, for the algorithm it records
+func decompressor(entry *Entry) (io.ReadCloser, error) {
+	compressed := bytes.NewReader(entry.Data)
+	switch Compression(entry.Compression) {
+	case CompressionNone:
+		return flate.NewReader(compressed), nil
+	case CompressionGzip:
+		return gzip.NewReader(compressed)
+	case CompressionZstd:
+		zr, err := zstd.NewReader(compressed, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unknown compression %d", entry.Compression)
+}
+
+// decompressEntry returns the entry with its payload decompressed, entries that aren't compressed are returned as is
+// The checksum of the stored bytes must have been verified before. The decompressed payload must have the stored length,
+// it gets a checksum of its own like the entries written uncompressed
+func decompressEntry(checksum ChecksumFunc, entry *Entry) (*Entry, error) {
+	if !entry.IsCompressed {
+		return entry, nil
+	}
+	dr, err := decompressor(entry)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress entry with seq no %d: %w", entry.SeqNo, err)
+	}
+	defer dr.Close()
+	// Read one byte past the stored length to detect a longer payload without inflating it all
+	data, err := io.ReadAll(io.LimitReader(dr, int64(entry.UncompressedLength)+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress entry with seq no %d: %w", entry.SeqNo, err)
+	}
+	if len(data) != int(entry.UncompressedLength) {
+		return nil, fmt.Errorf("%w: entry with seq no %d decompressed to more or less than %d bytes",
+			ErrUncompressedLengthMismatch, entry.SeqNo, entry.UncompressedLength)
+	}
+	decompressed := entry.clone()
+	decompressed.Data = data
+	decompressed.IsCompressed = false
+	decompressed.UncompressedLength = 0
+	decompressed.Compression = 0
+	stampChecksum(checksum, decompressed, decompressed.SeqNo)
+	return decompressed, nil
+}
@@ -1,23 +1,297 @@
 package wal
 
 import (
+	"crypto/cipher"
+	"fmt"
+	"io"
+	"log"
+	"os"
 	"time"
 )
 
+// MissingSegmentsPolicy decides what to do when the log directory exists
+// but all the segment files are gone (e.g. deleted externally)
+type MissingSegmentsPolicy int
+
+const (
+	// MissingSegmentsError returns an error wrapping ErrNoSegments
+	MissingSegmentsError MissingSegmentsPolicy = iota
+	// MissingSegmentsCreate starts over with a fresh segment file
+	MissingSegmentsCreate
+)
+
+// SegmentGapPolicy decides what to do when segment files are missing
+// between the oldest and the newest segment (e.g. a segment deleted by hand)
+type SegmentGapPolicy int
+
+const (
+	// SegmentGapError fails Open and the ordered reads with an ErrSegmentGap
+	SegmentGapError SegmentGapPolicy = iota
+	// SegmentGapWarn logs the missing segments and goes on with the others
+	SegmentGapWarn
+)
+
+// OrderingMode decides how reads handle entries stored out of sequence number order
+type OrderingMode int
+
+const (
+	// OrderingAsStored returns the entries in the order they are stored
+	OrderingAsStored OrderingMode = iota
+	// OrderingStrict fails the read with ErrOutOfOrder at the first entry
+	// whose seq number isn't above the one of the previous entry
+	OrderingStrict
+	// OrderingLenient tolerates such entries, ReadAll returns the entries sorted by seq number
+	OrderingLenient
+)
+
+// CorruptionPolicy decides what the reads do with an entry failing to decode or its checksum
+type CorruptionPolicy int
+
+const (
+	// CorruptError fails the read, and Open when recovery reaches the entry
+	CorruptError CorruptionPolicy = iota
+	// CorruptSkip logs and skips the entry, the read goes on with the next one
+	CorruptSkip
+	// CorruptTruncate ends the log before the entry, Open truncates the log there
+	CorruptTruncate
+)
+
+// Compression is the algorithm compressing the payload of the entries, recorded with every entry
+type Compression int
+
+const (
+	// CompressionNone stores the payloads as they are, unless CompressEntries is set
+	CompressionNone Compression = iota
+	// CompressionGzip compresses the payloads with gzip
+	CompressionGzip
+	// CompressionZstd compresses the payloads with Zstandard
+	CompressionZstd
+)
+
+// Logger receives the diagnostics of the WAL, like a failed background sync, *log.Logger implements it
+type Logger interface {
+	Printf(format string, v ...any)
+}
+
+// Option configures Open. *Options is an Option setting every field it doesn't leave to its zero value,
+// the With functions set a single field, including to its zero value
+type Option interface {
+	apply(config *Options)
+}
+
+// optionFunc is an Option setting a field of the configuration
+type optionFunc func(config *Options)
+
+func (f optionFunc) apply(config *Options) {
+	f(config)
+}
+
+// WithLogDir sets the directory of the segment files
+func WithLogDir(dir string) Option {
+	return optionFunc(func(config *Options) { config.LogDir = dir })
+}
+
+// WithMaxLogFileSize sets the size at which a segment is rotated
+func WithMaxLogFileSize(size int32) Option {
+	return optionFunc(func(config *Options) { config.MaxLogFileSize = size })
+}
+
+// WithMaxSegments sets the maximum number of segments kept, the oldest ones are deleted on rotation
+func WithMaxSegments(n int) Option {
+	return optionFunc(func(config *Options) { config.maxSegments = n })
+}
+
+// WithSyncInterval sets the interval of the periodic sync
+func WithSyncInterval(interval time.Duration) Option {
+	return optionFunc(func(config *Options) { config.SyncInterval = interval })
+}
+
+// WithSync enables or disables the periodic sync, unlike EnableSync in Options false overrides an earlier true
+func WithSync(enabled bool) Option {
+	return optionFunc(func(config *Options) { config.EnableSync = enabled })
+}
+
 type Options struct {
-	LogDir         string
-	MaxLogFileSize int32
-	maxSegments    int
-	EnableSync     bool
-	SyncInterval   time.Duration
+	LogDir            string
+	MaxLogFileSize    int32
+	maxSegments       int
+	EnableSync        bool
+	SyncInterval      time.Duration
+	OnMissingSegments MissingSegmentsPolicy
+	// SyncTimeout bounds how long Sync waits for the fsync of the segment file, it returns ErrSyncTimeout past it
+	// The fsync keeps running in the background, 0 means no limit
+	SyncTimeout time.Duration
+	// Clock returns the wall time used to stamp entries, defaults to time.Now
+	Clock func() time.Time
+	// MonotonicTimestamps derives entry timestamps from the wall time captured at Open
+	// plus the monotonic time elapsed since, so wall clock adjustments can't move them backwards
+	MonotonicTimestamps bool
+	// MaxRecoveryScanBytes bounds how many bytes of segments Open may scan
+	// to recover the last sequence number, 0 means no limit
+	MaxRecoveryScanBytes int64
+	// CompressSealedSegments gzip compresses segments in the background once they are rotated out
+	// The active segment is never compressed
+	CompressSealedSegments bool
+	// RecentCacheSize keeps the last N written entries in memory so LastN and Tail can skip the disk
+	// The cache is filled on write, so it spans rotations. 0 disables the cache
+	RecentCacheSize int
+	// SegmentCountWarnThreshold emits a warning once the number of segments exceeds it after a rotation
+	// 0 disables the warning
+	SegmentCountWarnThreshold int
+	// OnSegmentCountWarning receives the segment count when the warning fires, by default it is logged
+	OnSegmentCountWarning func(segmentCount int)
+	// SingleWriter replaces the internal mutex with no-op locking for callers that never
+	// use the WAL from more than one goroutine, it is unsafe for concurrent use
+	// There is no background sync goroutine in this mode, the periodic sync runs on the next write instead
+	// and sealed segments are compressed inline during rotation
+	SingleWriter bool
+	// MaxEntrySize is the largest payload WriteLarge puts in a single entry, larger payloads are split
+	// into chained entries, it defaults to half of MaxLogFileSize
+	MaxEntrySize int
+	// VerifySeqNo makes the readers check that the sequence numbers of the log are contiguous
+	// The checksum only covers the low byte of the sequence number, which is always cross-checked,
+	// this catches the other bytes being altered
+	// Logs with gaps, like the ones bootstrapped by ReplaceAll from sparse entries, fail it
+	VerifySeqNo bool
+	// EntryNonces stamps every entry with a nonce that increases independently of the sequence number
+	// Readers reject a log where a nonce doesn't increase, like an entry replayed from elsewhere
+	EntryNonces bool
+	// Codec serializes the entries inside the segment framing, defaults to ProtobufCodec
+	// RawCodec stores them without protobuf
+	// A log must always be opened with the codec it was written with
+	Codec EntryCodec
+	// ChecksumType selects a built-in checksum algorithm for the new entries, recorded with each entry
+	// so a log reads the same whatever Checksum it's reopened with. Defaults to ChecksumCRC32IEEE,
+	// or to ChecksumConfigured when Checksum is set
+	ChecksumType ChecksumType
+	// Checksum computes the checksum of the entries recorded as ChecksumConfigured, defaults to CRC32IEEE
+	// RechecksumLog converts an existing log to another one
+	Checksum ChecksumFunc
+	// ReplicaSink receives every entry framed as in a segment, its size followed by its body,
+	// synchronously before the entry is written locally, so a standby can follow the same stream
+	ReplicaSink io.Writer
+	// FailOnReplicaError fails the write when the replica sink returns an error, the entry isn't written locally
+	// Otherwise the error is logged and the entry is still written
+	FailOnReplicaError bool
+	// OpenRetries is how many more times Open tries to open the last segment for appending
+	// when it fails, like while an antivirus or a backup agent briefly locks it. 0 means no retry
+	OpenRetries int
+	// OpenRetryBackoff is the wait before the first retry, doubled for every next one
+	OpenRetryBackoff time.Duration
+	// OnSegmentGap decides what to do when segment files are missing in the middle of the log
+	OnSegmentGap SegmentGapPolicy
+	// OnCorruption decides what to do with a corrupted entry, defaults to CorruptError
+	OnCorruption CorruptionPolicy
+	// OrderingMode decides how reads handle entries stored out of sequence number order
+	OrderingMode OrderingMode
+	// SegmentMetaEntries starts every segment with an entry describing it, its ID, first seq number,
+	// creation time and a hash of the options, so a segment is self-describing. See ReadSegmentMeta
+	SegmentMetaEntries bool
+	// FlushOnlyWithoutFsync probes fsync on the active segment at Open, if the filesystem doesn't support it
+	// a warning is logged and the WAL falls back to flushing the entries to the OS without fsyncing them
+	FlushOnlyWithoutFsync bool
+	// VerifyRawChecksums verifies the checksum of the entries written with WriteRaw
+	VerifyRawChecksums bool
+	// MaxTotalEntries bounds the log to the most recent entries, counted by seq number, like a circular log
+	// Once a write goes a quarter of it beyond, the oldest entries are trimmed back to it, whole segments first
+	// Entries from the most recent checkpoint on are never trimmed, 0 means no limit
+	MaxTotalEntries int
+	// CompressEntries compresses the payload of every entry with DEFLATE, its checksum covers the compressed bytes
+	// and its uncompressed length, so corruption is caught before decompressing. Reads return the payload decompressed
+	CompressEntries bool
+	// Compression compresses the payload of every entry with the given algorithm, in place of the DEFLATE of CompressEntries
+	// Each entry records its algorithm so a log mixing them reads back, its checksum covers the compressed bytes
+	Compression Compression
+	// Cipher encrypts the payload of every entry, after its compression, with a random nonce stored with the entry
+	// Reads authenticate and decrypt the payloads, failing with ErrDecryptionFailed with another key,
+	// for a payload moved to another entry or for an entry stored in clear
+	// The checksum covers the encrypted bytes, the metadata of the entries is stored in clear but authenticated with the payload
+	Cipher cipher.AEAD
+	// PersistCount keeps the entry count returned by Count in the COUNT file, stored on rotation and Close,
+	// so Count doesn't scan a reopened log. A count left stale by a crash is detected and the log scanned instead
+	PersistCount bool
+	// Framing is how the size of the entries is encoded in the new segments, defaults to FramingFixed32
+	// Every segment records its framing, existing segments keep theirs, see ConvertFraming
+	Framing FramingMode
+	// GroupCommitWindow makes the WriteSync calls made within the window share a single sync, 0 syncs every call
+	GroupCommitWindow time.Duration
+	// DoubleBuffer writes a full write buffer to the segment file in the background while the writes fill
+	// a second one, so a write doesn't wait for the flush of the buffer. The entries reach the file in order,
+	// Sync and Close wait for both buffers
+	DoubleBuffer bool
+	// BeforeWrite is called with every entry before it is serialized, like for tracing or auditing
+	// It may set metadata fields like the user version, the sequence number, timestamp, nonce and checksum
+	// are stamped after it. An error aborts the write. The chunks of WriteLarge are passed one by one
+	// It runs under the lock of the WAL and must not call it
+	BeforeWrite func(entry *Entry) error
+	// AfterWrite is called with every entry once it is written into the buffer, stamped with its sequence number
+	// It runs under the lock of the WAL and must not call it
+	AfterWrite func(entry *Entry)
+	// DirRotation lists the directories new segments move on to, in order, once LogDir holds
+	// more than DirRotationBytes of segments, like for tiered storage. The last one takes the rest
+	// LogDir keeps the lock and the sidecar files, readers span LogDir and these directories in order
+	DirRotation []string
+	// DirRotationBytes is the size of the segments a directory may hold before the next segment
+	// is created in the next directory of DirRotation, the check runs on rotation
+	DirRotationBytes int64
+	// ErrorHandler receives the errors of the periodic sync, like a full disk, so the application can react to them
+	// It is called from the sync goroutine, or from the write running the sync in SingleWriter mode. By default they are logged
+	ErrorHandler func(err error)
+	// RetentionAge deletes the oldest segments once their newest entry is older than it, on rotation and with
+	// PurgeExpired. The segment holding the most recent checkpoint and the ones after it are kept, 0 keeps everything
+	RetentionAge time.Duration
+	// MaxTotalSize bounds the bytes the segments take on disk, the oldest segments are deleted on rotation and with
+	// PurgeOverSize to stay under it, counting the active segment at MaxLogFileSize. The segment holding the most
+	// recent checkpoint and the ones after it are kept, 0 means no limit
+	MaxTotalSize int64
+	// Logger receives the diagnostics of the WAL, defaults to the standard logger
+	Logger Logger
+	// Validate checks the payload of every write before it is persisted, a write it fails
+	// is rejected with its error and doesn't consume a sequence number
+	// WriteLarge validates the whole payload before splitting it
+	Validate func(data []byte) error
+	// FS is the file system holding the segments and the files next to them, defaults to the one of the OS
+	FS FileSystem
+	// openFile opens the segment files, tests swap it to observe or fail file access
+	// It defaults to FS.OpenFile
+	openFile func(name string, flag int, perm os.FileMode) (File, error)
+	// fsync fsyncs the segment files, tests swap it to fail it
+	fsync func(file File) error
 }
 
 func DefaultConfig() *Options {
 	return &Options{
-		LogDir:         "./wal_data/",
-		MaxLogFileSize: 16 * 1024 * 1024, // 16MB
-		maxSegments:    5,
-		EnableSync:     false,
-		SyncInterval:   5 * time.Second,
+		LogDir:            "./wal_data/",
+		MaxLogFileSize:    16 * 1024 * 1024, // 16MB
+		maxSegments:       5,
+		EnableSync:        false,
+		SyncInterval:      5 * time.Second,
+		OnMissingSegments: MissingSegmentsError,
+		Clock:             time.Now,
+		Codec:             ProtobufCodec{},
+		ChecksumType:      ChecksumCRC32IEEE,
+		Checksum:          CRC32IEEE,
+		Logger:            log.Default(),
+		OpenRetryBackoff:  10 * time.Millisecond,
+		FS:                osFS{},
+		fsync:             File.Sync,
+	}
+}
+
+// checkConfig returns an error wrapping ErrInvalidConfig for the options that can't work, once the defaults are applied
+func checkConfig(config *Options) error {
+	if config.LogDir == "" {
+		return fmt.Errorf("%w: LogDir is empty", ErrInvalidConfig)
+	}
+	if config.MaxLogFileSize <= 0 {
+		return fmt.Errorf("%w: MaxLogFileSize must be positive, got %d", ErrInvalidConfig, config.MaxLogFileSize)
+	}
+	if config.maxSegments < 1 {
+		return fmt.Errorf("%w: the maximum number of segments must be at least 1, got %d", ErrInvalidConfig, config.maxSegments)
+	}
+	// Without the periodic sync the interval isn't used
+	if config.EnableSync && config.SyncInterval <= 0 {
+		return fmt.Errorf("%w: SyncInterval must be positive with EnableSync, got %v", ErrInvalidConfig, config.SyncInterval)
 	}
+	return nil
 }
@@ -1,3 +1,23 @@
 package wal
 
 const segmentPrefix = "segment-"
+
+// compressedSuffix is appended to sealed segments compressed with gzip
+const compressedSuffix = ".gz"
+
+// cursorFileName stores the position applied by ResumeFromCursor
+const cursorFileName = "CURSOR"
+
+// watermarkFileName stores the application watermark set by SetWatermark
+const watermarkFileName = "WATERMARK"
+
+// countFileName stores the entry count with Options.PersistCount
+const countFileName = "COUNT"
+
+// replaceStagingDirName holds the segments being prepared by ReplaceAll
+// Once complete it is renamed to replaceReadyDirName, which commits the replacement
+const (
+	replaceStagingDirName = "REPLACE.tmp"
+	replaceReadyDirName   = "REPLACE"
+	replaceManifestName   = "MANIFEST"
+)
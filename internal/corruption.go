@@ -0,0 +1,87 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// errCorruptionReached ends the reads of the log at a corrupted entry with CorruptTruncate
+var errCorruptionReached = errors.New("corrupted entry reached")
+
+// truncateAtCorruption cuts the log before its first corrupted entry, for CorruptTruncate
+// The segment holding it is truncated and the segments after it are deleted
+// An entry cut short at the end of the log is a torn write, it is left to openExistingSegment
+func (wal *WriteAheadLog) truncateAtCorruption() error {
+	logFiles, err := wal.listSegments()
+	if errors.Is(err, ErrNoSegments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for i, logFile := range logFiles {
+		file, err := wal.openSegmentContent(logFile)
+		if err != nil {
+			return err
+		}
+		content, err := io.ReadAll(file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read segment %s: %w", logFile, err)
+		}
+		offset, err := wal.firstCorruptionOffset(content)
+		if errors.Is(err, io.ErrUnexpectedEOF) && i == len(logFiles)-1 {
+			return nil
+		}
+		if err == nil {
+			continue
+		}
+
+		wal.logger.Printf("truncating the log at offset %d of segment %s, the entry there is corrupted: %v", offset, logFile, err)
+		// A compressed segment is written back uncompressed, it's now the active segment
+		rawPath := strings.TrimSuffix(logFile, compressedSuffix)
+		if err := writeFileAtomic(wal.fs, rawPath, content[:offset]); err != nil {
+			return err
+		}
+		if rawPath != logFile {
+			if err := wal.fs.Remove(logFile); err != nil {
+				return err
+			}
+		}
+		for _, later := range logFiles[i+1:] {
+			if err := wal.fs.Remove(later); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// firstCorruptionOffset returns the offset of the first entry of the segment content failing to read, with its error
+// It returns a nil error when the whole segment reads fine
+func (wal *WriteAheadLog) firstCorruptionOffset(content []byte) (int64, error) {
+	remaining := bytes.NewReader(content)
+	sr := &segmentReader{file: io.NopCloser(remaining), reader: bufio.NewReader(remaining), codec: wal.codec, checksum: wal.checksum}
+	var err error
+	if sr.header, err = readSegmentHeader(sr.reader); err != nil {
+		return 0, err
+	}
+	consumed := func() int64 {
+		return int64(len(content) - remaining.Len() - sr.reader.Buffered())
+	}
+	for {
+		offset := consumed()
+		_, err := sr.next()
+		if err == io.EOF {
+			return 0, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+	}
+}
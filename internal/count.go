@@ -0,0 +1,143 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Count returns the number of entries of the log, the ones ReadAll returns
+// It is maintained on write, the log is only scanned when the count isn't known, like after a trim
+// With Options.PersistCount it is kept in the COUNT file so a reopened log doesn't have to scan either
+func (wal *WriteAheadLog) Count() (uint64, error) {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+	return wal.countLocked()
+}
+
+// countLocked returns the entry count, scanning the log when it isn't known
+// The caller must hold the lock
+func (wal *WriteAheadLog) countLocked() (uint64, error) {
+	if !wal.countKnown {
+		if err := wal.bufWriter.Flush(); err != nil {
+			return 0, err
+		}
+		var count uint64
+		err := wal.forEach(func(*Entry) error {
+			count++
+			return nil
+		})
+		if err != nil {
+			return 0, err
+		}
+		wal.entryCount = count
+		wal.countKnown = true
+	}
+	return wal.entryCount, nil
+}
+
+// countEntry counts an entry written to the log, the chunks of a payload count as one
+// The caller must hold the lock
+func (wal *WriteAheadLog) countEntry(entry *Entry) {
+	if entry.ChunkIndex == 0 {
+		wal.entryCount++
+	}
+}
+
+// forgetCount drops the count after the entries changed in a way it can't follow, the next Count scans the log
+// The COUNT file is removed so a crash can't leave a count that looks current
+// The caller must hold the lock
+func (wal *WriteAheadLog) forgetCount() {
+	wal.countKnown = false
+	if !wal.persistCount {
+		return
+	}
+	if err := wal.fs.Remove(filepath.Join(wal.logDir, countFileName)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		wal.logger.Printf("failed to remove the entry count: %v", err)
+	}
+}
+
+// countSegmentEntries returns the number of entries of a segment file
+func (wal *WriteAheadLog) countSegmentEntries(path string) (uint64, error) {
+	sr, err := wal.openSegmentReader(path)
+	if err != nil {
+		return 0, err
+	}
+	defer sr.Close()
+	var count uint64
+	for {
+		entry, err := sr.next()
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return 0, err
+		}
+		if entry.ChunkIndex == 0 {
+			count++
+		}
+	}
+}
+
+// The COUNT file holds the entry count followed by the last seq number and the oldest segment ID
+// of the log it was counted on, as 8 bytes little-endian each. A count whose seq number or oldest
+// segment doesn't match the log is stale, like after a crash, and the log is scanned instead
+const countFileSize = 24
+
+// persistEntryCount stores the entry count in the COUNT file, if it is known
+// The caller must hold the lock
+func (wal *WriteAheadLog) persistEntryCount() error {
+	if !wal.persistCount || !wal.countKnown {
+		return nil
+	}
+	oldestSegmentNo, err := wal.oldestSegmentNo()
+	if err != nil {
+		return err
+	}
+	data := make([]byte, 0, countFileSize)
+	data = binary.LittleEndian.AppendUint64(data, wal.entryCount)
+	data = binary.LittleEndian.AppendUint64(data, wal.lastSeqNo)
+	data = binary.LittleEndian.AppendUint64(data, uint64(oldestSegmentNo))
+	if err := writeFileAtomic(wal.fs, filepath.Join(wal.logDir, countFileName), data); err != nil {
+		return fmt.Errorf("failed to persist the entry count: %w", err)
+	}
+	return nil
+}
+
+// loadEntryCount takes the entry count from the COUNT file when it is current
+func (wal *WriteAheadLog) loadEntryCount() error {
+	data, err := wal.fs.ReadFile(filepath.Join(wal.logDir, countFileName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if len(data) != countFileSize {
+		wal.logger.Printf("ignoring the entry count, invalid content in %s: %d bytes", countFileName, len(data))
+		return nil
+	}
+	oldestSegmentNo, err := wal.oldestSegmentNo()
+	if err != nil {
+		return err
+	}
+	if binary.LittleEndian.Uint64(data[8:]) != wal.lastSeqNo || binary.LittleEndian.Uint64(data[16:]) != uint64(oldestSegmentNo) {
+		// Stale, the log changed after the count was stored
+		return nil
+	}
+	wal.entryCount = binary.LittleEndian.Uint64(data)
+	wal.countKnown = true
+	return nil
+}
+
+// oldestSegmentNo returns the ID of the oldest segment of the log
+func (wal *WriteAheadLog) oldestSegmentNo() (int, error) {
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return 0, err
+	}
+	return parseSegmentNo(logFiles[0])
+}
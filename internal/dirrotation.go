@@ -0,0 +1,96 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// listSegments returns the segment files of the log oldest first
+// With Options.DirRotation they span the directories in order, the segment IDs keep increasing across them
+func (wal *WriteAheadLog) listSegments() ([]string, error) {
+	if len(wal.segmentDirs) == 0 {
+		return listSegmentFiles(wal.fs, wal.logFileNamePrefix)
+	}
+	logFiles := []string{}
+	for _, dir := range wal.segmentDirs {
+		dirFiles, err := listSegmentFiles(wal.fs, filepath.Join(dir, segmentPrefix))
+		if errors.Is(err, ErrNoSegments) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		logFiles = append(logFiles, dirFiles...)
+	}
+	if len(logFiles) == 0 {
+		return nil, fmt.Errorf("%w in directories: %v", ErrNoSegments, wal.segmentDirs)
+	}
+	return logFiles, nil
+}
+
+// selectSegmentDir makes the last directory holding segments the one new segments are written to
+func (wal *WriteAheadLog) selectSegmentDir() error {
+	for i, dir := range wal.segmentDirs {
+		if err := wal.fs.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+		if _, err := listSegmentFiles(wal.fs, filepath.Join(dir, segmentPrefix)); err == nil {
+			wal.segmentDir = i
+		}
+	}
+	wal.logFileNamePrefix = filepath.Join(wal.segmentDirs[wal.segmentDir], segmentPrefix)
+	return nil
+}
+
+// rotateSegmentDir moves on to the next directory of Options.DirRotation once the segments
+// of the current one exceed Options.DirRotationBytes, the last directory takes the rest
+func (wal *WriteAheadLog) rotateSegmentDir() error {
+	if wal.dirRotationBytes <= 0 || wal.segmentDir >= len(wal.segmentDirs)-1 {
+		return nil
+	}
+	logFiles, err := listSegmentFiles(wal.fs, filepath.Join(wal.segmentDirs[wal.segmentDir], segmentPrefix))
+	if errors.Is(err, ErrNoSegments) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, logFile := range logFiles {
+		fileInfo, err := wal.fs.Stat(logFile)
+		if err != nil {
+			return err
+		}
+		total += fileInfo.Size()
+	}
+	if total <= wal.dirRotationBytes {
+		return nil
+	}
+	wal.segmentDir++
+	wal.logFileNamePrefix = filepath.Join(wal.segmentDirs[wal.segmentDir], segmentPrefix)
+	return nil
+}
+
+// clearRotatedDirs removes the segments of the directories after LogDir, the ones ReplaceAll
+// doesn't swap, and goes back to writing into LogDir
+func (wal *WriteAheadLog) clearRotatedDirs() error {
+	if len(wal.segmentDirs) == 0 {
+		return nil
+	}
+	for _, dir := range wal.segmentDirs[1:] {
+		// Every file with the prefix goes, the compressed copies and leftovers listSegmentFiles skips too
+		oldFiles, err := filesWithPrefix(wal.fs, filepath.Join(dir, segmentPrefix))
+		if err != nil {
+			return err
+		}
+		for _, oldFile := range oldFiles {
+			if err := wal.fs.Remove(oldFile); err != nil {
+				return err
+			}
+		}
+	}
+	wal.segmentDir = 0
+	wal.logFileNamePrefix = filepath.Join(wal.segmentDirs[0], segmentPrefix)
+	return nil
+}
@@ -0,0 +1,103 @@
+package wal
+
+import (
+	"bufio"
+	"io"
+)
+
+// entryWriter buffers the encoded entries in front of the active segment
+type entryWriter interface {
+	io.Writer
+	// Flush writes the buffered entries into the segment file
+	Flush() error
+	// Size is the size of the buffer
+	Size() int
+}
+
+// defaultBufferSize is the size of the write buffer, the one bufio uses
+const defaultBufferSize = 4096
+
+// newEntryWriter returns the writer buffering the entries in front of the segment file
+func (wal *WriteAheadLog) newEntryWriter(file File) entryWriter {
+	if wal.doubleBuffer {
+		return newDoubleBuffer(file, defaultBufferSize)
+	}
+	return bufio.NewWriter(file)
+}
+
+// doubleBuffer is a write-behind buffer: once a buffer is full it is written to the file in the background
+// while the writes fill the other one. A single buffer is written at a time, so they reach the file in order
+// Flush returns once both buffers are written. A failed write is returned by every next call, like bufio does
+type doubleBuffer struct {
+	file     io.Writer
+	size     int
+	active   []byte
+	spare    []byte
+	flushed  chan error // receives the result of the write in flight
+	inFlight bool
+	err      error
+}
+
+func newDoubleBuffer(file io.Writer, size int) *doubleBuffer {
+	return &doubleBuffer{
+		file:    file,
+		size:    size,
+		active:  make([]byte, 0, size),
+		spare:   make([]byte, 0, size),
+		flushed: make(chan error, 1),
+	}
+}
+
+func (db *doubleBuffer) Write(p []byte) (int, error) {
+	if db.err != nil {
+		return 0, db.err
+	}
+	db.active = append(db.active, p...)
+	if len(db.active) >= db.size {
+		if err := db.swap(); err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// swap hands the active buffer to the background write and continues in the spare one
+// It first waits for the write in flight, the spare buffer is the one it was writing
+func (db *doubleBuffer) swap() error {
+	if err := db.wait(); err != nil {
+		return err
+	}
+	full := db.active
+	db.active, db.spare = db.spare[:0], nil
+	db.inFlight = true
+	go func() {
+		_, err := db.file.Write(full)
+		db.spare = full
+		db.flushed <- err
+	}()
+	return nil
+}
+
+// wait waits for the write in flight, if any
+func (db *doubleBuffer) wait() error {
+	if db.inFlight {
+		db.inFlight = false
+		if err := <-db.flushed; err != nil {
+			db.err = err
+		}
+	}
+	return db.err
+}
+
+func (db *doubleBuffer) Flush() error {
+	if len(db.active) > 0 {
+		if err := db.swap(); err != nil {
+			return err
+		}
+	}
+	return db.wait()
+}
+
+func (db *doubleBuffer) Size() int {
+	return db.size
+}
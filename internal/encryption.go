@@ -0,0 +1,80 @@
+package wal
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+)
+
+// encryptEntry replaces the payload of an entry with its encryption under a random nonce, stored with the entry
+// The entry must have its sequence number and header fields set, the payload is authenticated along with them
+// The checksum is computed afterwards, over the encrypted bytes and the nonce
+func encryptEntry(aead cipher.AEAD, entry *Entry) error {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return fmt.Errorf("failed to generate the nonce of an entry: %w", err)
+	}
+	entry.Data = aead.Seal(nil, nonce, entry.Data, cipherAdditionalData(entry))
+	entry.CipherNonce = nonce
+	return nil
+}
+
+// decryptEntry returns the entry with its payload authenticated and decrypted
+// With a cipher set every entry must be encrypted, one stored in clear fails like a payload with the wrong key.
+// Without one, entries stored in clear are returned as is
+// The checksum of the stored bytes must have been verified before, the decrypted payload gets a checksum of its own
+func decryptEntry(checksum ChecksumFunc, aead cipher.AEAD, entry *Entry) (*Entry, error) {
+	if len(entry.CipherNonce) == 0 {
+		if aead != nil {
+			return nil, fmt.Errorf("%w: entry with seq no %d is not encrypted", ErrDecryptionFailed, entry.SeqNo)
+		}
+		return entry, nil
+	}
+	if aead == nil {
+		return nil, fmt.Errorf("%w: entry with seq no %d is encrypted and no cipher is set", ErrDecryptionFailed, entry.SeqNo)
+	}
+	if len(entry.CipherNonce) != aead.NonceSize() {
+		return nil, fmt.Errorf("%w: entry with seq no %d has a %d bytes nonce, the cipher takes %d",
+			ErrDecryptionFailed, entry.SeqNo, len(entry.CipherNonce), aead.NonceSize())
+	}
+	data, err := aead.Open(nil, entry.CipherNonce, entry.Data, cipherAdditionalData(entry))
+	if err != nil {
+		return nil, fmt.Errorf("%w: entry with seq no %d: %v", ErrDecryptionFailed, entry.SeqNo, err)
+	}
+	decrypted := entry.clone()
+	decrypted.Data = data
+	decrypted.CipherNonce = nil
+	stampChecksum(checksum, decrypted, decrypted.SeqNo)
+	return decrypted, nil
+}
+
+// cipherAdditionalData is the metadata an encrypted payload is authenticated with, so it can't be moved to another entry
+// It holds the sequence number and the header fields covered by the checksum but the checkpoint flag,
+// which CompactCheckpoints clears without decrypting the payload
+func cipherAdditionalData(entry *Entry) []byte {
+	data := binary.LittleEndian.AppendUint64(nil, entry.SeqNo)
+	data = binary.LittleEndian.AppendUint64(data, uint64(entry.TimestampUnixNano))
+	data = binary.LittleEndian.AppendUint64(data, entry.Nonce)
+	data = binary.LittleEndian.AppendUint32(data, entry.UserVersion)
+	data = binary.LittleEndian.AppendUint64(data, entry.TxnId)
+	data = binary.LittleEndian.AppendUint32(data, entry.ChunkIndex)
+	data = binary.LittleEndian.AppendUint32(data, entry.UncompressedLength)
+	data = binary.LittleEndian.AppendUint32(data, entry.Compression)
+	var flags byte
+	for i, flag := range []bool{entry.IsBarrier, entry.MoreChunks, entry.IsCompressed, entry.TxnCommit} {
+		if flag {
+			flags |= 1 << i
+		}
+	}
+	return append(data, flags)
+}
+
+// decodePayload returns the entry with its payload as it was written, decrypted then decompressed
+func (wal *WriteAheadLog) decodePayload(entry *Entry) (*Entry, error) {
+	entry, err := decryptEntry(wal.checksum, wal.cipher, entry)
+	if err != nil {
+		return nil, err
+	}
+	return decompressEntry(wal.checksum, entry)
+}
@@ -0,0 +1,90 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrNoSegments is returned when the log directory doesn't hold any segment file
+var ErrNoSegments = errors.New("no segment files found")
+
+// ErrRecoveryBudgetExceeded is returned by Open when recovering the log
+// would scan more bytes than Options.MaxRecoveryScanBytes allows
+var ErrRecoveryBudgetExceeded = errors.New("recovery scan budget exceeded")
+
+// ErrUnsupportedFormatVersion is returned for segments written in a newer on-disk format
+var ErrUnsupportedFormatVersion = errors.New("unsupported WAL format version")
+
+// ErrSegmentNotFound is returned when a segment ID doesn't match any segment file
+var ErrSegmentNotFound = errors.New("segment not found")
+
+// ErrSegmentChecksumMismatch is returned when the content of a sealed segment doesn't match its footer checksum
+var ErrSegmentChecksumMismatch = errors.New("segment checksum mismatch")
+
+// ErrSeqNoMismatch is returned on read when the stored sequence number of an entry was altered
+var ErrSeqNoMismatch = errors.New("sequence number mismatch")
+
+// ErrSegmentNotContiguous is returned by InstallSegment for a segment that doesn't continue the log
+var ErrSegmentNotContiguous = errors.New("segment doesn't continue the log")
+
+// ErrNonceRegression is returned on read when the nonce of an entry isn't above the one of the previous entry
+var ErrNonceRegression = errors.New("entry nonce regressed")
+
+// ErrLogOpen is returned by MoveLog when the log directory is held by an open WAL
+var ErrLogOpen = errors.New("log is open")
+
+// ErrOutOfOrder is returned on read with OrderingStrict when an entry doesn't follow the previous one in seq number order
+var ErrOutOfOrder = errors.New("entry out of order")
+
+// ErrClosed is returned by WaitForWrite and Tail once the WAL is closed
+var ErrClosed = errors.New("WAL is closed")
+
+// ErrSyncTimeout is returned by Sync when the fsync of the segment file didn't complete within Options.SyncTimeout
+var ErrSyncTimeout = errors.New("sync timed out")
+
+// ErrUncompressedLengthMismatch is returned when a compressed payload doesn't decompress to its stored length
+var ErrUncompressedLengthMismatch = errors.New("uncompressed length mismatch")
+
+// ErrDecryptionFailed is returned on read when an encrypted payload fails authentication, like with the wrong key
+var ErrDecryptionFailed = errors.New("entry decryption failed")
+
+// ErrInvalidConfig is returned by Open when the options can't work together
+var ErrInvalidConfig = errors.New("invalid configuration")
+
+// ErrBufferFlush is returned by Sync when the buffered entries couldn't be written to the segment file
+// The entries never reached the OS
+type ErrBufferFlush struct {
+	Err error
+}
+
+func (e *ErrBufferFlush) Error() string {
+	return fmt.Sprintf("failed to flush WAL buffer: %v", e.Err)
+}
+
+func (e *ErrBufferFlush) Unwrap() error {
+	return e.Err
+}
+
+// ErrFileSync is returned by Sync when the segment file couldn't be fsynced
+// The entries reached the OS but may not be on disk yet
+type ErrFileSync struct {
+	Err error
+}
+
+func (e *ErrFileSync) Error() string {
+	return fmt.Sprintf("failed to sync WAL file: %v", e.Err)
+}
+
+func (e *ErrFileSync) Unwrap() error {
+	return e.Err
+}
+
+// ErrSegmentGap is returned when segment files are missing between the oldest and the newest segment
+// Missing lists their IDs
+type ErrSegmentGap struct {
+	Missing []int
+}
+
+func (e *ErrSegmentGap) Error() string {
+	return fmt.Sprintf("missing segments %v", e.Missing)
+}
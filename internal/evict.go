@@ -0,0 +1,87 @@
+package wal
+
+import (
+	"fmt"
+)
+
+// evictOldest trims the oldest entries once the log holds more than Options.MaxTotalEntries
+// The entries are counted by sequence number. Whole sealed segments are removed first,
+// then the front of the oldest remaining segment is rewritten without the extra entries
+// The trim waits for a quarter of the limit of extra entries, so its cost is spread over the writes
+// The most recent checkpoint is where recovery starts, it and the entries after it are never evicted
+// The caller must hold the lock
+func (wal *WriteAheadLog) evictOldest() error {
+	if wal.lastSeqNo <= uint64(wal.maxTotalEntries) {
+		return nil
+	}
+	// Entries below keepFrom are over the limit
+	keepFrom := wal.lastSeqNo - uint64(wal.maxTotalEntries) + 1
+	if wal.lastCheckpointSeqNo != 0 {
+		keepFrom = min(keepFrom, wal.lastCheckpointSeqNo)
+	}
+	// Unknown after Open, the first write trims right away
+	if wal.oldestSeqNo != 0 && wal.oldestSeqNo+evictionSlack(wal.maxTotalEntries) > keepFrom {
+		return nil
+	}
+
+	if err := wal.bufWriter.Flush(); err != nil {
+		return err
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return err
+	}
+	for len(logFiles) > 1 {
+		nextFirstSeqNo, ok, err := wal.segmentFirstSeqNo(logFiles[1])
+		if err != nil {
+			return err
+		}
+		if !ok || nextFirstSeqNo > keepFrom {
+			break
+		}
+		// All the entries of the oldest segment are below keepFrom
+		if err := wal.removeOldestSegment(logFiles[0]); err != nil {
+			return fmt.Errorf("failed to evict segment %s: %w", logFiles[0], err)
+		}
+		logFiles = logFiles[1:]
+	}
+
+	firstSeqNo, ok, err := wal.segmentFirstSeqNo(logFiles[0])
+	if err != nil {
+		return err
+	}
+	if ok && firstSeqNo < keepFrom {
+		err := wal.rewriteSegment(logFiles[0], func(entries []*Entry) []*Entry {
+			kept := []*Entry{}
+			for _, entry := range entries {
+				if entry.SeqNo >= keepFrom {
+					kept = append(kept, entry)
+				}
+			}
+			return kept
+		})
+		if err != nil {
+			return fmt.Errorf("failed to evict entries from segment %s: %w", logFiles[0], err)
+		}
+		wal.forgetCount()
+	}
+	wal.oldestSeqNo = keepFrom
+	if wal.recentCache != nil {
+		wal.recentCache.dropBefore(keepFrom)
+	}
+	wal.sinceCheckpointKnown = false
+	return nil
+}
+
+// evictionSlack is how many entries over the limit wait for the next trim
+func evictionSlack(maxTotalEntries int) uint64 {
+	return uint64(max(maxTotalEntries/4, 1))
+}
+
+// evictAfterWrite runs the eviction of Options.MaxTotalEntries after a write
+// The entry is already written, so a failure is only logged and the next write tries again
+func (wal *WriteAheadLog) evictAfterWrite() {
+	if err := wal.evictOldest(); err != nil {
+		wal.logger.Printf("failed to evict the oldest entries: %v", err)
+	}
+}
@@ -0,0 +1,291 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+// Every segment starts with a fixed size header:
+// 4 bytes magic, 2 bytes format version and 2 bytes flags, all little-endian
+// Segments written before the header existed have no header at all and are read as formatVersionLegacy
+const (
+	segmentHeaderSize = 8
+
+	// formatVersionLegacy is the headerless format of the first releases
+	formatVersionLegacy uint16 = 1
+	// formatVersionCurrent is written into the header of every new segment
+	formatVersionCurrent uint16 = 2
+)
+
+var segmentMagic = []byte("MWAL")
+
+// FramingMode is how the size in front of every entry of a segment is encoded
+type FramingMode int
+
+const (
+	// FramingFixed32 writes the size as 4 bytes little-endian, it's the default
+	FramingFixed32 FramingMode = iota
+	// FramingVarint writes the size as a varint, 1 or 2 bytes for most entries
+	FramingVarint
+)
+
+// flagVarintFraming is set in the header flags of the segments framed with FramingVarint
+// Segments without a header are framed with FramingFixed32
+const flagVarintFraming uint16 = 1 << 0
+
+// segmentHeader is the decoded header of a segment file
+type segmentHeader struct {
+	version uint16
+	flags   uint16
+}
+
+// framing returns how the entries of the segment are framed
+func (h segmentHeader) framing() FramingMode {
+	if h.flags&flagVarintFraming != 0 {
+		return FramingVarint
+	}
+	return FramingFixed32
+}
+
+// encodeSegmentHeader returns the header written at the start of a new segment with the given framing
+func encodeSegmentHeader(framing FramingMode) []byte {
+	header := make([]byte, segmentHeaderSize)
+	copy(header, segmentMagic)
+	binary.LittleEndian.PutUint16(header[4:], formatVersionCurrent)
+	var flags uint16
+	if framing == FramingVarint {
+		flags |= flagVarintFraming
+	}
+	binary.LittleEndian.PutUint16(header[6:], flags)
+	return header
+}
+
+// contentFraming returns the framing of the segment whose uncompressed content is given
+func contentFraming(content []byte) (FramingMode, error) {
+	header, err := readSegmentHeader(bufio.NewReader(bytes.NewReader(content)))
+	if err != nil {
+		return 0, err
+	}
+	return header.framing(), nil
+}
+
+// fileFraming returns the framing of the segment file being appended to
+func fileFraming(file File) (FramingMode, error) {
+	header := make([]byte, segmentHeaderSize)
+	n, err := file.ReadAt(header, 0)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	return contentFraming(header[:n])
+}
+
+// appendFrameSize appends the size of an entry framed with the given framing
+func appendFrameSize(b []byte, framing FramingMode, size uint32) []byte {
+	if framing == FramingVarint {
+		return binary.AppendUvarint(b, uint64(size))
+	}
+	return binary.LittleEndian.AppendUint32(b, size)
+}
+
+// readFrameSize reads the size in front of the next entry, footerSentinel when the footer comes next
+// It returns io.EOF when nothing is left and io.ErrUnexpectedEOF when the size is cut short
+// With FramingVarint the footer is recognized by its 4 sentinel bytes, a varint starting with
+// them is at least 256MB, more than any entry
+func readFrameSize(reader *bufio.Reader, framing FramingMode) (uint32, error) {
+	if framing == FramingFixed32 {
+		var size uint32
+		err := binary.Read(reader, binary.LittleEndian, &size)
+		return size, err
+	}
+	if peeked, err := reader.Peek(4); err == nil && binary.LittleEndian.Uint32(peeked) == footerSentinel {
+		reader.Discard(4)
+		return footerSentinel, nil
+	}
+	size, err := binary.ReadUvarint(reader)
+	if err != nil {
+		return 0, err
+	}
+	if size > math.MaxUint32 {
+		return 0, fmt.Errorf("invalid entry size %d", size)
+	}
+	return uint32(size), nil
+}
+
+// legacySeqNoTag is the protobuf tag of the seq number, the first field of the first entry of a legacy segment
+// right after its 4 bytes size. Legacy segments predate the codecs, their entries are always protobuf
+const legacySeqNoTag = 0x08
+
+// readSegmentHeader consumes the segment header from the reader and negotiates the format version
+// A segment without the magic bytes is a legacy segment and nothing is consumed
+// It returns ErrUnsupportedFormatVersion for segments written by a newer version, or starting with
+// neither the magic bytes nor a legacy entry, rather than parsing what follows as entries
+func readSegmentHeader(reader *bufio.Reader) (segmentHeader, error) {
+	magic, err := reader.Peek(len(segmentMagic))
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return segmentHeader{version: formatVersionLegacy}, nil
+	}
+	if err != nil {
+		return segmentHeader{}, err
+	}
+	if !bytes.Equal(magic, segmentMagic) {
+		// A segment cut short after the size of its first entry is still a legacy one
+		start, err := reader.Peek(len(segmentMagic) + 1)
+		if err == io.EOF || (err == nil && start[len(segmentMagic)] == legacySeqNoTag) {
+			return segmentHeader{version: formatVersionLegacy}, nil
+		}
+		if err != nil {
+			return segmentHeader{}, err
+		}
+		return segmentHeader{}, fmt.Errorf("%w: unknown magic %q", ErrUnsupportedFormatVersion, magic)
+	}
+	header := make([]byte, segmentHeaderSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return segmentHeader{}, fmt.Errorf("failed to read segment header: %w", err)
+	}
+	decoded := segmentHeader{
+		version: binary.LittleEndian.Uint16(header[4:]),
+		flags:   binary.LittleEndian.Uint16(header[6:]),
+	}
+	if decoded.version > formatVersionCurrent || decoded.version < formatVersionLegacy {
+		return segmentHeader{}, fmt.Errorf("%w: %d, supported up to %d",
+			ErrUnsupportedFormatVersion, decoded.version, formatVersionCurrent)
+	}
+	return decoded, nil
+}
+
+// Sealed segments end with a fixed size footer:
+// 4 bytes footerSentinel in place of an entry size, 4 bytes CRC-32 of everything before the footer
+// and 4 bytes magic, all little-endian
+// The active segment has no footer, it is written when the segment is rotated out
+const (
+	segmentFooterSize = 12
+
+	// footerSentinel can't be the size of a real entry, it tells the readers the entries are over
+	footerSentinel uint32 = 0xFFFFFFFF
+)
+
+var segmentFooterMagic = []byte("MWFT")
+
+// encodeSegmentFooter returns the footer sealing a segment whose content has the given checksum
+func encodeSegmentFooter(checksum uint32) []byte {
+	footer := make([]byte, segmentFooterSize)
+	binary.LittleEndian.PutUint32(footer, footerSentinel)
+	binary.LittleEndian.PutUint32(footer[4:], checksum)
+	copy(footer[8:], segmentFooterMagic)
+	return footer
+}
+
+// hasSegmentFooter reports whether the content ends with a segment footer
+func hasSegmentFooter(content []byte) bool {
+	if len(content) < segmentFooterSize {
+		return false
+	}
+	footer := content[len(content)-segmentFooterSize:]
+	return binary.LittleEndian.Uint32(footer) == footerSentinel && bytes.Equal(footer[8:], segmentFooterMagic)
+}
+
+// checkSegmentFooter verifies the content of a sealed segment against the checksum of its footer
+// Segments without a footer, like the active one, have nothing to verify
+func checkSegmentFooter(content []byte) error {
+	if !hasSegmentFooter(content) {
+		return nil
+	}
+	footerStart := len(content) - segmentFooterSize
+	checksum := binary.LittleEndian.Uint32(content[footerStart+4:])
+	if crc32.ChecksumIEEE(content[:footerStart]) != checksum {
+		return ErrSegmentChecksumMismatch
+	}
+	return nil
+}
+
+// readSegmentFooter consumes the rest of the footer once its sentinel was read in place of an entry size
+func readSegmentFooter(reader io.Reader) error {
+	footer := make([]byte, segmentFooterSize-4)
+	if _, err := io.ReadFull(reader, footer); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return fmt.Errorf("failed to read segment footer: %w", err)
+	}
+	if !bytes.Equal(footer[4:], segmentFooterMagic) {
+		return fmt.Errorf("invalid segment footer")
+	}
+	return nil
+}
+
+// fileHasSegmentFooter reports whether the segment file was sealed with a footer
+func fileHasSegmentFooter(file File) (bool, error) {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if fileInfo.Size() < segmentFooterSize {
+		return false, nil
+	}
+	footer := make([]byte, segmentFooterSize)
+	if _, err := file.ReadAt(footer, fileInfo.Size()-segmentFooterSize); err != nil {
+		return false, err
+	}
+	return hasSegmentFooter(footer), nil
+}
+
+// DecodeFramed decodes a sequence of framed entries, each a size in the given framing followed by the
+// entry serialized with codec, as stored in a segment after its header. A segment footer ends the sequence
+// It is meant for untrusted input: it never panics and never allocates more than the input size,
+// and every entry must pass its checksum, CRC32IEEE for the entries not recording their checksum type
+// On error the entries decoded so far are returned with it
+func DecodeFramed(b []byte, codec EntryCodec, framing FramingMode) ([]*Entry, error) {
+	entries := []*Entry{}
+	for offset := 0; offset < len(b); {
+		if len(b)-offset == segmentFooterSize && hasSegmentFooter(b[offset:]) {
+			return entries, nil
+		}
+		size, n, err := frameSize(b[offset:], framing)
+		if err != nil {
+			return entries, fmt.Errorf("invalid size at offset %d: %w", offset, err)
+		}
+		if size == 0 {
+			return entries, fmt.Errorf("zero size entry at offset %d", offset)
+		}
+		offset += n
+		if uint64(size) > uint64(len(b)-offset) {
+			return entries, fmt.Errorf("entry of %d bytes at offset %d overruns the input: %w",
+				size, offset-n, io.ErrUnexpectedEOF)
+		}
+		entry, err := codec.Unmarshal(b[offset : offset+int(size)])
+		if err != nil {
+			return entries, fmt.Errorf("invalid entry at offset %d: %w", offset-n, err)
+		}
+		if err := validateChecksum(CRC32IEEE, entry); err != nil {
+			return entries, fmt.Errorf("invalid entry at offset %d: %w", offset-n, err)
+		}
+		if !entry.IsSegmentMeta {
+			entries = append(entries, entry)
+		}
+		offset += int(size)
+	}
+	return entries, nil
+}
+
+// frameSize parses the size at the start of b, it returns the size and the number of bytes it takes
+func frameSize(b []byte, framing FramingMode) (uint32, int, error) {
+	if framing == FramingVarint {
+		size, n := binary.Uvarint(b)
+		if n == 0 {
+			return 0, 0, io.ErrUnexpectedEOF
+		}
+		if n < 0 || size > math.MaxUint32 {
+			return 0, 0, fmt.Errorf("varint size overflows")
+		}
+		return uint32(size), n, nil
+	}
+	if len(b) < 4 {
+		return 0, 0, io.ErrUnexpectedEOF
+	}
+	return binary.LittleEndian.Uint32(b), 4, nil
+}
@@ -0,0 +1,85 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path/filepath"
+)
+
+// ConvertFraming rewrites the segments of a closed log with the given framing, like to move a log written with
+// FramingFixed32 to FramingVarint. The entries are copied byte for byte, only their size prefix changes, and
+// every segment records its new framing in its header. Segments stay sealed or compressed
+// Each segment is replaced atomically and segments already in the new framing are skipped,
+// so after a crash the conversion can simply run again. It returns ErrLogOpen while a WAL has dir open
+func ConvertFraming(dir string, to FramingMode) error {
+	if to != FramingFixed32 && to != FramingVarint {
+		return fmt.Errorf("invalid framing mode %d", to)
+	}
+	lock, err := lockLogDir(dir, true)
+	if err != nil {
+		return err
+	}
+	defer unlockLogDir(lock)
+
+	if err := finishReplace(osFS{}, dir); err != nil {
+		return fmt.Errorf("failed to complete the replacement of the log: %w", err)
+	}
+	logFiles, err := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	if err != nil {
+		return err
+	}
+	for _, logFile := range logFiles {
+		if err := convertSegmentFraming(logFile, to); err != nil {
+			return fmt.Errorf("failed to convert segment %s: %w", logFile, err)
+		}
+	}
+	return nil
+}
+
+// convertSegmentFraming rewrites a segment file with its entries framed with to
+func convertSegmentFraming(path string, to FramingMode) error {
+	content, err := readSegmentFile(path)
+	if err != nil {
+		return err
+	}
+	if err := checkSegmentFooter(content); err != nil {
+		return err
+	}
+	reader := bufio.NewReader(bytes.NewReader(content))
+	header, err := readSegmentHeader(reader)
+	if err != nil {
+		return err
+	}
+	if header.version != formatVersionLegacy && header.framing() == to {
+		return nil
+	}
+
+	var segment bytes.Buffer
+	segment.Write(encodeSegmentHeader(to))
+	for {
+		size, err := readFrameSize(reader, header.framing())
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read entry size: %w", err)
+		}
+		if size == 0 || size == footerSentinel {
+			// The zero filled tail or the footer, rewritten below
+			break
+		}
+		body := make([]byte, size)
+		if _, err := io.ReadFull(reader, body); err != nil {
+			return fmt.Errorf("failed to read entry: %w", err)
+		}
+		segment.Write(appendFrameSize(nil, to, size))
+		segment.Write(body)
+	}
+	data, err := finishSegment(segment.Bytes(), hasSegmentFooter(content), isCompressedSegment(path))
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(osFS{}, path, data)
+}
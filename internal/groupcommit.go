@@ -0,0 +1,78 @@
+package wal
+
+import (
+	"fmt"
+	"time"
+)
+
+// commitGroup gathers the WriteSync calls sharing a single sync
+// done is closed once the sync covering all their entries completed, err is its result
+type commitGroup struct {
+	done chan struct{}
+	err  error
+}
+
+// WriteSync writes an entry and returns its sequence number once it is durable, flushed and fsynced
+// with everything buffered before it. Unlike WriteWithCheckpoint the entry is a regular one, replayed like the ones of Write
+// With Options.GroupCommitWindow the calls made within the window share a single sync:
+// the first one waits for the window, syncs for the whole group and wakes up the others with its result
+// A Close during the window syncs the group instead, its calls return the result of that sync
+func (wal *WriteAheadLog) WriteSync(data []byte) (uint64, error) {
+	if wal.validate != nil {
+		if err := wal.validate(data); err != nil {
+			return 0, err
+		}
+	}
+	wal.locker.Lock()
+	if wal.file == nil || wal.ctx.Err() != nil {
+		wal.locker.Unlock()
+		return 0, fmt.Errorf("WAL is closed, cannot write data")
+	}
+	entry := &Entry{Data: data}
+	if err := wal.appendEntry(entry); err != nil {
+		wal.locker.Unlock()
+		return 0, err
+	}
+	if wal.groupCommitWindow <= 0 {
+		err := wal.syncLocked()
+		wal.locker.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		return entry.SeqNo, nil
+	}
+	group := wal.commitGroup
+	leader := group == nil
+	if leader {
+		group = &commitGroup{done: make(chan struct{})}
+		wal.commitGroup = group
+	}
+	wal.locker.Unlock()
+
+	if leader {
+		window := time.NewTimer(wal.groupCommitWindow)
+		select {
+		case <-window.C:
+		case <-group.done:
+			window.Stop()
+		}
+		wal.locker.Lock()
+		// A Close during the window already synced the group and woke it up with its result
+		if wal.commitGroup == group {
+			// The entries written from now on wait for the next group
+			wal.commitGroup = nil
+			if wal.file == nil {
+				group.err = fmt.Errorf("WAL is closed, cannot sync data")
+			} else {
+				group.err = wal.syncLocked()
+			}
+			close(group.done)
+		}
+		wal.locker.Unlock()
+	}
+	<-group.done
+	if group.err != nil {
+		return 0, group.err
+	}
+	return entry.SeqNo, nil
+}
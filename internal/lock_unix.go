@@ -0,0 +1,40 @@
+//go:build unix
+
+package wal
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// lockLogDir takes an advisory lock on the log directory itself, so no extra file lands next to the segments
+// Open holds a shared lock while the log is open, MoveLog needs an exclusive one
+// The lock goes away with the process, a crash never leaves a stale lock behind
+func lockLogDir(dirPath string, exclusive bool) (*os.File, error) {
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	if err := syscall.Flock(int(dir.Fd()), how|syscall.LOCK_NB); err != nil {
+		dir.Close()
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return nil, ErrLogOpen
+		}
+		return nil, err
+	}
+	return dir, nil
+}
+
+// unlockLogDir releases a lock taken by lockLogDir
+func unlockLogDir(dir *os.File) error {
+	if dir == nil {
+		return nil
+	}
+	syscall.Flock(int(dir.Fd()), syscall.LOCK_UN)
+	return dir.Close()
+}
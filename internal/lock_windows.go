@@ -0,0 +1,21 @@
+//go:build windows
+
+package wal
+
+import (
+	"os"
+)
+
+// lockLogDir opens the log directory without locking it
+// Windows has no advisory lock on a directory handle, so a log opened by another process isn't detected there
+func lockLogDir(dirPath string, exclusive bool) (*os.File, error) {
+	return os.Open(dirPath)
+}
+
+// unlockLogDir releases a lock taken by lockLogDir
+func unlockLogDir(dir *os.File) error {
+	if dir == nil {
+		return nil
+	}
+	return dir.Close()
+}
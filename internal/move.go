@@ -0,0 +1,113 @@
+package wal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// sidecarFileNames lists the files kept next to the segments that belong to the log
+var sidecarFileNames = []string{cursorFileName, watermarkFileName, countFileName}
+
+// MoveLog moves a closed log from oldDir to newDir, segments keep their numbers
+// Files are renamed when both directories are on the same filesystem, otherwise they are copied,
+// fsynced and removed from oldDir. It returns ErrLogOpen while a WAL has oldDir open
+func MoveLog(oldDir, newDir string) error {
+	lock, err := lockLogDir(oldDir, true)
+	if err != nil {
+		return err
+	}
+	defer unlockLogDir(lock)
+
+	// Leave a ReplaceAll interrupted by a crash complete, its staging directories aren't moved
+	if err := finishReplace(osFS{}, oldDir); err != nil {
+		return fmt.Errorf("failed to complete the replacement of the log: %w", err)
+	}
+	if err := os.MkdirAll(newDir, 0755); err != nil {
+		return err
+	}
+	existing, err := segmentFileNames(newDir)
+	if err != nil {
+		return err
+	}
+	if len(existing) > 0 {
+		return fmt.Errorf("destination %s already holds segment files", newDir)
+	}
+
+	names, err := segmentFileNames(oldDir)
+	if err != nil {
+		return err
+	}
+	if len(names) == 0 {
+		return fmt.Errorf("%w in %s", ErrNoSegments, oldDir)
+	}
+	for _, name := range sidecarFileNames {
+		if _, err := os.Stat(filepath.Join(oldDir, name)); err == nil {
+			names = append(names, name)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	for _, name := range names {
+		if err := moveFile(filepath.Join(oldDir, name), filepath.Join(newDir, name)); err != nil {
+			return fmt.Errorf("failed to move %s: %w", name, err)
+		}
+	}
+	if err := syncDir(osFS{}, newDir); err != nil {
+		return err
+	}
+	return syncDir(osFS{}, oldDir)
+}
+
+// segmentFileNames returns the names of all the segment files in dirPath, compressed or not
+func segmentFileNames(dirPath string) ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(dirPath, segmentPrefix+"*"))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, match := range matches {
+		if _, err := parseSegmentNo(match); err == nil {
+			names = append(names, filepath.Base(match))
+		}
+	}
+	return names, nil
+}
+
+// moveFile renames oldPath to newPath, falling back to a copy when they are on different filesystems
+func moveFile(oldPath, newPath string) error {
+	err := os.Rename(oldPath, newPath)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyFile(oldPath, newPath); err != nil {
+		os.Remove(newPath)
+		return err
+	}
+	return os.Remove(oldPath)
+}
+
+// copyFile copies oldPath to newPath and fsyncs the copy
+func copyFile(oldPath, newPath string) error {
+	src, err := os.Open(oldPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(newPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,89 @@
+package wal
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// RawCodec encodes entries without protobuf: the sequence number, the checksum and a byte of flags,
+// little endian, then the other metadata as varints and the payload up to the end
+type RawCodec struct{}
+
+// rawCodecHeaderSize is the size of the fixed fields of RawCodec
+const rawCodecHeaderSize = 13
+
+// The flags of RawCodec
+const (
+	rawCheckpoint = 1 << iota
+	rawBarrier
+	rawMoreChunks
+	rawSegmentMeta
+	rawCompressed
+	rawTxnCommit
+	rawTimestampChecked
+	rawHeaderChecked
+)
+
+func (RawCodec) Marshal(entry *Entry) ([]byte, error) {
+	b := make([]byte, rawCodecHeaderSize, rawCodecHeaderSize+8*binary.MaxVarintLen64+len(entry.CipherNonce)+len(entry.Data))
+	binary.LittleEndian.PutUint64(b[0:], entry.SeqNo)
+	binary.LittleEndian.PutUint32(b[8:], entry.Checksum)
+	flags := []bool{entry.IsCheckpoint, entry.IsBarrier, entry.MoreChunks, entry.IsSegmentMeta, entry.IsCompressed, entry.TxnCommit, entry.TimestampChecked, entry.HeaderChecked}
+	for i, flag := range flags {
+		if flag {
+			b[12] |= 1 << i
+		}
+	}
+	b = binary.AppendVarint(b, entry.TimestampUnixNano)
+	for _, field := range []uint64{uint64(entry.ChunkIndex), uint64(entry.UserVersion), entry.Nonce, uint64(entry.UncompressedLength),
+		entry.TxnId, uint64(entry.ChecksumType), uint64(entry.ChecksumHigh), uint64(entry.Compression)} {
+		b = binary.AppendUvarint(b, field)
+	}
+	b = binary.AppendUvarint(b, uint64(len(entry.CipherNonce)))
+	b = append(b, entry.CipherNonce...)
+	return append(b, entry.Data...), nil
+}
+
+func (RawCodec) Unmarshal(b []byte) (*Entry, error) {
+	if len(b) < rawCodecHeaderSize {
+		return nil, fmt.Errorf("entry of %d bytes is too short", len(b))
+	}
+	flags := b[12]
+	entry := &Entry{
+		SeqNo:            binary.LittleEndian.Uint64(b[0:]),
+		Checksum:         binary.LittleEndian.Uint32(b[8:]),
+		IsCheckpoint:     flags&rawCheckpoint != 0,
+		IsBarrier:        flags&rawBarrier != 0,
+		MoreChunks:       flags&rawMoreChunks != 0,
+		IsSegmentMeta:    flags&rawSegmentMeta != 0,
+		IsCompressed:     flags&rawCompressed != 0,
+		TxnCommit:        flags&rawTxnCommit != 0,
+		TimestampChecked: flags&rawTimestampChecked != 0,
+		HeaderChecked:    flags&rawHeaderChecked != 0,
+	}
+	rest := b[rawCodecHeaderSize:]
+	timestamp, n := binary.Varint(rest)
+	if n <= 0 {
+		return nil, fmt.Errorf("invalid timestamp in entry with seq no %d", entry.SeqNo)
+	}
+	entry.TimestampUnixNano, rest = timestamp, rest[n:]
+	fields := make([]uint64, 9)
+	for i := range fields {
+		field, n := binary.Uvarint(rest)
+		if n <= 0 {
+			return nil, fmt.Errorf("invalid metadata in entry with seq no %d", entry.SeqNo)
+		}
+		fields[i], rest = field, rest[n:]
+	}
+	entry.ChunkIndex, entry.UserVersion, entry.Nonce = uint32(fields[0]), uint32(fields[1]), fields[2]
+	entry.UncompressedLength, entry.TxnId, entry.ChecksumType = uint32(fields[3]), fields[4], uint32(fields[5])
+	entry.ChecksumHigh, entry.Compression = uint32(fields[6]), uint32(fields[7])
+	if nonceLength := fields[8]; nonceLength > 0 {
+		if nonceLength > uint64(len(rest)) {
+			return nil, fmt.Errorf("invalid nonce length %d in entry with seq no %d", nonceLength, entry.SeqNo)
+		}
+		entry.CipherNonce, rest = rest[:nonceLength], rest[nonceLength:]
+	}
+	entry.Data = rest
+	return entry, nil
+}
@@ -0,0 +1,852 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"os"
+	"slices"
+	"sync"
+	"time"
+	wal_pb "wal/proto"
+)
+
+// segmentReader decodes the size prefixed entries of a single segment file
+// Compressed segments are decompressed transparently
+type segmentReader struct {
+	file         io.ReadCloser
+	reader       *bufio.Reader
+	header       segmentHeader
+	codec        EntryCodec
+	checksum     ChecksumFunc     // verifies the entries, left to the caller when nil
+	path         string           // segment file read, for the logs
+	onCorruption CorruptionPolicy // what to do with an entry failing to decode or its checksum
+	logger       Logger           // receives the skipped entries with CorruptSkip
+
+	segmentMeta *Entry // entry describing the segment, once read past it
+}
+
+func (wal *WriteAheadLog) openSegmentReader(path string) (*segmentReader, error) {
+	file, err := wal.openSegmentContent(path)
+	if err != nil {
+		return nil, err
+	}
+	sr, err := newSegmentReader(file, path, wal.codec, wal.checksum)
+	if err != nil {
+		return nil, err
+	}
+	sr.path = path
+	sr.onCorruption = wal.onCorruption
+	sr.logger = wal.logger
+	return sr, nil
+}
+
+// newSegmentReader parses the header of the segment content and returns a reader positioned on the first entry
+func newSegmentReader(file io.ReadCloser, path string, codec EntryCodec, checksum ChecksumFunc) (*segmentReader, error) {
+	var err error
+	sr := &segmentReader{file: file, reader: bufio.NewReader(file), codec: codec, checksum: checksum}
+	if sr.header, err = readSegmentHeader(sr.reader); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("segment %s: %w", path, err)
+	}
+	return sr, nil
+}
+
+// segmentContent is the uncompressed content of a segment file
+type segmentContent struct {
+	io.Reader
+	file File
+}
+
+func (sc *segmentContent) Close() error {
+	return sc.file.Close()
+}
+
+// openSegmentContent opens a segment file for reading from its first byte
+// Compressed segments are decompressed on the fly
+func (wal *WriteAheadLog) openSegmentContent(path string) (io.ReadCloser, error) {
+	file, err := wal.openFile(path, os.O_RDONLY, 0)
+	if errors.Is(err, os.ErrNotExist) && !isCompressedSegment(path) {
+		// The segment may have been compressed since it was listed
+		path += compressedSuffix
+		file, err = wal.openFile(path, os.O_RDONLY, 0)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !isCompressedSegment(path) {
+		return file, nil
+	}
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("failed to decompress segment %s: %w", path, err)
+	}
+	return &segmentContent{Reader: zr, file: file}, nil
+}
+
+// next returns the next entry of the segment, or io.EOF once the segment is fully read
+func (sr *segmentReader) next() (*Entry, error) {
+	size, err := readFrameSize(sr.reader, sr.header.framing())
+	if err != nil {
+		return nil, err
+	}
+	if size == 0 {
+		// Every entry carries at least its seq number, even with an empty payload, so its size is never 0
+		// A zero size is the zero filled space after the last entry, like a preallocated tail
+		return nil, io.EOF
+	}
+	if size == footerSentinel {
+		// The footer of a sealed segment follows the last entry
+		if err := readSegmentFooter(sr.reader); err != nil {
+			return nil, err
+		}
+		return nil, io.EOF
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(sr.reader, data); err != nil {
+		if err == io.EOF {
+			// The size was written without the entry
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	entry, err := sr.codec.Unmarshal(data)
+	if err == nil && sr.checksum != nil {
+		err = validateChecksum(sr.checksum, entry)
+	}
+	if err != nil {
+		switch sr.onCorruption {
+		case CorruptSkip:
+			// The size prefix was intact, the next entry starts right after this one
+			sr.logger.Printf("skipping corrupted entry in segment %s: %v", sr.path, err)
+			return sr.next()
+		case CorruptTruncate:
+			return nil, fmt.Errorf("%w: %v", errCorruptionReached, err)
+		}
+		return nil, err
+	}
+	if entry.IsSegmentMeta {
+		// The description of the segment isn't an entry of the log
+		sr.segmentMeta = entry
+		return sr.next()
+	}
+	return entry, nil
+}
+
+func (sr *segmentReader) Close() error {
+	return sr.file.Close()
+}
+
+// readSegment reads all the entries of a single segment file
+func (wal *WriteAheadLog) readSegment(path string) ([]*Entry, error) {
+	_, entries, err := wal.readSegmentWithMeta(path)
+	return entries, err
+}
+
+// readSegmentWithMeta reads all the entries of a single segment file and the entry describing it, if any
+func (wal *WriteAheadLog) readSegmentWithMeta(path string) (*Entry, []*Entry, error) {
+	sr, err := wal.openSegmentReader(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer sr.Close()
+
+	entries := []*Entry{}
+	for {
+		entry, err := sr.next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read segment %s: %w", path, err)
+		}
+		entries = append(entries, entry)
+	}
+	return sr.segmentMeta, entries, nil
+}
+
+// Segments returns the IDs of the segments on disk, oldest first
+func (wal *WriteAheadLog) Segments() ([]int, error) {
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	segmentNos := make([]int, 0, len(logFiles))
+	for _, logFile := range logFiles {
+		segmentNo, err := parseSegmentNo(logFile)
+		if err != nil {
+			return nil, err
+		}
+		segmentNos = append(segmentNos, segmentNo)
+	}
+	return segmentNos, nil
+}
+
+// flushForRead writes the buffered entries into the active segment, every read of the log starts with it
+// so it sees all the entries written before it
+func (wal *WriteAheadLog) flushForRead() error {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+	return wal.bufWriter.Flush()
+}
+
+// FirstSeqNo returns the sequence number of the oldest entry on disk, read from the oldest segment holding one
+// A ReadFrom below it can't return the entries purged before it. It returns 0 for an empty log
+func (wal *WriteAheadLog) FirstSeqNo() (uint64, error) {
+	err := wal.flushForRead()
+	if err != nil {
+		return 0, err
+	}
+
+	it, err := wal.newLogIterator()
+	if err != nil {
+		return 0, err
+	}
+	defer it.Close()
+	entry, err := it.next()
+	if err == io.EOF {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return entry.SeqNo, nil
+}
+
+// LastSeqNo returns the sequence number of the last entry written, 0 for an empty log
+func (wal *WriteAheadLog) LastSeqNo() uint64 {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+	return wal.lastSeqNo
+}
+
+// ReadSegment reads all the entries of the segment with the given ID
+// The footer checksum of a sealed segment is verified before any entry is decoded,
+// a mismatch returns an error wrapping ErrSegmentChecksumMismatch
+func (wal *WriteAheadLog) ReadSegment(segmentNo int) ([]*Entry, error) {
+	err := wal.flushForRead()
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := wal.segmentPath(segmentNo)
+	if err != nil {
+		return nil, err
+	}
+	file, err := wal.openSegmentContent(path)
+	if err != nil {
+		return nil, err
+	}
+	content, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read segment %d: %w", segmentNo, err)
+	}
+	if err := checkSegmentFooter(content); err != nil {
+		return nil, fmt.Errorf("segment %d: %w", segmentNo, err)
+	}
+
+	sr, err := newSegmentReader(io.NopCloser(bytes.NewReader(content)), path, wal.codec, wal.checksum)
+	if err != nil {
+		return nil, err
+	}
+	entries := []*Entry{}
+	for {
+		entry, err := sr.next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err == nil {
+			entry, err = wal.decodePayload(entry)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment %d: %w", segmentNo, err)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// ReadFromGlobalOffset reads the entries from the given position up to the end of the log
+// and returns the position after the last entry read, pass it back to continue from there
+// An entry that isn't fully written yet is left for the next call
+// Entries are returned as stored, the chunks of a WriteLarge payload are not reassembled
+func (wal *WriteAheadLog) ReadFromGlobalOffset(cur GlobalOffset) ([]*Entry, GlobalOffset, error) {
+	err := wal.flushForRead()
+	if err != nil {
+		return nil, cur, err
+	}
+
+	segmentNos, err := wal.Segments()
+	if err != nil {
+		return nil, cur, err
+	}
+	start := 0
+	if cur.Segment != 0 {
+		start = slices.Index(segmentNos, cur.Segment)
+		if start < 0 {
+			return nil, cur, fmt.Errorf("%w: %d", ErrSegmentNotFound, cur.Segment)
+		}
+	} else {
+		cur = GlobalOffset{Segment: segmentNos[0]}
+	}
+
+	entries := []*Entry{}
+	for i := start; i < len(segmentNos); i++ {
+		if segmentNos[i] != cur.Segment {
+			cur = GlobalOffset{Segment: segmentNos[i]}
+		}
+		segmentEntries, offset, atEnd, err := wal.readSegmentFrom(cur)
+		entries = append(entries, segmentEntries...)
+		cur.Offset = offset
+		if err != nil {
+			return entries, cur, err
+		}
+		if !atEnd {
+			break
+		}
+	}
+	return entries, cur, nil
+}
+
+// readSegmentFrom reads the entries of a segment starting at the given offset
+// It returns the offset after the last entry read and whether the end of the segment was reached,
+// it stops early at an entry that is cut short. The last segment may still grow after its end was reached
+func (wal *WriteAheadLog) readSegmentFrom(cur GlobalOffset) ([]*Entry, int64, bool, error) {
+	path, err := wal.segmentPath(cur.Segment)
+	if err != nil {
+		return nil, cur.Offset, false, err
+	}
+	file, err := wal.openSegmentContent(path)
+	if err != nil {
+		return nil, cur.Offset, false, err
+	}
+	content, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return nil, cur.Offset, false, err
+	}
+	if cur.Offset > int64(len(content)) {
+		return nil, cur.Offset, false, fmt.Errorf("offset %d is past the end of segment %d", cur.Offset, cur.Segment)
+	}
+
+	remaining := bytes.NewReader(content[cur.Offset:])
+	sr := &segmentReader{file: io.NopCloser(remaining), reader: bufio.NewReader(remaining), codec: wal.codec, checksum: wal.checksum}
+	// consumed is the offset of the next byte the segment reader hands out
+	consumed := func() int64 {
+		return int64(len(content) - remaining.Len() - sr.reader.Buffered())
+	}
+	if cur.Offset == 0 {
+		sr.header, err = readSegmentHeader(sr.reader)
+	} else {
+		// Past the header, it's only read for the framing
+		sr.header, err = readSegmentHeader(bufio.NewReader(bytes.NewReader(content)))
+	}
+	if err != nil {
+		return nil, cur.Offset, false, fmt.Errorf("segment %d: %w", cur.Segment, err)
+	}
+
+	entries := []*Entry{}
+	offset := consumed()
+	for {
+		entry, err := sr.next()
+		if err == io.EOF {
+			// Past the footer if the segment is sealed
+			return entries, consumed(), true, nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return entries, offset, false, nil
+		}
+		if err == nil {
+			entry, err = wal.decodePayload(entry)
+		}
+		if err != nil {
+			return entries, offset, false, fmt.Errorf("failed to read segment %d at offset %d: %w", cur.Segment, offset, err)
+		}
+		entries = append(entries, entry)
+		offset = consumed()
+	}
+}
+
+// Has reports whether an entry with the given seq number is in the log
+// Seq numbers past the last write are rejected right away, otherwise only the segment that can hold
+// the entry is scanned, so entries trimmed by retention or truncation are reported missing
+func (wal *WriteAheadLog) Has(seqNo uint64) (bool, error) {
+	wal.locker.Lock()
+	lastSeqNo := wal.lastSeqNo
+	err := wal.bufWriter.Flush()
+	wal.locker.Unlock()
+	if err != nil {
+		return false, err
+	}
+	if seqNo == 0 || seqNo > lastSeqNo {
+		return false, nil
+	}
+
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return false, err
+	}
+	// The entry can only be in the last segment starting at or before it
+	for i := len(logFiles) - 1; i >= 0; i-- {
+		firstSeqNo, ok, err := wal.segmentFirstSeqNo(logFiles[i])
+		if err != nil {
+			return false, err
+		}
+		if !ok || firstSeqNo > seqNo {
+			continue
+		}
+		entries, err := wal.readSegment(logFiles[i])
+		if err != nil {
+			return false, err
+		}
+		for _, entry := range entries {
+			if entry.SeqNo == seqNo {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, nil
+}
+
+// segmentFirstSeqNo returns the seq number of the first entry of a segment, false if it has no entry
+func (wal *WriteAheadLog) segmentFirstSeqNo(path string) (uint64, bool, error) {
+	sr, err := wal.openSegmentReader(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer sr.Close()
+	entry, err := sr.next()
+	if err == io.EOF {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("failed to read segment %s: %w", path, err)
+	}
+	return entry.SeqNo, true, nil
+}
+
+// Prefetch reads through every segment file so the OS page cache holds them before the actual reads
+// It's only advisory, the files are read as stored without decoding the entries
+func (wal *WriteAheadLog) Prefetch() error {
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return err
+	}
+	for _, logFile := range logFiles {
+		file, err := wal.openFile(logFile, os.O_RDONLY, 0)
+		if errors.Is(err, os.ErrNotExist) {
+			// Compressed or deleted since it was listed
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(io.Discard, file)
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("failed to prefetch segment %s: %w", logFile, err)
+		}
+	}
+	return nil
+}
+
+// segmentPath returns the file holding the segment with the given ID
+func (wal *WriteAheadLog) segmentPath(segmentNo int) (string, error) {
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return "", err
+	}
+	for _, logFile := range logFiles {
+		if n, err := parseSegmentNo(logFile); err == nil && n == segmentNo {
+			return logFile, nil
+		}
+	}
+	return "", fmt.Errorf("%w: %d", ErrSegmentNotFound, segmentNo)
+}
+
+// logIterator streams the entries of a list of segments one at a time
+type logIterator struct {
+	wal       *WriteAheadLog
+	segments  []string
+	current   *segmentReader
+	path      string // path of the current segment
+	lastSeqNo uint64 // seq no of the previous entry, checked with VerifySeqNo and OrderingStrict
+	lastNonce uint64 // nonce of the previous entry that had one
+}
+
+// newLogIterator returns an iterator over all the segments of the log
+func (wal *WriteAheadLog) newLogIterator() (*logIterator, error) {
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	if err := wal.checkSegmentGaps(logFiles); err != nil {
+		return nil, err
+	}
+	return &logIterator{wal: wal, segments: logFiles}, nil
+}
+
+// next returns the next entry of the log, or io.EOF once every segment is fully read
+func (it *logIterator) next() (*Entry, error) {
+	for {
+		if it.current == nil {
+			if len(it.segments) == 0 {
+				return nil, io.EOF
+			}
+			it.path = it.segments[0]
+			it.segments = it.segments[1:]
+			sr, err := it.wal.openSegmentReader(it.path)
+			if err != nil {
+				return nil, err
+			}
+			it.current = sr
+		}
+		entry, err := it.current.next()
+		if errors.Is(err, io.ErrUnexpectedEOF) && len(it.segments) == 0 {
+			// An entry cut short at the end of the log is a write torn by a crash, or still being written
+			err = io.EOF
+		}
+		if errors.Is(err, errCorruptionReached) {
+			// With CorruptTruncate the log ends before its first corrupted entry
+			it.segments = nil
+			err = io.EOF
+		}
+		if err == io.EOF {
+			it.current.Close()
+			it.current = nil
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment %s: %w", it.path, err)
+		}
+		if it.wal.verifySeqNo && it.lastSeqNo != 0 && entry.SeqNo != it.lastSeqNo+1 {
+			return nil, fmt.Errorf("failed to read segment %s: %w: seq no %d follows %d",
+				it.path, ErrSeqNoMismatch, entry.SeqNo, it.lastSeqNo)
+		}
+		if it.wal.orderingMode == OrderingStrict && it.lastSeqNo != 0 && entry.SeqNo <= it.lastSeqNo {
+			return nil, fmt.Errorf("failed to read segment %s: %w: seq no %d follows %d",
+				it.path, ErrOutOfOrder, entry.SeqNo, it.lastSeqNo)
+		}
+		it.lastSeqNo = entry.SeqNo
+		if entry.Nonce != 0 {
+			if entry.Nonce <= it.lastNonce {
+				return nil, fmt.Errorf("failed to read segment %s: %w: entry with seq no %d has nonce %d after %d",
+					it.path, ErrNonceRegression, entry.SeqNo, entry.Nonce, it.lastNonce)
+			}
+			it.lastNonce = entry.Nonce
+		}
+		entry, err = it.wal.decodePayload(entry)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read segment %s: %w", it.path, err)
+		}
+		return entry, nil
+	}
+}
+
+func (it *logIterator) Close() error {
+	if it.current == nil {
+		return nil
+	}
+	err := it.current.Close()
+	it.current = nil
+	return err
+}
+
+// Grep returns the entries whose payload contains pattern, for quick inspection of a log
+func (wal *WriteAheadLog) Grep(pattern []byte) ([]*Entry, error) {
+	err := wal.flushForRead()
+	if err != nil {
+		return nil, err
+	}
+	matches := []*Entry{}
+	err = wal.forEach(func(entry *Entry) error {
+		if bytes.Contains(entry.Data, pattern) {
+			matches = append(matches, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return matches, nil
+}
+
+// ReadFromTime returns the entries with a timestamp at or after t
+// Timestamps don't have to be monotonic, every entry of the segments read is checked. A segment is only skipped
+// when the metadata of the segments after it, see Options.SegmentMetaEntries, shows none of its entries can be that recent
+func (wal *WriteAheadLog) ReadFromTime(t time.Time) ([]*Entry, error) {
+	from := t.UnixNano()
+	// A segment is created no earlier than the timestamps written before it,
+	// so all the segments before one created before t hold older entries only
+	return wal.readFromSegmentMeta(func(segmentMeta *wal_pb.SEGMENT_META) bool {
+		return segmentMeta.GetCreatedUnixNano() < from
+	}, func(entry *Entry) bool {
+		return entry.TimestampUnixNano >= from
+	})
+}
+
+// ReadFrom returns the entries after the seqNo sequence number, like the ones left to apply after recovering up to seqNo
+// The segments before one described as starting at or before seqNo+1, see Options.SegmentMetaEntries, aren't read
+func (wal *WriteAheadLog) ReadFrom(seqNo uint64) ([]*Entry, error) {
+	return wal.readFromSegmentMeta(func(segmentMeta *wal_pb.SEGMENT_META) bool {
+		return segmentMeta.GetFirstSeqNo() <= seqNo+1
+	}, func(entry *Entry) bool {
+		return entry.SeqNo > seqNo
+	})
+}
+
+// readFromSegmentMeta returns the entries matching keep, starting at the last segment before which the log can be skipped
+// skipBefore tells from the metadata of a segment whether none of the entries before it match,
+// the segments are only skipped up to the first one without metadata
+func (wal *WriteAheadLog) readFromSegmentMeta(skipBefore func(*wal_pb.SEGMENT_META) bool, keep func(*Entry) bool) ([]*Entry, error) {
+	err := wal.flushForRead()
+	if err != nil {
+		return nil, err
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	if err := wal.checkSegmentGaps(logFiles); err != nil {
+		return nil, err
+	}
+	start := 0
+	for i := 1; i < len(logFiles); i++ {
+		segmentMeta, err := wal.readSegmentMetaAt(logFiles[i])
+		if err != nil {
+			return nil, err
+		}
+		if segmentMeta == nil || !skipBefore(segmentMeta) {
+			break
+		}
+		start = i
+	}
+
+	entries := []*Entry{}
+	it := &logIterator{wal: wal, segments: logFiles[start:]}
+	err = it.forEach(func(entry *Entry) error {
+		if keep(entry) {
+			entries = append(entries, entry)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if wal.orderingMode == OrderingLenient {
+		sortBySeqNo(entries)
+	}
+	return entries, nil
+}
+
+// errDeadlineReached stops the iteration of ReadAllDeadline once its deadline elapsed
+var errDeadlineReached = errors.New("read deadline reached")
+
+// ReadAllDeadline reads the entries like ReadAll but stops once d elapsed, so replaying a large log stays bounded
+// It returns the entries read so far and whether they are the whole log, the deadline is checked between entries
+func (wal *WriteAheadLog) ReadAllDeadline(d time.Duration) ([]*Entry, bool, error) {
+	if err := wal.flushForRead(); err != nil {
+		return nil, false, err
+	}
+	deadline := time.Now().Add(d)
+	entries := []*Entry{}
+	err := wal.forEach(func(entry *Entry) error {
+		entries = append(entries, entry)
+		if time.Now().After(deadline) {
+			return errDeadlineReached
+		}
+		return nil
+	})
+	complete := err == nil
+	if err != nil && !errors.Is(err, errDeadlineReached) {
+		return nil, false, err
+	}
+	if wal.orderingMode == OrderingLenient {
+		sortBySeqNo(entries)
+	}
+	return entries, complete, nil
+}
+
+// ForEach calls fn for every entry of the log in order, one entry at a time
+// Unlike ReadAll it doesn't hold the entries in memory, which suits the recovery of large logs
+// It stops at the first error returned by fn and returns it
+// The chunks of a payload written by WriteLarge are reassembled into a single entry
+func (wal *WriteAheadLog) ForEach(fn func(*Entry) error) error {
+	if err := wal.flushForRead(); err != nil {
+		return err
+	}
+	return wal.forEach(fn)
+}
+
+// forEach is ForEach for the internal callers, which flush the buffered entries themselves
+func (wal *WriteAheadLog) forEach(fn func(*Entry) error) error {
+	it, err := wal.newLogIterator()
+	if err != nil {
+		return err
+	}
+	return it.forEach(fn)
+}
+
+// ApplyParallel calls handler for every entry of the log on workers goroutines, like to replay a keyed state machine
+// The entries are sharded by the hash of their key returned by keyFn, so the entries of a key are handled in log order
+// by the same worker while different keys are handled concurrently. It stops at the first error and returns it
+func (wal *WriteAheadLog) ApplyParallel(keyFn func(*Entry) string, handler func(*Entry) error, workers int) error {
+	if workers < 1 {
+		return fmt.Errorf("invalid number of workers %d", workers)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var firstErr error
+	var errOnce sync.Once
+	fail := func(err error) {
+		errOnce.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+
+	shards := make([]chan *Entry, workers)
+	var wg sync.WaitGroup
+	for i := range shards {
+		shards[i] = make(chan *Entry, 64)
+		wg.Add(1)
+		go func(shard <-chan *Entry) {
+			defer wg.Done()
+			for entry := range shard {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := handler(entry); err != nil {
+					fail(err)
+				}
+			}
+		}(shards[i])
+	}
+
+	err := wal.ForEach(func(entry *Entry) error {
+		hash := fnv.New32a()
+		hash.Write([]byte(keyFn(entry)))
+		select {
+		case shards[hash.Sum32()%uint32(workers)] <- entry:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+	for _, shard := range shards {
+		close(shard)
+	}
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return err
+}
+
+// forEach calls fn for every entry left in the iterator with the chunks reassembled, and closes it
+// The records of a transaction are only handed to fn once its commit is read
+func (it *logIterator) forEach(fn func(*Entry) error) error {
+	defer it.Close()
+	chunks := &chunkAssembler{checksum: it.wal.checksum}
+	txns := &txnAssembler{}
+	for {
+		entry, err := it.next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry, ok := chunks.add(entry)
+		if !ok {
+			continue
+		}
+		if err := txns.add(entry, fn); err != nil {
+			return err
+		}
+	}
+}
+
+// Reader streams the entries of the log one at a time, so a log of any size is read in constant memory
+// It returns the entries ReadAll would return, in the order they are stored:
+//
+//	reader, err := wal.NewReader()
+//	...
+//	defer reader.Close()
+//	for reader.Next() {
+//		entry := reader.Entry()
+//	}
+//	if err := reader.Err(); err != nil { ... }
+type Reader struct {
+	it      *logIterator
+	chunks  *chunkAssembler
+	txns    *txnAssembler
+	pending []*Entry // entries released together by a transaction commit
+	entry   *Entry
+	err     error
+}
+
+// NewReader returns a Reader over the entries written so far
+func (wal *WriteAheadLog) NewReader() (*Reader, error) {
+	err := wal.flushForRead()
+	if err != nil {
+		return nil, err
+	}
+	it, err := wal.newLogIterator()
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{it: it, chunks: &chunkAssembler{checksum: wal.checksum}, txns: &txnAssembler{}}, nil
+}
+
+// Next advances to the next entry, it returns false once the log is read or on the first error, see Err
+func (r *Reader) Next() bool {
+	r.entry = nil
+	for len(r.pending) == 0 {
+		if r.err != nil {
+			return false
+		}
+		entry, err := r.it.next()
+		if err != nil {
+			if err != io.EOF {
+				r.err = err
+			}
+			r.it.Close()
+			return false
+		}
+		entry, ok := r.chunks.add(entry)
+		if !ok {
+			continue
+		}
+		r.txns.add(entry, func(entry *Entry) error {
+			r.pending = append(r.pending, entry)
+			return nil
+		})
+	}
+	r.entry = r.pending[0]
+	r.pending[0] = nil
+	r.pending = r.pending[1:]
+	return true
+}
+
+// Entry returns the entry Next advanced to
+func (r *Reader) Entry() *Entry {
+	return r.entry
+}
+
+// Err returns the error that stopped Next, like an entry failing its checksum, nil once the whole log is read
+func (r *Reader) Err() error {
+	return r.err
+}
+
+// Close releases the segment being read, it is safe to call after Next returned false
+func (r *Reader) Close() error {
+	return r.it.Close()
+}
@@ -0,0 +1,192 @@
+package wal
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// ReplaceAll replaces the whole content of the log with the given entries, like when a follower
+// is bootstrapped from a snapshot. The entries keep their sequence numbers, which must be increasing,
+// and the next write continues after the highest one
+// The new segments are prepared in a staging directory which is renamed into place once complete,
+// a crash before that keeps the old log and a crash after it is completed by the next Open
+func (wal *WriteAheadLog) ReplaceAll(replacement []*Entry) error {
+	entries := make([]*Entry, len(replacement))
+	for i, entry := range replacement {
+		entries[i] = entry
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].SeqNo <= entries[i-1].SeqNo {
+			return fmt.Errorf("entries must have increasing seq numbers, got %d after %d",
+				entries[i].SeqNo, entries[i-1].SeqNo)
+		}
+	}
+	// Let the background compression finish, it must not swap in a segment of the old log
+	wal.background.Wait()
+
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return fmt.Errorf("WAL is closed, cannot replace data")
+	}
+	stagingDir := filepath.Join(wal.logDir, replaceStagingDirName)
+	readyDir := filepath.Join(wal.logDir, replaceReadyDirName)
+	if err := wal.fs.RemoveAll(stagingDir); err != nil {
+		return err
+	}
+	if err := wal.fs.MkdirAll(stagingDir, 0755); err != nil {
+		return err
+	}
+	if err := wal.stageSegments(stagingDir, entries); err != nil {
+		wal.fs.RemoveAll(stagingDir)
+		return fmt.Errorf("failed to stage segments: %w", err)
+	}
+
+	// Renaming the complete staging directory is the commit point
+	if err := wal.fs.Rename(stagingDir, readyDir); err != nil {
+		wal.fs.RemoveAll(stagingDir)
+		return err
+	}
+	if err := syncDir(wal.fs, wal.logDir); err != nil {
+		return err
+	}
+
+	if err := wal.file.Close(); err != nil {
+		return err
+	}
+	wal.file = nil
+	if err := wal.clearRotatedDirs(); err != nil {
+		return fmt.Errorf("failed to drop the segments of the old log: %w", err)
+	}
+	if err := finishReplace(wal.fs, wal.logDir); err != nil {
+		return fmt.Errorf("failed to swap in the new segments: %w", err)
+	}
+	if err := wal.openExistingSegment(); err != nil {
+		return err
+	}
+
+	wal.lastSeqNo = 0
+	wal.lastTimestamp = 0
+	wal.lastCheckpointSeqNo = 0
+	wal.oldestSeqNo = 0
+	wal.entryCount = 0
+	for _, entry := range entries {
+		if entry.IsCheckpoint {
+			wal.lastCheckpointSeqNo = max(wal.lastCheckpointSeqNo, entry.SeqNo)
+		}
+		wal.countEntry(entry)
+	}
+	wal.countKnown = true
+	if len(entries) > 0 {
+		wal.lastSeqNo = entries[len(entries)-1].SeqNo
+		wal.lastTimestamp = entries[len(entries)-1].TimestampUnixNano
+	}
+	if wal.recentCache != nil {
+		wal.recentCache = newRecentCache(len(wal.recentCache.entries))
+	}
+	wal.sinceCheckpointKnown = false
+	if err := wal.persistEntryCount(); err != nil {
+		wal.logger.Printf("%v", err)
+		wal.forgetCount()
+	}
+	return nil
+}
+
+// stageSegments writes the entries into segment files in dir, split at the maximum segment size
+// Every segment but the last is sealed, the last one becomes the active segment
+// The names of the segments are listed in a manifest written last
+func (wal *WriteAheadLog) stageSegments(dir string, entries []*Entry) error {
+	names := []string{}
+	var segment bytes.Buffer
+	flush := func(seal bool) error {
+		if seal {
+			segment.Write(encodeSegmentFooter(crc32.ChecksumIEEE(segment.Bytes())))
+		}
+		name := segmentPrefix + strconv.Itoa(len(names)+1)
+		if err := writeFileAtomic(wal.fs, filepath.Join(dir, name), segment.Bytes()); err != nil {
+			return err
+		}
+		names = append(names, name)
+		segment.Reset()
+		return nil
+	}
+
+	segment.Write(encodeSegmentHeader(wal.framing))
+	for _, entry := range entries {
+		entry = entry.clone()
+		stampChecksum(wal.checksum, entry, entry.SeqNo)
+		var encoded bytes.Buffer
+		if err := encodeEntry(&encoded, wal.codec, wal.framing, entry); err != nil {
+			return err
+		}
+		if segment.Len() > segmentHeaderSize && segment.Len()+encoded.Len() > int(wal.maxLogFileSize) {
+			if err := flush(true); err != nil {
+				return err
+			}
+			segment.Write(encodeSegmentHeader(wal.framing))
+		}
+		if wal.segmentMetaEntries && segment.Len() == segmentHeaderSize {
+			segmentMeta, err := wal.segmentMetaEntry(len(names)+1, entry.SeqNo)
+			if err != nil {
+				return err
+			}
+			if err := encodeEntry(&segment, wal.codec, wal.framing, segmentMeta); err != nil {
+				return err
+			}
+		}
+		segment.Write(encoded.Bytes())
+	}
+	if err := flush(false); err != nil {
+		return err
+	}
+	return writeFileAtomic(wal.fs, filepath.Join(dir, replaceManifestName), []byte(strings.Join(names, "\n")))
+}
+
+// finishReplace swaps the segments committed by ReplaceAll into the log directory
+// It can run again after a crash, segments already moved are listed in the manifest and kept
+// An incomplete staging directory is removed, the replacement never committed
+func finishReplace(fsys FileSystem, logDir string) error {
+	if err := fsys.RemoveAll(filepath.Join(logDir, replaceStagingDirName)); err != nil {
+		return err
+	}
+	readyDir := filepath.Join(logDir, replaceReadyDirName)
+	manifest, err := fsys.ReadFile(filepath.Join(readyDir, replaceManifestName))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	names := strings.Split(string(manifest), "\n")
+
+	// Drop the segments of the old log
+	oldFiles, err := filesWithPrefix(fsys, filepath.Join(logDir, segmentPrefix))
+	if err != nil {
+		return err
+	}
+	for _, oldFile := range oldFiles {
+		if !slices.Contains(names, filepath.Base(oldFile)) {
+			if err := fsys.Remove(oldFile); err != nil {
+				return err
+			}
+		}
+	}
+	for _, name := range names {
+		err := fsys.Rename(filepath.Join(readyDir, name), filepath.Join(logDir, name))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	if err := syncDir(fsys, logDir); err != nil {
+		return err
+	}
+	return fsys.RemoveAll(readyDir)
+}
@@ -0,0 +1,205 @@
+package wal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+)
+
+// CopySegmentTo copies the content of a segment to w, like when shipping it to a follower, and returns the byte count
+// The framed entries are copied as they are stored, compressed segments are copied uncompressed
+// For the active segment only what was flushed when the call started is copied
+func (wal *WriteAheadLog) CopySegmentTo(segmentNo int, w io.Writer) (int64, error) {
+	wal.locker.Lock()
+	path, err := wal.segmentPath(segmentNo)
+	if err != nil {
+		wal.locker.Unlock()
+		return 0, err
+	}
+	limit := int64(-1)
+	// Once closed the active segment is complete on disk
+	if segmentNo == wal.currentSegmentNo && wal.file != nil {
+		if err := wal.bufWriter.Flush(); err != nil {
+			wal.locker.Unlock()
+			return 0, err
+		}
+		fileInfo, err := wal.file.Stat()
+		if err != nil {
+			wal.locker.Unlock()
+			return 0, err
+		}
+		limit = fileInfo.Size()
+	}
+	content, err := wal.openSegmentContent(path)
+	wal.locker.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	defer content.Close()
+
+	var reader io.Reader = content
+	if limit >= 0 {
+		// Entries appended after the flush are left for the next copy
+		reader = io.LimitReader(content, limit)
+	}
+	n, err := io.Copy(w, reader)
+	if err != nil {
+		return n, fmt.Errorf("failed to copy segment %d: %w", segmentNo, err)
+	}
+	return n, nil
+}
+
+// InstallSegment writes a segment received from a replication stream, like the output of CopySegmentTo on the leader
+// The framing and the checksums of the entries are validated before anything is written, and the first entry
+// must continue the log, otherwise an error wrapping ErrSegmentNotContiguous is returned
+// The segment number must come after the active segment, which is sealed, or be the one of the active segment
+// while it holds no entry. A sealed segment is followed by a new active segment, otherwise writes append to it
+func (wal *WriteAheadLog) InstallSegment(segmentNo int, r io.Reader) error {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return fmt.Errorf("failed to receive segment %d: %w", segmentNo, err)
+	}
+	entries, err := decodeSegment(content, wal.codec, wal.checksum)
+	if err != nil {
+		return fmt.Errorf("invalid segment %d: %w", segmentNo, err)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("invalid segment %d: no entries", segmentNo)
+	}
+
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return fmt.Errorf("WAL is closed, cannot install segment")
+	}
+	if entries[0].SeqNo != wal.lastSeqNo+1 {
+		return fmt.Errorf("%w: segment %d starts at seq no %d, the log is at %d",
+			ErrSegmentNotContiguous, segmentNo, entries[0].SeqNo, wal.lastSeqNo)
+	}
+	if err := wal.syncLocked(); err != nil {
+		return err
+	}
+	fileInfo, err := wal.file.Stat()
+	if err != nil {
+		return err
+	}
+	activeIsEmpty := fileInfo.Size() <= segmentHeaderSize
+	if segmentNo < wal.currentSegmentNo || (segmentNo == wal.currentSegmentNo && !activeIsEmpty) {
+		return fmt.Errorf("%w: segment %d is not after the active segment %d",
+			ErrSegmentNotContiguous, segmentNo, wal.currentSegmentNo)
+	}
+
+	// Retire the active segment, an empty one is simply replaced or left behind
+	if !activeIsEmpty {
+		if err := wal.sealSegment(); err != nil {
+			return err
+		}
+	}
+	if err := wal.file.Close(); err != nil {
+		return err
+	}
+	wal.file = nil
+	path := wal.logFileNamePrefix + strconv.Itoa(segmentNo)
+	if err := writeFileAtomic(wal.fs, path, content); err != nil {
+		return err
+	}
+
+	wal.currentSegmentNo = segmentNo
+	if hasSegmentFooter(content) {
+		wal.currentSegmentNo++
+		err = wal.createNewSegment()
+	} else {
+		err = wal.openActiveSegment(path)
+	}
+	if err != nil {
+		return err
+	}
+
+	last := entries[len(entries)-1]
+	wal.lastSeqNo = last.SeqNo
+	wal.lastTimestamp = max(wal.lastTimestamp, last.TimestampUnixNano)
+	wal.oldestSeqNo = 0
+	wal.forgetCount()
+	for _, entry := range entries {
+		if entry.IsCheckpoint {
+			wal.lastCheckpointSeqNo = max(wal.lastCheckpointSeqNo, entry.SeqNo)
+		}
+	}
+	if wal.recentCache != nil {
+		for _, entry := range entries {
+			wal.recentCache.add(entry)
+		}
+	}
+	wal.sinceCheckpointKnown = false
+	return nil
+}
+
+// openActiveSegment opens an existing segment file to append to it
+func (wal *WriteAheadLog) openActiveSegment(path string) error {
+	file, err := wal.openFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if wal.activeFraming, err = fileFraming(file); err != nil {
+		file.Close()
+		return err
+	}
+	wal.file = file
+	wal.bufWriter = wal.newEntryWriter(file)
+	// The installed segment holds entries, with the metadata entry of the leader if it wrote one
+	wal.segmentMetaPending = false
+	return nil
+}
+
+// decodeSegment validates the content of a segment file and returns its entries
+// The footer of a sealed segment is verified as well
+func decodeSegment(content []byte, codec EntryCodec, checksum ChecksumFunc) ([]*Entry, error) {
+	if err := checkSegmentFooter(content); err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(content)
+	sr := &segmentReader{file: io.NopCloser(reader), reader: bufio.NewReader(reader), codec: codec, checksum: checksum}
+	var err error
+	if sr.header, err = readSegmentHeader(sr.reader); err != nil {
+		return nil, err
+	}
+	entries := []*Entry{}
+	for {
+		entry, err := sr.next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 && entry.SeqNo != entries[len(entries)-1].SeqNo+1 {
+			return nil, fmt.Errorf("%w: seq no %d follows %d",
+				ErrSegmentNotContiguous, entry.SeqNo, entries[len(entries)-1].SeqNo)
+		}
+		entries = append(entries, entry)
+	}
+}
+
+// writeReplica writes the framed entry to the replica sink
+// A failure fails the write only with Options.FailOnReplicaError, otherwise it's logged
+// The caller must hold the lock
+func (wal *WriteAheadLog) writeReplica(entry *Entry) error {
+	var framed bytes.Buffer
+	// The replica stream doesn't depend on the framing of the segments
+	err := encodeEntry(&framed, wal.codec, FramingFixed32, entry)
+	if err == nil {
+		_, err = wal.replicaSink.Write(framed.Bytes())
+	}
+	if err == nil {
+		return nil
+	}
+	if wal.failOnReplicaError {
+		return fmt.Errorf("failed to write entry %d to the replica: %w", entry.SeqNo, err)
+	}
+	wal.logger.Printf("failed to write entry %d to the replica: %v", entry.SeqNo, err)
+	return nil
+}
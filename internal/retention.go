@@ -0,0 +1,156 @@
+package wal
+
+import (
+	"fmt"
+	"io"
+)
+
+// PurgeExpired deletes the oldest segments whose newest entry is older than Options.RetentionAge
+// The active segment and the one holding the most recent checkpoint are never deleted, nor the segments
+// after them, so the log stays contiguous. It also runs on every rotation, it does nothing without RetentionAge
+func (wal *WriteAheadLog) PurgeExpired() error {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return fmt.Errorf("WAL is closed, cannot purge data")
+	}
+	if err := wal.bufWriter.Flush(); err != nil {
+		return err
+	}
+	return wal.purgeExpired()
+}
+
+// purgeExpired deletes the expired segments, see PurgeExpired
+// The caller must hold the lock
+func (wal *WriteAheadLog) purgeExpired() error {
+	if wal.retentionAge <= 0 {
+		return nil
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return err
+	}
+	expiredBefore := wal.clock().Add(-wal.retentionAge).UnixNano()
+	// The last segment is the active one
+	for len(logFiles) > 1 {
+		holdsCheckpoint, err := wal.holdsLastCheckpoint(logFiles)
+		if err != nil {
+			return err
+		}
+		if holdsCheckpoint {
+			return nil
+		}
+		newest, ok, err := wal.segmentNewestTimestamp(logFiles[0])
+		if err != nil {
+			return err
+		}
+		// A segment without entries has nothing to retain
+		if ok && newest >= expiredBefore {
+			return nil
+		}
+		nextFirstSeqNo, _, err := wal.segmentFirstSeqNo(logFiles[1])
+		if err != nil {
+			return err
+		}
+		if err := wal.removeOldestSegment(logFiles[0]); err != nil {
+			return fmt.Errorf("failed to purge segment %s: %w", logFiles[0], err)
+		}
+		if wal.recentCache != nil {
+			wal.recentCache.dropBefore(nextFirstSeqNo)
+		}
+		logFiles = logFiles[1:]
+	}
+	return nil
+}
+
+// segmentNewestTimestamp returns the timestamp of the last entry of a segment, false if it has no entry
+func (wal *WriteAheadLog) segmentNewestTimestamp(path string) (int64, bool, error) {
+	sr, err := wal.openSegmentReader(path)
+	if err != nil {
+		return 0, false, err
+	}
+	defer sr.Close()
+	var newest int64
+	found := false
+	for {
+		entry, err := sr.next()
+		if err == io.EOF {
+			return newest, found, nil
+		}
+		if err != nil {
+			return 0, false, fmt.Errorf("failed to read segment %s: %w", path, err)
+		}
+		newest, found = entry.TimestampUnixNano, true
+	}
+}
+
+// PurgeOverSize deletes the oldest segments while the segments take more than Options.MaxTotalSize on disk,
+// counting the active segment at its maximum size, and returns the IDs of the segments deleted
+// The active segment and the one holding the most recent checkpoint are never deleted, nor the segments
+// after them. It also runs on every rotation, it does nothing without MaxTotalSize
+func (wal *WriteAheadLog) PurgeOverSize() ([]int, error) {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return nil, fmt.Errorf("WAL is closed, cannot purge data")
+	}
+	if err := wal.bufWriter.Flush(); err != nil {
+		return nil, err
+	}
+	return wal.purgeOverSize()
+}
+
+// purgeOverSize deletes the oldest segments over the size cap, see PurgeOverSize
+// The caller must hold the lock
+func (wal *WriteAheadLog) purgeOverSize() ([]int, error) {
+	if wal.maxTotalSize <= 0 {
+		return nil, nil
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	sizes := make([]int64, len(logFiles))
+	// The active segment, the last one, grows up to the maximum size before the next rotation
+	total := int64(wal.maxLogFileSize)
+	for i, logFile := range logFiles[:len(logFiles)-1] {
+		fileInfo, err := wal.fs.Stat(logFile)
+		if err != nil {
+			return nil, err
+		}
+		sizes[i] = fileInfo.Size()
+		total += sizes[i]
+	}
+	removed := []int{}
+	for total > wal.maxTotalSize && len(logFiles) > 1 {
+		holdsCheckpoint, err := wal.holdsLastCheckpoint(logFiles)
+		if err != nil {
+			return removed, err
+		}
+		if holdsCheckpoint {
+			wal.logger.Printf("WAL takes %d bytes, over the maximum of %d, keeping %s holding the last checkpoint %d",
+				total, wal.maxTotalSize, logFiles[0], wal.lastCheckpointSeqNo)
+			return removed, nil
+		}
+		segmentNo, err := parseSegmentNo(logFiles[0])
+		if err != nil {
+			return removed, err
+		}
+		nextFirstSeqNo, _, err := wal.segmentFirstSeqNo(logFiles[1])
+		if err != nil {
+			return removed, err
+		}
+		if err := wal.removeOldestSegment(logFiles[0]); err != nil {
+			return removed, fmt.Errorf("failed to purge segment %s: %w", logFiles[0], err)
+		}
+		if wal.recentCache != nil {
+			wal.recentCache.dropBefore(nextFirstSeqNo)
+		}
+		removed = append(removed, segmentNo)
+		total -= sizes[0]
+		logFiles, sizes = logFiles[1:], sizes[1:]
+	}
+	return removed, nil
+}
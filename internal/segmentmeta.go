@@ -0,0 +1,84 @@
+package wal
+
+import (
+	"fmt"
+	"hash/crc32"
+	"io"
+	wal_pb "wal/proto"
+
+	pb "google.golang.org/protobuf/proto"
+)
+
+// segmentMetaEntry returns the entry describing a segment, stored before its first entry
+// It has no sequence number and the reads skip it
+func (wal *WriteAheadLog) segmentMetaEntry(segmentNo int, firstSeqNo uint64) (*Entry, error) {
+	data, err := pb.Marshal(&wal_pb.SEGMENT_META{
+		SegmentId:       uint32(segmentNo),
+		FirstSeqNo:      firstSeqNo,
+		CreatedUnixNano: max(wal.clock().UnixNano(), wal.lastTimestamp), // no entry before the segment is newer
+		ConfigHash:      wal.configHash(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	entry := &Entry{Data: data, IsSegmentMeta: true}
+	entry.ChecksumType = uint32(wal.checksumType)
+	stampChecksum(wal.checksum, entry, 0)
+	return entry, nil
+}
+
+// writeSegmentMeta writes the entry describing the active segment before its first entry, with the firstSeqNo seq no
+// The caller must hold the lock
+func (wal *WriteAheadLog) writeSegmentMeta(firstSeqNo uint64) error {
+	entry, err := wal.segmentMetaEntry(wal.currentSegmentNo, firstSeqNo)
+	if err != nil {
+		return err
+	}
+	if err := encodeEntry(wal.bufWriter, wal.codec, wal.activeFraming, entry); err != nil {
+		return fmt.Errorf("failed to write segment metadata: %w", err)
+	}
+	wal.segmentMetaPending = false
+	return nil
+}
+
+// configHash identifies the options shaping the content of the segments
+func (wal *WriteAheadLog) configHash() uint32 {
+	return crc32.ChecksumIEEE(fmt.Appendf(nil, "maxLogFileSize=%d maxEntrySize=%d entryNonces=%t codec=%T",
+		wal.maxLogFileSize, wal.maxEntrySize, wal.entryNonces, wal.codec))
+}
+
+// ReadSegmentMeta returns the description stored at the start of the segment with the given ID
+// Segments are described when written with Options.SegmentMetaEntries, it returns nil for the others
+func (wal *WriteAheadLog) ReadSegmentMeta(segmentNo int) (*wal_pb.SEGMENT_META, error) {
+	err := wal.flushForRead()
+	if err != nil {
+		return nil, err
+	}
+
+	path, err := wal.segmentPath(segmentNo)
+	if err != nil {
+		return nil, err
+	}
+	return wal.readSegmentMetaAt(path)
+}
+
+// readSegmentMetaAt returns the description stored at the start of a segment file, nil if it has none
+func (wal *WriteAheadLog) readSegmentMetaAt(path string) (*wal_pb.SEGMENT_META, error) {
+	sr, err := wal.openSegmentReader(path)
+	if err != nil {
+		return nil, err
+	}
+	defer sr.Close()
+	// Reading the first entry reads past the description
+	if _, err := sr.next(); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read segment %s: %w", path, err)
+	}
+	if sr.segmentMeta == nil {
+		return nil, nil
+	}
+	segmentMeta := &wal_pb.SEGMENT_META{}
+	if err := pb.Unmarshal(sr.segmentMeta.Data, segmentMeta); err != nil {
+		return nil, fmt.Errorf("invalid metadata in segment %s: %w", path, err)
+	}
+	return segmentMeta, nil
+}
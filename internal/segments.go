@@ -2,23 +2,25 @@ package wal
 
 import (
 	"bufio"
-	"encoding/binary"
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"errors"
 	"fmt"
 	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
-	wal_pb "wal/proto"
-
-	proto "google.golang.org/protobuf/proto"
+	"time"
 )
 
 // Check if the directory is empty
-func checkEmptyDir(dirPath string) (bool, error) {
-	entries, err := os.ReadDir(dirPath)
+func checkEmptyDir(fsys FileSystem, dirPath string) (bool, error) {
+	entries, err := fsys.ReadDir(dirPath)
 	if err != nil {
 		return false, err
 	}
@@ -29,10 +31,10 @@ func checkEmptyDir(dirPath string) (bool, error) {
 // If it is empty, it creates a new segment file
 // If it is not empty, it opens the last segment file for writing
 func (wal *WriteAheadLog) openExistingOrCreateSegment(dirPath string) error {
-	if err := os.MkdirAll(dirPath, 0755); err != nil {
+	if err := wal.fs.MkdirAll(dirPath, 0755); err != nil {
 		return err
 	}
-	isEmptyDir, err := checkEmptyDir(dirPath)
+	isEmptyDir, err := checkEmptyDir(wal.fs, dirPath)
 	if err != nil {
 		return err
 	}
@@ -52,16 +54,44 @@ func (wal *WriteAheadLog) openExistingOrCreateSegment(dirPath string) error {
 	return nil
 }
 
+// openForAppend opens the last segment for appending, retrying up to Options.OpenRetries times
+// with a growing backoff while another process briefly holds it
+func (wal *WriteAheadLog) openForAppend(path string) (File, error) {
+	backoff := wal.openRetryBackoff
+	for attempt := 0; ; attempt++ {
+		file, err := wal.openFile(path, os.O_RDWR|os.O_APPEND, 0644)
+		if err == nil || attempt >= wal.openRetries || errors.Is(err, os.ErrNotExist) {
+			return file, err
+		}
+		wal.logger.Printf("failed to open segment %s, retrying in %v: %v", path, backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
 // Create a file with the prefix and segment no
 // It creates a new segment file with the name "segment-<segmentID>"
 func (wal *WriteAheadLog) createNewSegment() error {
 	fileName := wal.logFileNamePrefix + strconv.Itoa(wal.currentSegmentNo)
-	file, err := os.OpenFile(fileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
+	file, err := wal.openFile(fileName, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
 	if err != nil {
 		return err
 	}
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if fileInfo.Size() == 0 {
+		if _, err := file.Write(encodeSegmentHeader(wal.framing)); err != nil {
+			return fmt.Errorf("failed to write segment header: %w", err)
+		}
+	}
+	if wal.activeFraming, err = fileFraming(file); err != nil {
+		return err
+	}
 	wal.file = file
-	wal.bufWriter = bufio.NewWriter(file)
+	wal.bufWriter = wal.newEntryWriter(file)
+	wal.segmentMetaPending = wal.segmentMetaEntries && fileInfo.Size() <= segmentHeaderSize
 	return nil
 }
 
@@ -72,33 +102,103 @@ func (wal *WriteAheadLog) createNewSegment() error {
 // It also seeks to the end of the file to append new data
 func (wal *WriteAheadLog) openExistingSegment() error {
 	// Get the list of log files in the directory, using the prefix
-	logFiles, err := filepath.Glob(wal.logFileNamePrefix + "*")
+	logFiles, err := wal.listSegments()
+	if errors.Is(err, ErrNoSegments) && wal.onMissingSegments == MissingSegmentsCreate {
+		// Nothing left to append to, start over with a fresh segment
+		return wal.createNewSegment()
+	}
 	if err != nil {
 		return err
 	}
-	sort.Strings(logFiles)
 	lastFileName := logFiles[len(logFiles)-1]
+	if isCompressedSegment(lastFileName) {
+		// A compressed segment is sealed, continue in a new segment after it
+		lastSegmentNo, err := parseSegmentNo(lastFileName)
+		if err != nil {
+			return err
+		}
+		wal.currentSegmentNo = lastSegmentNo + 1
+		return wal.createNewSegment()
+	}
 	// Open the last segment file for writing
-	file, err := os.OpenFile(lastFileName, os.O_RDWR|os.O_APPEND, 0644)
+	file, err := wal.openForAppend(lastFileName)
 	if err != nil {
 		return err
 	}
 	// Extract the segment ID from the file name
-	s := strings.Split(lastFileName, segmentPrefix)
-	lastSegmentNo, err := strconv.Atoi(s[1])
+	lastSegmentNo, err := parseSegmentNo(lastFileName)
 	if err != nil {
 		return err
 	}
+	sealed, err := fileHasSegmentFooter(file)
+	if err != nil {
+		return err
+	}
+	if sealed {
+		// The segment was sealed but the rotation didn't get to create the next one
+		file.Close()
+		wal.currentSegmentNo = lastSegmentNo + 1
+		return wal.createNewSegment()
+	}
+	if err := truncateTornTail(file, wal.codec, wal.logger); err != nil {
+		file.Close()
+		return err
+	}
 	// Go to the end of the file
-	if _, err := file.Seek(0, io.SeekEnd); err != nil {
+	end, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
 		return fmt.Errorf("failed to seek to the end of segment: %w", err)
 	}
+	if wal.activeFraming, err = fileFraming(file); err != nil {
+		return err
+	}
 	wal.file = file
-	wal.bufWriter = bufio.NewWriter(file)
+	wal.bufWriter = wal.newEntryWriter(file)
 	wal.currentSegmentNo = lastSegmentNo
+	wal.segmentMetaPending = wal.segmentMetaEntries && end <= segmentHeaderSize
 	return nil
 }
 
+// truncateTornTail cuts the active segment after its last complete entry
+// A crash in the middle of a write leaves an entry cut short at the end of the segment,
+// the next entries would be appended after it and unreadable
+func truncateTornTail(file File, codec EntryCodec, logger Logger) error {
+	fileInfo, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	content := make([]byte, fileInfo.Size())
+	if _, err := file.ReadAt(content, 0); err != nil {
+		return fmt.Errorf("failed to read segment %s: %w", file.Name(), err)
+	}
+	remaining := bytes.NewReader(content)
+	sr := &segmentReader{file: io.NopCloser(remaining), reader: bufio.NewReader(remaining), codec: codec}
+	if sr.header, err = readSegmentHeader(sr.reader); err != nil {
+		return fmt.Errorf("segment %s: %w", file.Name(), err)
+	}
+	// offset is the end of the last complete entry
+	consumed := func() int64 {
+		return int64(len(content) - remaining.Len() - sr.reader.Buffered())
+	}
+	offset := consumed()
+	for {
+		_, err := sr.next()
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			break
+		}
+		if err != nil {
+			// Other errors are left to the readers, only a cut short tail is expected after a crash
+			return nil
+		}
+		offset = consumed()
+	}
+	logger.Printf("truncating segment %s from %d to %d bytes, its last entry is incomplete", file.Name(), len(content), offset)
+	if err := file.Truncate(offset); err != nil {
+		return fmt.Errorf("failed to truncate the incomplete entry of segment %s: %w", file.Name(), err)
+	}
+	return file.Sync()
+}
+
 // Check if the current segment file size exceeds the maximum log file size
 func (wal *WriteAheadLog) checkRotateLog(entry []byte) bool {
 	fileInfo, _ := wal.file.Stat()
@@ -109,8 +209,27 @@ func (wal *WriteAheadLog) checkRotateLog(entry []byte) bool {
 	return false
 }
 
+// Rotate seals the active segment and continues the log in a new one, regardless of MaxLogFileSize,
+// like to start a segment at application defined boundaries. Sequence numbers continue across it
+func (wal *WriteAheadLog) Rotate() error {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return fmt.Errorf("WAL is closed, cannot rotate segment")
+	}
+	if err := wal.syncLocked(); err != nil {
+		return fmt.Errorf("Couldn't rotate log, error in syncing %v", err)
+	}
+	return wal.rotateLog()
+}
+
 // Rotate the log file if it exceeds the maximum log file size
 func (wal *WriteAheadLog) rotateLog() error {
+	sealedSegment := wal.file.Name()
+	if err := wal.sealSegment(); err != nil {
+		return fmt.Errorf("failed to seal segment %s: %w", sealedSegment, err)
+	}
 	if err := wal.file.Close(); err != nil {
 		return err
 	}
@@ -118,88 +237,594 @@ func (wal *WriteAheadLog) rotateLog() error {
 	if err := wal.checkAndDeleteOldSegment(); err != nil {
 		return err
 	}
+	if err := wal.rotateSegmentDir(); err != nil {
+		return err
+	}
 	if err := wal.createNewSegment(); err != nil {
 		return err
 	}
+	if err := wal.purgeExpired(); err != nil {
+		wal.logger.Printf("failed to purge the expired segments: %v", err)
+	}
+	if removed, err := wal.purgeOverSize(); err != nil {
+		wal.logger.Printf("failed to purge the segments over the maximum total size: %v", err)
+	} else if len(removed) > 0 {
+		wal.logger.Printf("WAL purged segments %v to stay under the maximum total size of %d bytes", removed, wal.maxTotalSize)
+	}
+	if err := wal.persistEntryCount(); err != nil {
+		wal.logger.Printf("%v", err)
+		wal.forgetCount()
+	}
+	wal.checkSegmentCount()
+	rewrites := wal.segmentRewrites
+	if wal.compressSealedSegments && wal.singleWriter {
+		// Without a real lock the compression can't run next to the writes
+		if err := wal.compressSegment(sealedSegment, rewrites); err != nil {
+			wal.logger.Printf("failed to compress segment %s: %v", sealedSegment, err)
+		}
+	} else if wal.compressSealedSegments {
+		wal.background.Add(1)
+		go func() {
+			defer wal.background.Done()
+			if err := wal.compressSegment(sealedSegment, rewrites); err != nil {
+				wal.logger.Printf("failed to compress segment %s: %v", sealedSegment, err)
+			}
+		}()
+	}
+	return nil
+}
+
+// sealSegment appends the footer with the checksum of the segment content to the active segment
+// The buffered entries must have been synced before
+func (wal *WriteAheadLog) sealSegment() error {
+	file, err := wal.fs.Open(wal.file.Name())
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	hash := crc32.NewIEEE()
+	if _, err := io.Copy(hash, file); err != nil {
+		return err
+	}
+	if _, err := wal.file.Write(encodeSegmentFooter(hash.Sum32())); err != nil {
+		return err
+	}
+	return wal.fsyncActive()
+}
+
+// rewriteSegment replaces the entries of a segment file with the ones returned by transform
+// The new content is written into a temporary file and renamed over the segment, so a crash leaves
+// either the old or the new segment. A sealed segment gets a new footer and a compressed one stays compressed
+// The caller must hold the lock and have flushed the buffered entries
+func (wal *WriteAheadLog) rewriteSegment(path string, transform func([]*Entry) []*Entry) error {
+	file, err := wal.openSegmentContent(path)
+	if err != nil {
+		return err
+	}
+	content, err := io.ReadAll(file)
+	file.Close()
+	if err != nil {
+		return err
+	}
+	segmentMeta, entries, err := wal.readSegmentWithMeta(path)
+	if err != nil {
+		return err
+	}
+	entries = transform(entries)
+	if segmentMeta != nil {
+		entries = append([]*Entry{segmentMeta}, entries...)
+	}
+
+	framing, err := contentFraming(content)
+	if err != nil {
+		return err
+	}
+	data, err := encodeSegment(entries, wal.codec, framing, hasSegmentFooter(content), isCompressedSegment(path))
+	if err != nil {
+		return err
+	}
+
+	isActive := wal.file != nil && path == wal.file.Name()
+	wal.segmentRewrites++
+	if err := writeFileAtomic(wal.fs, path, data); err != nil {
+		return fmt.Errorf("failed to rewrite segment %s: %w", path, err)
+	}
+	if !isActive {
+		return nil
+	}
+	// The open file still points to the replaced segment, continue appending to the new one
+	wal.file.Close()
+	activeFile, err := wal.openFile(path, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	wal.file = activeFile
+	wal.bufWriter = wal.newEntryWriter(activeFile)
 	return nil
 }
 
-// Check and delete the oldest segment if the maximum number of segments is reached
+// encodeSegment returns the content of a segment file holding the entries
+// A sealed segment ends with a footer, a compressed one is gzip compressed as a whole
+func encodeSegment(entries []*Entry, codec EntryCodec, framing FramingMode, sealed, compressed bool) ([]byte, error) {
+	var segment bytes.Buffer
+	segment.Write(encodeSegmentHeader(framing))
+	for _, entry := range entries {
+		if err := encodeEntry(&segment, codec, framing, entry); err != nil {
+			return nil, err
+		}
+	}
+	return finishSegment(segment.Bytes(), sealed, compressed)
+}
+
+// finishSegment returns the segment file content for the header and entries, sealed with a footer
+// and gzip compressed as requested
+func finishSegment(segment []byte, sealed, compressed bool) ([]byte, error) {
+	if sealed {
+		segment = append(segment, encodeSegmentFooter(crc32.ChecksumIEEE(segment))...)
+	}
+	if !compressed {
+		return segment, nil
+	}
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	if _, err := zw.Write(segment); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return gzipped.Bytes(), nil
+}
+
+// checkSegmentGaps looks for segments missing between the first and the last of logFiles
+// Depending on Options.OnSegmentGap it returns an ErrSegmentGap or logs them
+func (wal *WriteAheadLog) checkSegmentGaps(logFiles []string) error {
+	segmentNos := make([]int, 0, len(logFiles))
+	for _, logFile := range logFiles {
+		segmentNo, err := parseSegmentNo(logFile)
+		if err != nil {
+			return err
+		}
+		segmentNos = append(segmentNos, segmentNo)
+	}
+	slices.Sort(segmentNos)
+	missing := []int{}
+	for i := 1; i < len(segmentNos); i++ {
+		for segmentNo := segmentNos[i-1] + 1; segmentNo < segmentNos[i]; segmentNo++ {
+			missing = append(missing, segmentNo)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	if wal.onSegmentGap == SegmentGapWarn {
+		wal.logger.Printf("WAL is missing segments %v, their entries are skipped", missing)
+		return nil
+	}
+	return &ErrSegmentGap{Missing: missing}
+}
+
+// checkSegmentCount warns once when the number of segments exceeds the configured threshold
+// The warning fires again only after the count went back under the threshold
+func (wal *WriteAheadLog) checkSegmentCount() {
+	if wal.segmentCountWarnAt <= 0 {
+		return
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return
+	}
+	if len(logFiles) <= wal.segmentCountWarnAt {
+		wal.segmentCountWarned = false
+		return
+	}
+	if wal.segmentCountWarned {
+		return
+	}
+	wal.segmentCountWarned = true
+	if wal.onSegmentCountWarning != nil {
+		wal.onSegmentCountWarning(len(logFiles))
+		return
+	}
+	wal.logger.Printf("WAL has %d segments, over the warning threshold of %d", len(logFiles), wal.segmentCountWarnAt)
+}
+
+// compressSegment replaces a sealed segment with a gzip compressed "segment-<segmentID>.gz" copy
+// The copy is written to a temporary file first, so a crash never leaves a partial .gz segment
+func (wal *WriteAheadLog) compressSegment(segmentPath string, rewrites uint64) error {
+	tmpPath := segmentPath + compressedSuffix + ".tmp"
+	if err := gzipFile(wal.fs, segmentPath, tmpPath); err != nil {
+		wal.fs.Remove(tmpPath)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil // The segment was deleted in the meantime
+		}
+		return err
+	}
+
+	// Segments are deleted under the lock, so only swap in the copy if the segment is still there
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+	if _, err := wal.fs.Stat(segmentPath); errors.Is(err, os.ErrNotExist) {
+		return wal.fs.Remove(tmpPath)
+	}
+	// A segment rewritten since the copy started would get its old entries back, it stays uncompressed
+	if wal.segmentRewrites != rewrites {
+		return wal.fs.Remove(tmpPath)
+	}
+	if err := wal.fs.Rename(tmpPath, segmentPath+compressedSuffix); err != nil {
+		return err
+	}
+	return wal.fs.Remove(segmentPath)
+}
+
+// gzipFile writes a gzip compressed and synced copy of src into dst
+func gzipFile(fsys FileSystem, src, dst string) error {
+	in, err := fsys.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := fsys.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	zw := gzip.NewWriter(out)
+	if _, err := io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// checkAndDeleteOldSegment deletes the oldest segments so the new one fits in the maximum number of segments
+// A segment holding the most recent checkpoint is where recovery starts, it is kept with a warning
 func (wal *WriteAheadLog) checkAndDeleteOldSegment() error {
-	if wal.currentSegmentNo <= wal.maxSegments {
+	logFiles, err := wal.listSegments()
+	if errors.Is(err, ErrNoSegments) && wal.onMissingSegments == MissingSegmentsCreate {
+		// Segments were removed externally, nothing left to delete
 		return nil
 	}
-	oldestSegment, err := findOldestSegment(wal.logFileNamePrefix)
 	if err != nil {
 		return fmt.Errorf("Can't find oldest segment %v", err)
 	}
-	if err := os.Remove(oldestSegment); err != nil {
-		return fmt.Errorf("Can't remove the file %v", err)
+	// The new segment is about to be created
+	for len(logFiles)+1 > wal.maxSegments && len(logFiles) > 0 {
+		holdsCheckpoint, err := wal.holdsLastCheckpoint(logFiles)
+		if err != nil {
+			return err
+		}
+		if holdsCheckpoint {
+			wal.logger.Printf("WAL has %d segments, over the maximum of %d, keeping %s holding the last checkpoint %d",
+				len(logFiles)+1, wal.maxSegments, logFiles[0], wal.lastCheckpointSeqNo)
+			return nil
+		}
+		if err := wal.removeOldestSegment(logFiles[0]); err != nil {
+			return fmt.Errorf("Can't remove the file %v", err)
+		}
+		logFiles = logFiles[1:]
 	}
 	return nil
 }
 
-// Find the oldest segment file based on the prefix
-func findOldestSegment(pathWithPrefix string) (string, error) {
-	logFiles, err := filepath.Glob(pathWithPrefix + "*")
+// holdsLastCheckpoint reports whether the first of the segments, the oldest one, holds the most recent checkpoint
+// Recovery starts there, it must be kept
+func (wal *WriteAheadLog) holdsLastCheckpoint(logFiles []string) (bool, error) {
+	if wal.lastCheckpointSeqNo == 0 {
+		return false, nil
+	}
+	firstSeqNo, ok, err := wal.segmentFirstSeqNo(logFiles[0])
+	if err != nil {
+		return false, err
+	}
+	if !ok || firstSeqNo > wal.lastCheckpointSeqNo {
+		return false, nil
+	}
+	if len(logFiles) == 1 {
+		return true, nil
+	}
+	nextFirstSeqNo, ok, err := wal.segmentFirstSeqNo(logFiles[1])
 	if err != nil {
-		return "", fmt.Errorf("Failed to list files: %v", err)
+		return false, err
+	}
+	return !ok || nextFirstSeqNo > wal.lastCheckpointSeqNo, nil
+}
+
+// removeOldestSegment deletes the oldest segment of the log, keeping the entry count up to date
+// The caller must hold the lock
+func (wal *WriteAheadLog) removeOldestSegment(path string) error {
+	if wal.countKnown {
+		removed, err := wal.countSegmentEntries(path)
+		if err != nil || removed > wal.entryCount {
+			wal.forgetCount()
+		} else {
+			wal.entryCount -= removed
+		}
+	}
+	if err := wal.fs.Remove(path); err != nil {
+		wal.forgetCount()
+		return err
+	}
+	wal.oldestSeqNo = 0
+	return nil
+}
+
+// parseSegmentNo extracts the segment ID from a "segment-<segmentID>" file name
+// Compressed segments named "segment-<segmentID>.gz" are accepted too
+func parseSegmentNo(fileName string) (int, error) {
+	s := strings.Split(strings.TrimSuffix(filepath.Base(fileName), compressedSuffix), segmentPrefix)
+	if len(s) != 2 {
+		return 0, fmt.Errorf("invalid segment file name %s", fileName)
+	}
+	return strconv.Atoi(s[1])
+}
+
+// isCompressedSegment reports whether the segment file was compressed after sealing
+func isCompressedSegment(fileName string) bool {
+	return strings.HasSuffix(fileName, compressedSuffix)
+}
+
+// listSegmentFiles returns the segment files of fsys matching the prefix sorted by segment ID, so segment-10 comes after segment-9
+// It never returns an empty list, if there is no segment file it returns an error wrapping ErrNoSegments
+func listSegmentFiles(fsys FileSystem, pathWithPrefix string) ([]string, error) {
+	matches, err := filesWithPrefix(fsys, pathWithPrefix)
+	if err != nil {
+		return nil, err
+	}
+	logFiles := []string{}
+	segmentNos := map[string]int{}
+	for _, match := range matches {
+		// Skip leftovers like temporary files of an interrupted compression
+		segmentNo, err := parseSegmentNo(match)
+		if err != nil {
+			continue
+		}
+		// While a segment is being compressed both copies may exist, the raw one is still authoritative
+		if isCompressedSegment(match) && slices.Contains(matches, strings.TrimSuffix(match, compressedSuffix)) {
+			continue
+		}
+		logFiles = append(logFiles, match)
+		segmentNos[match] = segmentNo
 	}
 	if len(logFiles) == 0 {
-		return "", fmt.Errorf("No segments found with prefix: %s", pathWithPrefix)
+		return nil, fmt.Errorf("%w with prefix: %s", ErrNoSegments, pathWithPrefix)
+	}
+	slices.SortFunc(logFiles, func(a, b string) int {
+		return cmp.Compare(segmentNos[a], segmentNos[b])
+	})
+	return logFiles, nil
+}
+
+// checkRecoveryBudget makes sure the segments scanned on recovery fit in the budget
+// A budget of 0 or less means there is no limit
+func (wal *WriteAheadLog) checkRecoveryBudget(budget int64) error {
+	if budget <= 0 {
+		return nil
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return err
+	}
+	var total int64
+	for _, logFile := range logFiles {
+		fileInfo, err := wal.fs.Stat(logFile)
+		if err != nil {
+			return err
+		}
+		total += fileInfo.Size()
+	}
+	if total > budget {
+		return fmt.Errorf("%w: %d segments hold %d bytes, budget is %d bytes",
+			ErrRecoveryBudgetExceeded, len(logFiles), total, budget)
+	}
+	return nil
+}
+
+// RecoveryEstimate describes how much of a log Open has to scan to recover it
+type RecoveryEstimate struct {
+	// LastSegmentBytes is the on-disk size of the newest segment
+	LastSegmentBytes int64
+	// TotalBytes is the on-disk size of all the segments
+	TotalBytes int64
+	// ScanBytes is how many bytes recovery reads, it scans every segment
+	ScanBytes int64
+}
+
+// EstimateRecovery estimates the cost of recovering the log in dir without opening it
+// so operators can size their timeouts, or Options.MaxRecoveryScanBytes, before Open
+func EstimateRecovery(dir string) (RecoveryEstimate, error) {
+	logFiles, err := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	if err != nil {
+		return RecoveryEstimate{}, err
 	}
-	sort.Strings(logFiles)
-	return logFiles[0], nil
+	var estimate RecoveryEstimate
+	for _, logFile := range logFiles {
+		fileInfo, err := osFS{}.Stat(logFile)
+		if err != nil {
+			return RecoveryEstimate{}, err
+		}
+		estimate.TotalBytes += fileInfo.Size()
+		estimate.LastSegmentBytes = fileInfo.Size()
+	}
+	// Recovery scans every segment for the highest sequence number
+	estimate.ScanBytes = estimate.TotalBytes
+	return estimate, nil
 }
 
+// getLastSeqNo recovers the highest sequence number of the log by scanning the entries of every segment
+// Only an entry cut short at the end of the last segment, the tail of a write torn by a crash, ends the scan early
+// Any other invalid entry is handled by OnCorruption: CorruptError fails the scan, a seq number hidden behind it
+// would otherwise be handed out again, CorruptSkip scans past it and CorruptTruncate ends the log before it
+// The timestamp and nonce are recovered the same way, so they keep increasing across restarts
 func (wal *WriteAheadLog) getLastSeqNo() (uint64, error) {
-	// Get the last entry in the current segment
-	lastEntry, err := wal.getLastEntryInSegment()
+	logFiles, err := wal.listSegments()
 	if err != nil {
 		return 0, err
 	}
-	if lastEntry == nil {
-		return 0, nil // No entries in the segment
+	if err := wal.checkSegmentGaps(logFiles); err != nil {
+		return 0, err
 	}
-	return lastEntry.GetLogSeqNo(), nil
+	var lastSeqNo uint64
+	for i, logFile := range logFiles {
+		sr, err := wal.openSegmentReader(logFile)
+		if err != nil {
+			return 0, err
+		}
+		for {
+			entry, err := sr.next()
+			if errors.Is(err, errCorruptionReached) {
+				sr.Close()
+				return lastSeqNo, nil
+			}
+			if err == io.EOF || (errors.Is(err, io.ErrUnexpectedEOF) && i == len(logFiles)-1) {
+				break
+			}
+			if err != nil {
+				sr.Close()
+				return 0, fmt.Errorf("failed to read segment %s: %w", logFile, err)
+			}
+			lastSeqNo = max(lastSeqNo, entry.SeqNo)
+			wal.lastTimestamp = max(wal.lastTimestamp, entry.TimestampUnixNano)
+			wal.lastNonce = max(wal.lastNonce, entry.Nonce)
+			if entry.IsCheckpoint {
+				wal.lastCheckpointSeqNo = max(wal.lastCheckpointSeqNo, entry.SeqNo)
+			}
+		}
+		sr.Close()
+	}
+	return lastSeqNo, nil
 }
 
-func (wal *WriteAheadLog) getLastEntryInSegment() (*wal_pb.WAL_DATA, error) {
-	var lastEntry *wal_pb.WAL_DATA
-	// Read the last entry from the current segment
-	for {
-		var size uint32
-		if err := binary.Read(wal.file, binary.LittleEndian, &size); err != nil {
-			if err == io.EOF {
-				break
+func UnmarshalAndValidateEntry(data []byte) (*Entry, error) {
+	entry, err := ProtobufCodec{}.Unmarshal(data)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateChecksum(CRC32IEEE, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func verifyChecksum(checksum ChecksumFunc, entry *Entry) bool {
+	low, high := entryChecksums(checksum, entry, entry.SeqNo)
+	return entry.Checksum == low && entry.ChecksumHigh == high
+}
+
+// validateChecksum verifies the checksum of an entry read from disk
+// When it doesn't match, the sequence number byte folded into the checksum is cross-checked:
+// if the payload matches the checksum with another sequence number byte, the stored sequence number
+// was altered and an error wrapping ErrSeqNoMismatch is returned
+func validateChecksum(checksum ChecksumFunc, entry *Entry) error {
+	if verifyChecksum(checksum, entry) {
+		return nil
+	}
+	for seqByte := 0; seqByte < 256; seqByte++ {
+		if entryChecksum(checksum, entry, uint64(seqByte)) == entry.Checksum {
+			return fmt.Errorf("%w: entry with seq no %d was written with seq byte %d",
+				ErrSeqNoMismatch, entry.SeqNo, seqByte)
+		}
+	}
+	return fmt.Errorf("invalid checksum for entry with seq no %d", entry.SeqNo)
+}
+
+// CheckSegmentOverlaps reports every pair of segments holding overlapping sequence number ranges
+// Overlapping segments make reads return the same entry more than once
+func (wal *WriteAheadLog) CheckSegmentOverlaps() ([]Overlap, error) {
+	if err := wal.flushForRead(); err != nil {
+		return nil, err
+	}
+	ranges, err := wal.segmentSeqRanges()
+	if err != nil {
+		return nil, err
+	}
+	overlaps := []Overlap{}
+	for i := 0; i < len(ranges); i++ {
+		for j := i + 1; j < len(ranges); j++ {
+			from := max(ranges[i].first, ranges[j].first)
+			to := min(ranges[i].last, ranges[j].last)
+			if from <= to {
+				overlaps = append(overlaps, Overlap{
+					FirstSegment:  ranges[i].segmentNo,
+					SecondSegment: ranges[j].segmentNo,
+					FromSeqNo:     from,
+					ToSeqNo:       to,
+				})
 			}
-			return nil, err
 		}
-		data := make([]byte, size)
-		_, err := wal.file.Read(data)
+	}
+	return overlaps, nil
+}
+
+// ReadAllResolved reads the entries of all segments keeping a single copy of each sequence number
+// When segments overlap, the copy from the highest segment wins since it was written last
+// The entries are returned ordered by sequence number
+func (wal *WriteAheadLog) ReadAllResolved() ([]*Entry, error) {
+	if err := wal.flushForRead(); err != nil {
+		return nil, err
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	latest := map[uint64]*Entry{}
+	for _, logFile := range logFiles {
+		entries, err := wal.readSegment(logFile)
 		if err != nil {
 			return nil, err
 		}
-		entry, err := UnmarshalAndValidateEntry(data)
-		if err != nil {
-			return lastEntry, err
+		for _, entry := range entries {
+			if latest[entry.SeqNo], err = wal.decodePayload(entry); err != nil {
+				return nil, fmt.Errorf("failed to read segment %s: %w", logFile, err)
+			}
 		}
-		lastEntry = entry
 	}
-	return lastEntry, nil
+	entries := make([]*Entry, 0, len(latest))
+	for _, entry := range latest {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].SeqNo < entries[j].SeqNo
+	})
+	return entries, nil
+}
+
+// segmentSeqRange is the lowest and highest sequence number stored in a segment
+type segmentSeqRange struct {
+	segmentNo int
+	first     uint64
+	last      uint64
 }
 
-func UnmarshalAndValidateEntry(data []byte) (*wal_pb.WAL_DATA, error) {
-	entry := &wal_pb.WAL_DATA{}
-	if err := proto.Unmarshal(data, entry); err != nil {
+// segmentSeqRanges scans every segment and returns its sequence number range
+// Segments without any entry are left out
+func (wal *WriteAheadLog) segmentSeqRanges() ([]segmentSeqRange, error) {
+	logFiles, err := wal.listSegments()
+	if err != nil {
 		return nil, err
 	}
-	if !verifyChecksum(entry) {
-		return nil, fmt.Errorf("invalid checksum for entry with seq no %d", entry.GetLogSeqNo())
+	ranges := []segmentSeqRange{}
+	for _, logFile := range logFiles {
+		segmentNo, err := parseSegmentNo(logFile)
+		if err != nil {
+			return nil, err
+		}
+		entries, err := wal.readSegment(logFile)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) == 0 {
+			continue
+		}
+		seqRange := segmentSeqRange{segmentNo: segmentNo, first: entries[0].SeqNo, last: entries[0].SeqNo}
+		for _, entry := range entries {
+			seqRange.first = min(seqRange.first, entry.SeqNo)
+			seqRange.last = max(seqRange.last, entry.SeqNo)
+		}
+		ranges = append(ranges, seqRange)
 	}
-	return entry, nil
-}
-
-func verifyChecksum(entry *wal_pb.WAL_DATA) bool {
-	return entry.GetChecksum() == crc32.ChecksumIEEE(entry.GetData())
+	return ranges, nil
 }
@@ -0,0 +1,92 @@
+package wal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// SegmentSetReader reads a range of segments of a log, read-only
+// Several of them can read disjoint ranges of the same log in parallel, like workers processing an archive
+type SegmentSetReader struct {
+	wal      *WriteAheadLog // holds the read options, it has no active segment
+	segments []string
+	dirLock  *os.File
+}
+
+// OpenRange opens the segments with IDs from fromSeg to toSeg, both included, of the log in dir for reading
+// Only the read options of opts apply, nothing is written. The log directory is locked shared like by Open
+// A payload written by WriteLarge whose chunks cross the edges of the range is left out
+func OpenRange(dir string, fromSeg, toSeg int, opts *Options) (*SegmentSetReader, error) {
+	if fromSeg > toSeg {
+		return nil, fmt.Errorf("invalid segment range [%d, %d]", fromSeg, toSeg)
+	}
+	config := initConfig(opts)
+	wal := &WriteAheadLog{
+		logDir:            dir,
+		logFileNamePrefix: filepath.Join(dir, segmentPrefix),
+		codec:             config.Codec,
+		checksum:          config.Checksum,
+		verifySeqNo:       config.VerifySeqNo,
+		onSegmentGap:      config.OnSegmentGap,
+		orderingMode:      config.OrderingMode,
+		openFile:          config.openFile,
+		fs:                config.FS,
+		logger:            config.Logger,
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return nil, err
+	}
+	segments := []string{}
+	for _, logFile := range logFiles {
+		segmentNo, err := parseSegmentNo(logFile)
+		if err != nil {
+			return nil, err
+		}
+		if segmentNo >= fromSeg && segmentNo <= toSeg {
+			segments = append(segments, logFile)
+		}
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("%w: no segment in [%d, %d]", ErrSegmentNotFound, fromSeg, toSeg)
+	}
+	if err := wal.checkSegmentGaps(segments); err != nil {
+		return nil, err
+	}
+	dirLock, err := lockLogDir(dir, false)
+	if err != nil {
+		return nil, fmt.Errorf("failed to lock the log directory: %w", err)
+	}
+	return &SegmentSetReader{wal: wal, segments: segments, dirLock: dirLock}, nil
+}
+
+// ForEach calls fn for every entry of the segments in order, it stops at the first error returned by fn
+func (r *SegmentSetReader) ForEach(fn func(*Entry) error) error {
+	it := &logIterator{wal: r.wal, segments: r.segments}
+	return it.forEach(func(entry *Entry) error {
+		return fn(entry)
+	})
+}
+
+// ReadAll returns all the entries of the segments
+func (r *SegmentSetReader) ReadAll() ([]*Entry, error) {
+	entries := []*Entry{}
+	it := &logIterator{wal: r.wal, segments: r.segments}
+	err := it.forEach(func(entry *Entry) error {
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if r.wal.orderingMode == OrderingLenient {
+		sortBySeqNo(entries)
+	}
+	return entries, nil
+}
+
+// Close releases the lock on the log directory
+func (r *SegmentSetReader) Close() error {
+	return unlockLogDir(r.dirLock)
+}
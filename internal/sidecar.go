@@ -0,0 +1,119 @@
+package wal
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the file at path with data
+// The data is written and fsynced into a temporary file which is renamed over path,
+// so a crash leaves either the old or the new content, never a partial one
+func writeFileAtomic(fsys FileSystem, path string, data []byte) error {
+	tmpPath := path + ".tmp"
+	file, err := fsys.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if err := fsys.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	return syncDir(fsys, filepath.Dir(path))
+}
+
+// syncDir fsyncs a directory so the renames and file creations inside it are durable
+// Only the file system of the OS has directories to fsync
+func syncDir(fsys FileSystem, dirPath string) error {
+	if _, ok := fsys.(osFS); !ok {
+		return nil
+	}
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+// readUint64File reads a value written by writeUint64File, a missing file reads as 0
+func readUint64File(fsys FileSystem, path string) (uint64, error) {
+	data, err := fsys.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if len(data) != 8 {
+		return 0, fmt.Errorf("invalid content in %s: %d bytes", path, len(data))
+	}
+	return binary.LittleEndian.Uint64(data), nil
+}
+
+// writeUint64File atomically stores a value as 8 little-endian bytes
+func writeUint64File(fsys FileSystem, path string, value uint64) error {
+	data := make([]byte, 8)
+	binary.LittleEndian.PutUint64(data, value)
+	return writeFileAtomic(fsys, path, data)
+}
+
+// ResumeFromCursor calls handler for every entry after the position stored in the CURSOR file
+// The cursor is advanced and persisted after each entry the handler applied successfully,
+// so after a restart it continues right after the last applied entry
+// It stops at the first handler error, that entry will be handed again on the next call
+func (wal *WriteAheadLog) ResumeFromCursor(handler func(*Entry) error) error {
+	err := wal.flushForRead()
+	if err != nil {
+		return err
+	}
+
+	cursorPath := filepath.Join(wal.logDir, cursorFileName)
+	cursor, err := readUint64File(wal.fs, cursorPath)
+	if err != nil {
+		return fmt.Errorf("failed to read cursor: %w", err)
+	}
+	return wal.forEach(func(entry *Entry) error {
+		if entry.SeqNo <= cursor {
+			return nil
+		}
+		if err := handler(entry); err != nil {
+			return err
+		}
+		cursor = entry.SeqNo
+		if err := writeUint64File(wal.fs, cursorPath, cursor); err != nil {
+			return fmt.Errorf("failed to persist cursor: %w", err)
+		}
+		return nil
+	})
+}
+
+// SetWatermark durably stores an application watermark, like the seq number of the last applied entry,
+// in the WATERMARK file next to the segments. It is replaced atomically, a crash leaves the old or the new value
+func (wal *WriteAheadLog) SetWatermark(seq uint64) error {
+	if err := writeUint64File(wal.fs, filepath.Join(wal.logDir, watermarkFileName), seq); err != nil {
+		return fmt.Errorf("failed to persist watermark: %w", err)
+	}
+	return nil
+}
+
+// Watermark returns the application watermark stored by SetWatermark, 0 if it was never set
+func (wal *WriteAheadLog) Watermark() (uint64, error) {
+	seq, err := readUint64File(wal.fs, filepath.Join(wal.logDir, watermarkFileName))
+	if err != nil {
+		return 0, fmt.Errorf("failed to read watermark: %w", err)
+	}
+	return seq, nil
+}
@@ -0,0 +1,44 @@
+package wal
+
+// WALStats is a snapshot of the size of the log, see Stats
+type WALStats struct {
+	Entries        uint64 // number of entries, the ones ReadAll returns
+	Bytes          int64  // on-disk size of the segment files
+	Segments       int    // number of segment files
+	CurrentSegment int    // number of the active segment
+	LastSeqNo      uint64 // sequence number of the last entry written
+}
+
+// Stats returns the entry count, size and segments of the log, taken together under the lock
+// The size sums the segment files as stored, compressed sealed segments included, in LogDir and the DirRotation directories
+func (wal *WriteAheadLog) Stats() (WALStats, error) {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	entries, err := wal.countLocked()
+	if err != nil {
+		return WALStats{}, err
+	}
+	// The size covers the buffered entries too
+	if err := wal.bufWriter.Flush(); err != nil {
+		return WALStats{}, err
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return WALStats{}, err
+	}
+	stats := WALStats{
+		Entries:        entries,
+		Segments:       len(logFiles),
+		CurrentSegment: wal.currentSegmentNo,
+		LastSeqNo:      wal.lastSeqNo,
+	}
+	for _, logFile := range logFiles {
+		fileInfo, err := wal.fs.Stat(logFile)
+		if err != nil {
+			return WALStats{}, err
+		}
+		stats.Bytes += fileInfo.Size()
+	}
+	return stats, nil
+}
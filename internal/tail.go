@@ -0,0 +1,138 @@
+package wal
+
+import (
+	"context"
+	"io"
+)
+
+// writeSignal is closed after a write, waking up everyone waiting for it
+// A fresh signal replaces it for the following write
+type writeSignal struct {
+	done  chan struct{}
+	seqNo uint64 // seq no of the write, set before done is closed
+}
+
+func newWriteSignal() *writeSignal {
+	return &writeSignal{done: make(chan struct{})}
+}
+
+// notifyWrite wakes up the goroutines waiting for the next write
+// The caller must hold the lock
+func (wal *WriteAheadLog) notifyWrite(seqNo uint64) {
+	wal.writeSignal.seqNo = seqNo
+	close(wal.writeSignal.done)
+	wal.writeSignal = newWriteSignal()
+}
+
+// WaitForWrite blocks until the next successful write and returns its seq number
+// It returns the context error if ctx is done first, and ErrClosed if the WAL is closed
+func (wal *WriteAheadLog) WaitForWrite(ctx context.Context) (uint64, error) {
+	wal.locker.Lock()
+	signal := wal.writeSignal
+	wal.locker.Unlock()
+
+	select {
+	case <-signal.done:
+		return signal.seqNo, nil
+	case <-wal.closed:
+		return 0, ErrClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// Tail calls fn for every entry after the afterSeqNo sequence number, then for every new entry as it is written,
+// until ctx is done or fn returns an error, which Tail returns
+// When the WAL is closed, the entries written before Close are handed to fn and Tail returns ErrClosed
+// Entries are served from the recent entries cache while it holds them, so tailing continues seamlessly
+// across rotations, and from the segment files when the tail falls behind the cache
+// Entries are handed as stored, the chunks of a WriteLarge payload are not reassembled
+func (wal *WriteAheadLog) Tail(ctx context.Context, afterSeqNo uint64, fn func(*Entry) error) error {
+	closed := false
+	for {
+		wal.locker.Lock()
+		signal := wal.writeSignal
+		lastSeqNo := wal.lastSeqNo
+		var entries []*Entry
+		cached := false
+		if lastSeqNo > afterSeqNo && wal.recentCache != nil {
+			entries, cached = wal.recentCache.since(afterSeqNo)
+		}
+		var err error
+		if lastSeqNo > afterSeqNo && !cached {
+			err = wal.bufWriter.Flush()
+		}
+		wal.locker.Unlock()
+		if err != nil {
+			return err
+		}
+
+		if lastSeqNo > afterSeqNo && !cached {
+			if entries, err = wal.readAfter(afterSeqNo, lastSeqNo); err != nil {
+				return err
+			}
+		}
+		for _, entry := range entries {
+			if err := fn(entry); err != nil {
+				return err
+			}
+			afterSeqNo = entry.SeqNo
+		}
+		if len(entries) > 0 {
+			continue
+		}
+		if closed {
+			return ErrClosed
+		}
+
+		select {
+		case <-signal.done:
+		case <-wal.closed:
+			// Go around once more for the entries written right before Close
+			closed = true
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the entries Tail would hand over from afterSeqNo
+// The channel is closed when ctx is done, when reading the log fails, or when the WAL is closed
+// after the entries written before Close were received, so ranging over it ends cleanly
+func (wal *WriteAheadLog) Subscribe(ctx context.Context, afterSeqNo uint64) <-chan *Entry {
+	entries := make(chan *Entry)
+	go func() {
+		defer close(entries)
+		wal.Tail(ctx, afterSeqNo, func(entry *Entry) error {
+			select {
+			case entries <- entry:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return entries
+}
+
+// readAfter reads the entries of the segment files with a seq number in (afterSeqNo, upToSeqNo]
+func (wal *WriteAheadLog) readAfter(afterSeqNo, upToSeqNo uint64) ([]*Entry, error) {
+	it, err := wal.newLogIterator()
+	if err != nil {
+		return nil, err
+	}
+	defer it.Close()
+	entries := []*Entry{}
+	for {
+		entry, err := it.next()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if entry.SeqNo > afterSeqNo && entry.SeqNo <= upToSeqNo {
+			entries = append(entries, entry)
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package wal
+
+import (
+	"fmt"
+)
+
+// TruncateAfter rolls the log back to the seqNo sequence number, the entries after it are removed
+// and the next write continues at seqNo+1. The segments only holding later entries are deleted
+// and the segment holding seqNo is rewritten without the entries after it
+// An entry written by WriteLarge or WriteTxn that seqNo falls within is dropped by the readers
+// If it fails once the active segment is closed, the WAL is left closed: writes fail and Close releases it
+func (wal *WriteAheadLog) TruncateAfter(seqNo uint64) error {
+	// Let the background compression finish, it must not swap in a segment that is being deleted
+	wal.background.Wait()
+
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return fmt.Errorf("WAL is closed, cannot truncate data")
+	}
+	if seqNo >= wal.lastSeqNo {
+		return nil
+	}
+	if err := wal.syncLocked(); err != nil {
+		return err
+	}
+	logFiles, err := wal.listSegments()
+	if err != nil {
+		return err
+	}
+	// The segment holding seqNo is the last one starting at or before it
+	keep := 0
+	for i := len(logFiles) - 1; i > 0; i-- {
+		firstSeqNo, ok, err := wal.segmentFirstSeqNo(logFiles[i])
+		if err != nil {
+			return err
+		}
+		if ok && firstSeqNo <= seqNo {
+			keep = i
+			break
+		}
+	}
+
+	// The active segment is reopened once the log is truncated, it may be deleted or rewritten
+	if err := wal.file.Close(); err != nil {
+		return err
+	}
+	wal.file = nil
+	for _, logFile := range logFiles[keep+1:] {
+		if err := wal.fs.Remove(logFile); err != nil {
+			return fmt.Errorf("failed to truncate segment %s: %w", logFile, err)
+		}
+	}
+	err = wal.rewriteSegment(logFiles[keep], func(entries []*Entry) []*Entry {
+		kept := []*Entry{}
+		for _, entry := range entries {
+			if entry.SeqNo <= seqNo {
+				kept = append(kept, entry)
+			}
+		}
+		return kept
+	})
+	if err != nil {
+		return fmt.Errorf("failed to truncate segment %s: %w", logFiles[keep], err)
+	}
+	if err := syncDir(wal.fs, wal.logDir); err != nil {
+		return err
+	}
+	if len(wal.segmentDirs) > 0 {
+		if err := wal.selectSegmentDir(); err != nil {
+			return err
+		}
+	}
+	// A sealed segment isn't appended to, the next segment is created after it
+	if err := wal.openExistingSegment(); err != nil {
+		return err
+	}
+
+	wal.lastSeqNo = seqNo
+	if wal.oldestSeqNo > seqNo {
+		wal.oldestSeqNo = 0
+	}
+	if wal.lastCheckpointSeqNo > seqNo {
+		if err := wal.findLastCheckpoint(); err != nil {
+			return err
+		}
+	}
+	wal.forgetCount()
+	if wal.recentCache != nil {
+		wal.recentCache = newRecentCache(len(wal.recentCache.entries))
+	}
+	wal.sinceCheckpointKnown = false
+	return nil
+}
+
+// findLastCheckpoint scans the log for the most recent checkpoint
+// The caller must hold the lock
+func (wal *WriteAheadLog) findLastCheckpoint() error {
+	wal.lastCheckpointSeqNo = 0
+	return wal.forEach(func(entry *Entry) error {
+		if entry.IsCheckpoint {
+			wal.lastCheckpointSeqNo = entry.SeqNo
+		}
+		return nil
+	})
+}
@@ -0,0 +1,70 @@
+package wal
+
+import (
+	"fmt"
+)
+
+// WriteTxn writes the records as a transaction, on replay either all of them are read or none
+// Every record carries the transaction ID, the seq number of its first record, and the last one the commit flag.
+// The records of a transaction cut short, like by a crash, are dropped by the readers
+// It returns the transaction ID
+func (wal *WriteAheadLog) WriteTxn(records [][]byte) (uint64, error) {
+	if len(records) == 0 {
+		return 0, fmt.Errorf("empty transaction")
+	}
+	if wal.validate != nil {
+		for i, data := range records {
+			if err := wal.validate(data); err != nil {
+				return 0, fmt.Errorf("record %d: %w", i, err)
+			}
+		}
+	}
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return 0, fmt.Errorf("WAL is closed, cannot write data")
+	}
+	txnId := wal.lastSeqNo + 1
+	for i, data := range records {
+		entry := &Entry{Data: data, TxnId: txnId}
+		if i == len(records)-1 {
+			entry.TxnCommit = true
+		}
+		if err := wal.appendEntry(entry); err != nil {
+			// The records written so far won't be read back
+			wal.forgetCount()
+			return 0, fmt.Errorf("failed to write record %d of transaction %d: %w", i, txnId, err)
+		}
+	}
+	return txnId, nil
+}
+
+// txnAssembler holds back the records of a transaction until its commit
+// A transaction interrupted by another entry or by the end of the log was never committed and is dropped
+type txnAssembler struct {
+	id      uint64   // transaction being read
+	pending []*Entry // its records read so far
+}
+
+// add takes the next entry of the log and calls fn for the entries that can be handed to the reader
+func (ta *txnAssembler) add(entry *Entry, fn func(*Entry) error) error {
+	if entry.TxnId != ta.id {
+		ta.id, ta.pending = entry.TxnId, nil
+	}
+	if ta.id == 0 {
+		return fn(entry)
+	}
+	ta.pending = append(ta.pending, entry)
+	if !entry.TxnCommit {
+		return nil
+	}
+	pending := ta.pending
+	ta.id, ta.pending = 0, nil
+	for _, entry := range pending {
+		if err := fn(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
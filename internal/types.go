@@ -1,24 +1,114 @@
 package wal
 
 import (
-	"bufio"
 	"context"
+	"crypto/cipher"
+	"io"
 	"os"
 	"sync"
 	"time"
 )
 
 type WriteAheadLog struct {
-	logFileNamePrefix string
-	file              *os.File           // current segment file
-	bufWriter         *bufio.Writer      // buffered writer for the file
-	currentSegmentNo  int                // current segment number
-	lastSeqNo         uint64             // last sequence number written to the log
-	locker            sync.Mutex         // Mutex to protect concurrent writes
-	syncInterval      time.Duration      // Interval for periodic sync
-	syncDelay         *time.Ticker       // Timer for periodic sync
-	maxLogFileSize    int32              // maximum log file size
-	maxSegments       int                // maximum segment size
-	ctx               context.Context    // context for cancellation
-	cancel            context.CancelFunc // function to cancel the context
+	logDir                 string // directory holding the segments
+	logFileNamePrefix      string
+	file                   File                                                        // current segment file
+	bufWriter              entryWriter                                                 // buffered writer for the file
+	currentSegmentNo       int                                                         // current segment number
+	lastSeqNo              uint64                                                      // last sequence number written to the log
+	locker                 sync.Locker                                                 // Mutex to protect concurrent writes, no-op with SingleWriter
+	verifySeqNo            bool                                                        // check that the read sequence numbers are contiguous
+	singleWriter           bool                                                        // the caller guarantees there is a single goroutine
+	syncInterval           time.Duration                                               // Interval for periodic sync
+	syncDelay              *time.Ticker                                                // Timer for periodic sync, nil when it is off
+	syncTimeout            time.Duration                                               // how long Sync waits for the fsync, 0 for no limit
+	maxLogFileSize         int32                                                       // maximum log file size
+	maxEntrySize           int                                                         // largest payload of a single entry written by WriteLarge
+	maxSegments            int                                                         // maximum segment size
+	onMissingSegments      MissingSegmentsPolicy                                       // what to do when all segment files are gone
+	clock                  func() time.Time                                            // wall clock used to stamp entries
+	monotonicTimestamps    bool                                                        // derive timestamps from the monotonic clock
+	clockBase              time.Time                                                   // wall time captured at Open
+	monotonicBase          time.Time                                                   // time.Now() at Open, carries the monotonic reading
+	lastTimestamp          int64                                                       // timestamp of the last entry written
+	compressSealedSegments bool                                                        // compress segments once they are rotated out
+	segmentRewrites        uint64                                                      // segments rewritten so far, a compression started before a rewrite is dropped
+	background             sync.WaitGroup                                              // background work on sealed segments
+	sinceCheckpoint        uint64                                                      // entries written after the last checkpoint
+	sinceCheckpointKnown   bool                                                        // sinceCheckpoint was counted from the existing entries
+	openFile               func(name string, flag int, perm os.FileMode) (File, error) // opens segment files
+	fs                     FileSystem                                                  // holds the segments, see Options.FS
+	recentCache            *recentCache                                                // last entries written, nil when disabled
+	segmentCountWarnAt     int                                                         // segment count that triggers a warning
+	onSegmentCountWarning  func(int)                                                   // receives the segment count warning
+	errorHandler           func(error)                                                 // receives the errors of the periodic sync
+	segmentCountWarned     bool                                                        // the segment count warning already fired
+	writeSignal            *writeSignal                                                // closed on the next write, see WaitForWrite
+	entryNonces            bool                                                        // stamp entries with an increasing nonce
+	lastNonce              uint64                                                      // nonce of the last entry written
+	dirLock                *os.File                                                    // shared lock on the log directory, see lockLogDir
+	codec                  EntryCodec                                                  // serializes the entries, see Options.Codec
+	checksum               ChecksumFunc                                                // computes the entry checksums, see Options.Checksum
+	replicaSink            io.Writer                                                   // receives the framed entries, see Options.ReplicaSink
+	failOnReplicaError     bool                                                        // fail the write when the replica sink fails
+	openRetries            int                                                         // retries when opening the last segment fails
+	openRetryBackoff       time.Duration                                               // wait before the first retry
+	closed                 chan struct{}                                               // closed by Close once everything is flushed
+	closeOnce              sync.Once                                                   // closes closed once
+	isClosed               bool                                                        // set by Close, the next calls of Close and Sync do nothing
+	onSegmentGap           SegmentGapPolicy                                            // what to do when segments are missing in the middle
+	orderingMode           OrderingMode                                                // how reads handle entries out of seq number order
+	segmentMetaEntries     bool                                                        // describe every segment in its first entry
+	segmentMetaPending     bool                                                        // the active segment still needs its description
+	fsync                  func(file File) error                                       // fsyncs the segment files, see Options.fsync
+	retentionAge           time.Duration                                               // age of the newest entry past which a segment is deleted, 0 to keep them
+	maxTotalSize           int64                                                       // bytes the segments may take on disk, 0 for no limit
+	logger                 Logger                                                      // receives the diagnostics
+	flushOnly              bool                                                        // fsync is unsupported, the entries are only flushed to the OS
+	verifyRawChecksums     bool                                                        // verify the checksum of the entries written with WriteRaw
+	maxTotalEntries        int                                                         // trim the oldest entries beyond this count, 0 means no limit
+	oldestSeqNo            uint64                                                      // seq number of the oldest entry kept by the eviction, 0 when unknown
+	lastCheckpointSeqNo    uint64                                                      // seq number of the most recent checkpoint, 0 if there is none
+	validate               func([]byte) error                                          // checks the payload of every write before it is persisted
+	segmentDirs            []string                                                    // LogDir followed by Options.DirRotation, nil without directory rotation
+	segmentDir             int                                                         // index in segmentDirs of the directory new segments are written to
+	dirRotationBytes       int64                                                       // size of segments a directory may hold before rotating into the next one
+	beforeWrite            func(*Entry) error                                          // called with every entry before it is serialized
+	afterWrite             func(*Entry)                                                // called with every entry once it is written into the buffer
+	compressEntries        bool                                                        // compress the payload of every entry
+	compression            Compression                                                 // algorithm compressing the payloads, DEFLATE for compressEntries when none
+	cipher                 cipher.AEAD                                                 // encrypts the payloads, nil to store them in clear
+	doubleBuffer           bool                                                        // write full buffers to the segment file in the background
+	framing                FramingMode                                                 // framing of the new segments
+	activeFraming          FramingMode                                                 // framing of the active segment, it keeps the one it was created with
+	entryCount             uint64                                                      // number of entries of the log, valid when countKnown
+	countKnown             bool                                                        // entryCount was counted or loaded and is kept up to date since
+	persistCount           bool                                                        // keep the entry count in the COUNT file
+	onCorruption           CorruptionPolicy                                            // what to do with a corrupted entry
+	checksumType           ChecksumType                                                // built-in checksum algorithm of the new entries, or checksum
+	groupCommitWindow      time.Duration                                               // WriteSync calls within it share a sync
+	commitGroup            *commitGroup                                                // WriteSync calls waiting for the next group sync, nil when none
+	ctx                    context.Context                                             // context for cancellation
+	cancel                 context.CancelFunc                                          // function to cancel the context
 }
+
+// Overlap describes two segments holding the same range of sequence numbers
+type Overlap struct {
+	FirstSegment  int    // lower segment number
+	SecondSegment int    // higher segment number
+	FromSeqNo     uint64 // first sequence number held by both segments
+	ToSeqNo       uint64 // last sequence number held by both segments
+}
+
+// GlobalOffset is a position in the log, a byte offset in the uncompressed content of a segment
+// The zero value is the start of the log
+type GlobalOffset struct {
+	Segment int   // segment number
+	Offset  int64 // byte offset in the segment
+}
+
+// noopLocker stands in for the mutex when the WAL is used by a single goroutine
+type noopLocker struct{}
+
+func (noopLocker) Lock()   {}
+func (noopLocker) Unlock() {}
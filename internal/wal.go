@@ -1,196 +1,985 @@
 package wal
 
 import (
+	"cmp"
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"hash/crc32"
+	"hash"
 	"io"
-	"log"
-	"os"
+	"math"
+	"path/filepath"
+	"slices"
+	"sync"
+	"syscall"
 	"time"
-
-	wal_pb "wal/proto"
-
-	pb "google.golang.org/protobuf/proto"
 )
 
-func initConfig(userConfig *Options) *Options {
+func initConfig(opts ...Option) *Options {
 	config := DefaultConfig()
-
-	// Override default values with user-provided values
-	if userConfig != nil {
-		if userConfig.LogDir != "" {
-			config.LogDir = userConfig.LogDir
-		}
-		if userConfig.MaxLogFileSize != 0 {
-			config.MaxLogFileSize = userConfig.MaxLogFileSize
-		}
-		if userConfig.maxSegments != 0 {
-			config.maxSegments = userConfig.maxSegments
-		}
-		if userConfig.SyncInterval != 0 {
-			config.SyncInterval = userConfig.SyncInterval
-		}
-		if userConfig.EnableSync != config.EnableSync {
-			config.EnableSync = userConfig.EnableSync
+	for _, opt := range opts {
+		if opt != nil {
+			opt.apply(config)
 		}
 	}
+	if config.openFile == nil {
+		config.openFile = config.FS.OpenFile
+	}
 	return config
 }
 
+// apply overrides the values of config with the ones set in userConfig, the fields left to their zero value are skipped
+func (userConfig *Options) apply(config *Options) {
+	if userConfig == nil {
+		return
+	}
+	// Earlier options are kept, only the fields set here are merged into config
+
+	if userConfig.LogDir != "" {
+		config.LogDir = userConfig.LogDir
+	}
+	if userConfig.MaxLogFileSize != 0 {
+		config.MaxLogFileSize = userConfig.MaxLogFileSize
+	}
+	if userConfig.maxSegments != 0 {
+		config.maxSegments = userConfig.maxSegments
+	}
+	if userConfig.SyncInterval != 0 {
+		config.SyncInterval = userConfig.SyncInterval
+	}
+	if userConfig.SyncTimeout > 0 {
+		config.SyncTimeout = userConfig.SyncTimeout
+	}
+	if userConfig.EnableSync {
+		config.EnableSync = userConfig.EnableSync
+	}
+	if userConfig.OnMissingSegments != MissingSegmentsError {
+		config.OnMissingSegments = userConfig.OnMissingSegments
+	}
+	if userConfig.OnSegmentGap != SegmentGapError {
+		config.OnSegmentGap = userConfig.OnSegmentGap
+	}
+	if userConfig.OnCorruption != CorruptError {
+		config.OnCorruption = userConfig.OnCorruption
+	}
+	if userConfig.OrderingMode != OrderingAsStored {
+		config.OrderingMode = userConfig.OrderingMode
+	}
+	if userConfig.SegmentMetaEntries {
+		config.SegmentMetaEntries = userConfig.SegmentMetaEntries
+	}
+	if userConfig.Clock != nil {
+		config.Clock = userConfig.Clock
+	}
+	if userConfig.Codec != nil {
+		config.Codec = userConfig.Codec
+	}
+	if userConfig.Checksum != nil {
+		config.Checksum = userConfig.Checksum
+		// The entries record that they use the custom checksum, unless a ChecksumType is set along with it
+		config.ChecksumType = ChecksumConfigured
+	}
+	if userConfig.ChecksumType != ChecksumConfigured {
+		config.ChecksumType = userConfig.ChecksumType
+	}
+	if userConfig.ReplicaSink != nil {
+		config.ReplicaSink = userConfig.ReplicaSink
+	}
+	if userConfig.FailOnReplicaError {
+		config.FailOnReplicaError = userConfig.FailOnReplicaError
+	}
+	if userConfig.OpenRetries > 0 {
+		config.OpenRetries = userConfig.OpenRetries
+	}
+	if userConfig.OpenRetryBackoff > 0 {
+		config.OpenRetryBackoff = userConfig.OpenRetryBackoff
+	}
+	if userConfig.MonotonicTimestamps {
+		config.MonotonicTimestamps = userConfig.MonotonicTimestamps
+	}
+	if userConfig.MaxRecoveryScanBytes != 0 {
+		config.MaxRecoveryScanBytes = userConfig.MaxRecoveryScanBytes
+	}
+	if userConfig.CompressSealedSegments {
+		config.CompressSealedSegments = userConfig.CompressSealedSegments
+	}
+	if userConfig.RecentCacheSize != 0 {
+		config.RecentCacheSize = userConfig.RecentCacheSize
+	}
+	if userConfig.SegmentCountWarnThreshold != 0 {
+		config.SegmentCountWarnThreshold = userConfig.SegmentCountWarnThreshold
+	}
+	if userConfig.OnSegmentCountWarning != nil {
+		config.OnSegmentCountWarning = userConfig.OnSegmentCountWarning
+	}
+	if userConfig.ErrorHandler != nil {
+		config.ErrorHandler = userConfig.ErrorHandler
+	}
+	if userConfig.SingleWriter {
+		config.SingleWriter = userConfig.SingleWriter
+	}
+	if userConfig.MaxEntrySize != 0 {
+		config.MaxEntrySize = userConfig.MaxEntrySize
+	}
+	if userConfig.VerifySeqNo {
+		config.VerifySeqNo = userConfig.VerifySeqNo
+	}
+	if userConfig.EntryNonces {
+		config.EntryNonces = userConfig.EntryNonces
+	}
+	if userConfig.FS != nil {
+		config.FS = userConfig.FS
+	}
+	if userConfig.openFile != nil {
+		config.openFile = userConfig.openFile
+	}
+	if userConfig.fsync != nil {
+		config.fsync = userConfig.fsync
+	}
+	if userConfig.Logger != nil {
+		config.Logger = userConfig.Logger
+	}
+	if userConfig.RetentionAge != 0 {
+		config.RetentionAge = userConfig.RetentionAge
+	}
+	if userConfig.MaxTotalSize != 0 {
+		config.MaxTotalSize = userConfig.MaxTotalSize
+	}
+	if userConfig.FlushOnlyWithoutFsync {
+		config.FlushOnlyWithoutFsync = userConfig.FlushOnlyWithoutFsync
+	}
+	if userConfig.VerifyRawChecksums {
+		config.VerifyRawChecksums = userConfig.VerifyRawChecksums
+	}
+	if len(userConfig.DirRotation) > 0 {
+		config.DirRotation = userConfig.DirRotation
+	}
+	if userConfig.DirRotationBytes > 0 {
+		config.DirRotationBytes = userConfig.DirRotationBytes
+	}
+	if userConfig.CompressEntries {
+		config.CompressEntries = userConfig.CompressEntries
+	}
+	if userConfig.Compression != CompressionNone {
+		config.Compression = userConfig.Compression
+	}
+	if userConfig.Cipher != nil {
+		config.Cipher = userConfig.Cipher
+	}
+	if userConfig.PersistCount {
+		config.PersistCount = userConfig.PersistCount
+	}
+	if userConfig.Framing != FramingFixed32 {
+		config.Framing = userConfig.Framing
+	}
+	if userConfig.GroupCommitWindow != 0 {
+		config.GroupCommitWindow = userConfig.GroupCommitWindow
+	}
+	if userConfig.DoubleBuffer {
+		config.DoubleBuffer = userConfig.DoubleBuffer
+	}
+	if userConfig.BeforeWrite != nil {
+		config.BeforeWrite = userConfig.BeforeWrite
+	}
+	if userConfig.AfterWrite != nil {
+		config.AfterWrite = userConfig.AfterWrite
+	}
+	if userConfig.Validate != nil {
+		config.Validate = userConfig.Validate
+	}
+	if userConfig.MaxTotalEntries > 0 {
+		config.MaxTotalEntries = userConfig.MaxTotalEntries
+	}
+}
+
 // WALConfig holds the configuration for the Write Ahead Log
 // This method opens the WAL file for writing and returns a pointer to the WriteAheadLog struct
-func Open(config *Options) (*WriteAheadLog, error) {
-	// config is optional, it will get the default if not provided
-	config = initConfig(config)
+// The options are an *Options, functional options like WithLogDir, or both, applied in order
+func Open(opts ...Option) (*WriteAheadLog, error) {
+	// The options are optional, the defaults are used for everything not set
+	config := initConfig(opts...)
+	if err := checkConfig(config); err != nil {
+		return nil, err
+	}
 	fileNamePrefix := config.LogDir + segmentPrefix
+	var segmentDirs []string
+	if len(config.DirRotation) > 0 {
+		segmentDirs = append([]string{config.LogDir}, config.DirRotation...)
+	}
 	ctx, cancel := context.WithCancel(context.Background())
+	var cache *recentCache
+	if config.RecentCacheSize > 0 {
+		cache = newRecentCache(config.RecentCacheSize)
+	}
+	maxEntrySize := config.MaxEntrySize
+	if maxEntrySize <= 0 {
+		maxEntrySize = int(config.MaxLogFileSize) / 2
+	}
+	var locker sync.Locker = &sync.Mutex{}
+	if config.SingleWriter {
+		locker = noopLocker{}
+	}
 	wal := &WriteAheadLog{
-		logFileNamePrefix: fileNamePrefix,
-		lastSeqNo:         0,
-		maxLogFileSize:    config.MaxLogFileSize,
-		maxSegments:       config.maxSegments,
-		currentSegmentNo:  1,
-		syncDelay:         time.NewTicker(config.SyncInterval),
-		syncInterval:      config.SyncInterval,
-		ctx:               ctx,
-		cancel:            cancel,
+		logDir:                 config.LogDir,
+		logFileNamePrefix:      fileNamePrefix,
+		segmentDirs:            segmentDirs,
+		lastSeqNo:              0,
+		locker:                 locker,
+		singleWriter:           config.SingleWriter,
+		verifySeqNo:            config.VerifySeqNo,
+		entryNonces:            config.EntryNonces,
+		maxLogFileSize:         config.MaxLogFileSize,
+		maxEntrySize:           maxEntrySize,
+		maxSegments:            config.maxSegments,
+		currentSegmentNo:       1,
+		syncInterval:           config.SyncInterval,
+		syncTimeout:            config.SyncTimeout,
+		onMissingSegments:      config.OnMissingSegments,
+		onSegmentGap:           config.OnSegmentGap,
+		orderingMode:           config.OrderingMode,
+		segmentMetaEntries:     config.SegmentMetaEntries,
+		clock:                  config.Clock,
+		codec:                  config.Codec,
+		checksum:               config.Checksum,
+		replicaSink:            config.ReplicaSink,
+		failOnReplicaError:     config.FailOnReplicaError,
+		openRetries:            config.OpenRetries,
+		openRetryBackoff:       config.OpenRetryBackoff,
+		monotonicTimestamps:    config.MonotonicTimestamps,
+		clockBase:              config.Clock(),
+		monotonicBase:          time.Now(),
+		compressSealedSegments: config.CompressSealedSegments,
+		openFile:               config.openFile,
+		fs:                     config.FS,
+		fsync:                  config.fsync,
+		logger:                 config.Logger,
+		retentionAge:           config.RetentionAge,
+		maxTotalSize:           config.MaxTotalSize,
+		verifyRawChecksums:     config.VerifyRawChecksums,
+		maxTotalEntries:        config.MaxTotalEntries,
+		validate:               config.Validate,
+		beforeWrite:            config.BeforeWrite,
+		compressEntries:        config.CompressEntries,
+		compression:            config.Compression,
+		cipher:                 config.Cipher,
+		doubleBuffer:           config.DoubleBuffer,
+		groupCommitWindow:      config.GroupCommitWindow,
+		framing:                config.Framing,
+		checksumType:           config.ChecksumType,
+		onCorruption:           config.OnCorruption,
+		persistCount:           config.PersistCount,
+		afterWrite:             config.AfterWrite,
+		dirRotationBytes:       config.DirRotationBytes,
+		recentCache:            cache,
+		writeSignal:            newWriteSignal(),
+		closed:                 make(chan struct{}),
+		segmentCountWarnAt:     config.SegmentCountWarnThreshold,
+		onSegmentCountWarning:  config.OnSegmentCountWarning,
+		errorHandler:           config.ErrorHandler,
+		ctx:                    ctx,
+		cancel:                 cancel,
 	}
 
+	// Complete a ReplaceAll interrupted by a crash
+	if _, err := wal.fs.Stat(filepath.Join(config.LogDir, replaceReadyDirName)); err == nil {
+		if err := wal.clearRotatedDirs(); err != nil {
+			return nil, fmt.Errorf("failed to complete the replacement of the log: %w", err)
+		}
+	}
+	if err := finishReplace(wal.fs, config.LogDir); err != nil {
+		return nil, fmt.Errorf("failed to complete the replacement of the log: %w", err)
+	}
+	if len(wal.segmentDirs) > 0 {
+		if err := wal.selectSegmentDir(); err != nil {
+			return nil, err
+		}
+	}
+	if config.OnCorruption == CorruptTruncate {
+		if err := wal.truncateAtCorruption(); err != nil {
+			return nil, fmt.Errorf("failed to truncate the log at its corrupted entry: %w", err)
+		}
+	}
 	err := wal.openExistingOrCreateSegment(config.LogDir)
 	if err != nil {
 		return nil, err
 	}
+	// From here a failed Open releases the active segment and the lock, so the log can be opened again
+	fail := func(err error) (*WriteAheadLog, error) {
+		wal.cancel()
+		wal.file.Close()
+		unlockLogDir(wal.dirLock)
+		return nil, err
+	}
+	if wal.onDisk() {
+		if wal.dirLock, err = lockLogDir(config.LogDir, false); err != nil {
+			return fail(fmt.Errorf("failed to lock the log directory: %w", err))
+		}
+	}
+	if config.FlushOnlyWithoutFsync {
+		wal.probeFsync()
+	}
+	if err := wal.checkRecoveryBudget(config.MaxRecoveryScanBytes); err != nil {
+		return fail(err)
+	}
 	if wal.lastSeqNo, err = wal.getLastSeqNo(); err != nil {
-		return nil, fmt.Errorf("failed to get last sequence number: %w", err)
+		return fail(fmt.Errorf("failed to get last sequence number: %w", err))
+	}
+	if config.PersistCount {
+		if err := wal.loadEntryCount(); err != nil {
+			return fail(fmt.Errorf("failed to load the entry count: %w", err))
+		}
+	}
+	// Without the periodic sync there is no ticker, the entries are only synced by Sync, rotation and Close
+	if config.EnableSync && config.SyncInterval > 0 {
+		wal.syncDelay = time.NewTicker(config.SyncInterval)
+		if !wal.singleWriter {
+			go wal.keepSyncing()
+		}
 	}
-	go wal.keepSyncing()
 
 	return wal, nil
 }
 
 func (wal *WriteAheadLog) Write(data []byte) error {
-	return wal.writeEntry(data, false)
+	return wal.writeEntry(&Entry{Data: data})
+}
+
+// WriteBatch writes the records as consecutive entries under a single lock acquisition and returns their seq numbers
+// The records are validated before any is written. A segment rotates between records, never within one
+// If a write fails, the seq numbers of the records written before it are returned with the error
+func (wal *WriteAheadLog) WriteBatch(records [][]byte) ([]uint64, error) {
+	if wal.validate != nil {
+		for i, data := range records {
+			if err := wal.validate(data); err != nil {
+				return nil, fmt.Errorf("record %d: %w", i, err)
+			}
+		}
+	}
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return nil, fmt.Errorf("WAL is closed, cannot write data")
+	}
+	seqNos := make([]uint64, 0, len(records))
+	for i, data := range records {
+		entry := &Entry{Data: data}
+		if err := wal.appendEntry(entry); err != nil {
+			return seqNos, fmt.Errorf("failed to write record %d: %w", i, err)
+		}
+		seqNos = append(seqNos, entry.SeqNo)
+	}
+	return seqNos, nil
+}
+
+// WriteReader reads exactly size bytes from r and writes them as a single entry
+// It fails without writing anything if r has fewer than size bytes
+func (wal *WriteAheadLog) WriteReader(r io.Reader, size int) error {
+	if size < 0 {
+		return fmt.Errorf("invalid payload size %d", size)
+	}
+	data := make([]byte, size)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return fmt.Errorf("failed to read %d bytes of payload: %w", size, err)
+	}
+	return wal.writeEntry(&Entry{Data: data})
+}
+
+// WriteVersioned writes an entry stamped with the schema version of the application payload
+// The version is returned by GetUserVersion on read, so replay can migrate older payloads
+func (wal *WriteAheadLog) WriteVersioned(version uint32, data []byte) error {
+	return wal.writeEntry(&Entry{Data: data, UserVersion: version})
 }
 
 func (wal *WriteAheadLog) WriteWithCheckpoint(data []byte) error {
-	return wal.writeEntry(data, true)
+	return wal.writeEntry(&Entry{Data: data, IsCheckpoint: true})
+}
+
+// Checkpoint writes a checkpoint marker without payload and syncs it, it returns its sequence number
+// ReadFromCheckPoint resumes from it like from a checkpoint written with WriteWithCheckpoint
+func (wal *WriteAheadLog) Checkpoint() (uint64, error) {
+	return wal.writeCheckpoint(false)
+}
+
+// CheckpointDurable writes a checkpoint marker and returns its sequence number once it is durable,
+// the segment fsynced along with the log directory, so the checkpoint is a safe recovery point
+func (wal *WriteAheadLog) CheckpointDurable() (uint64, error) {
+	return wal.writeCheckpoint(true)
+}
+
+// writeCheckpoint writes and syncs a checkpoint marker, with durable the log directory is synced too
+func (wal *WriteAheadLog) writeCheckpoint(durable bool) (uint64, error) {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return 0, fmt.Errorf("WAL is closed, cannot write data")
+	}
+	entry := &Entry{IsCheckpoint: true}
+	if err := wal.appendEntry(entry); err != nil {
+		return 0, err
+	}
+	if err := wal.syncLocked(); err != nil {
+		return 0, fmt.Errorf("Couldn't sync checkpoint, error in syncing %w", err)
+	}
+	if !durable {
+		return entry.SeqNo, nil
+	}
+	// The segment file may have just been created by a rotation
+	if err := syncDir(wal.fs, wal.logDir); err != nil {
+		return 0, fmt.Errorf("Couldn't make checkpoint durable, error in syncing the log directory %w", err)
+	}
+	return entry.SeqNo, nil
+}
+
+// WriteBarrier writes a barrier entry and fsyncs it together with everything written before
+// Entries between two barriers were made durable together, see ReadBarrierGroups
+// It returns the sequence number of the barrier entry
+func (wal *WriteAheadLog) WriteBarrier() (uint64, error) {
+	entry := &Entry{IsBarrier: true}
+	if err := wal.writeEntry(entry); err != nil {
+		return 0, err
+	}
+	return entry.SeqNo, nil
+}
+
+// WriteRaw writes an entry formed elsewhere as it is, like an entry forwarded by a replicator
+// Its sequence number, timestamp, nonce and checksum are kept, the sequence number must be above the last one
+// of the log. With Options.VerifyRawChecksums the checksum is verified first. With Options.Cipher it must be encrypted
+func (wal *WriteAheadLog) WriteRaw(raw *Entry) error {
+	if raw == nil {
+		return fmt.Errorf("raw entry is nil")
+	}
+	entry := raw.clone()
+	if wal.cipher != nil && len(entry.CipherNonce) == 0 {
+		// Reads reject the entries stored in clear in an encrypted log
+		return fmt.Errorf("raw entry with seq no %d is not encrypted and the log has a cipher", entry.SeqNo)
+	}
+	if wal.verifyRawChecksums {
+		if err := validateChecksum(wal.checksum, entry); err != nil {
+			return fmt.Errorf("invalid raw entry: %w", err)
+		}
+	}
+
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return fmt.Errorf("WAL is closed, cannot write data")
+	}
+	if entry.SeqNo <= wal.lastSeqNo {
+		return fmt.Errorf("raw entry with seq no %d doesn't follow the last seq no %d", entry.SeqNo, wal.lastSeqNo)
+	}
+	if err := wal.prepareSegment(entry, entry.SeqNo); err != nil {
+		return err
+	}
+	wal.lastSeqNo = entry.SeqNo
+	wal.lastTimestamp = max(wal.lastTimestamp, entry.TimestampUnixNano)
+	wal.lastNonce = max(wal.lastNonce, entry.Nonce)
+	return wal.storeEntry(entry)
 }
 
 // Write data to the log file
-// Create WAL_DATA struct and marshal it to bytes
-func (wal *WriteAheadLog) writeEntry(data []byte, isCheckpoint bool) error {
+// The entry comes with its payload and flags, the sequence number, timestamp and checksum are filled here
+func (wal *WriteAheadLog) writeEntry(entry *Entry) error {
+	// Barriers carry no application payload to validate
+	if wal.validate != nil && !entry.IsBarrier {
+		if err := wal.validate(entry.Data); err != nil {
+			return err
+		}
+	}
 	wal.locker.Lock()
 	defer wal.locker.Unlock()
 
 	if wal.file == nil || wal.ctx.Err() != nil {
 		return fmt.Errorf("WAL is closed, cannot write data")
 	}
+	return wal.appendEntry(entry)
+}
 
-	if wal.checkRotateLog(data) {
-		if err := wal.Sync(); err != nil {
-			return fmt.Errorf("Couldn't rotate log, error in syncing %v", err)
+// appendEntry writes the entry into the active segment, rotating it first if needed
+// The caller must hold the lock
+func (wal *WriteAheadLog) appendEntry(entry *Entry) error {
+	if wal.beforeWrite != nil {
+		if err := wal.beforeWrite(entry); err != nil {
+			return err
 		}
-		if err := wal.rotateLog(); err != nil {
+	}
+	if wal.compressEntries || wal.compression != CompressionNone {
+		if err := compressEntry(entry, wal.compression); err != nil {
 			return err
 		}
 	}
+	if err := wal.prepareSegment(entry, wal.lastSeqNo+1); err != nil {
+		return err
+	}
 
 	wal.lastSeqNo++
-	entry := &wal_pb.WAL_DATA{
-		LogSeqNo: wal.lastSeqNo,
-		Data:     data,
-		Checksum: crc32.ChecksumIEEE(append(data, byte(wal.lastSeqNo))),
+	entry.SeqNo = wal.lastSeqNo
+	entry.TimestampUnixNano = wal.nextTimestamp()
+	entry.TimestampChecked = true
+	entry.HeaderChecked = true
+	if wal.entryNonces {
+		entry.Nonce = wal.nextNonce()
+	}
+	if wal.cipher != nil {
+		// The payload is encrypted once its header is complete, it's authenticated along with it
+		if err := encryptEntry(wal.cipher, entry); err != nil {
+			return err
+		}
+	}
+	entry.ChecksumType = uint32(wal.checksumType)
+	stampChecksum(wal.checksum, entry, wal.lastSeqNo)
+	if err := wal.storeEntry(entry); err != nil {
+		return err
+	}
+	if wal.afterWrite != nil {
+		wal.afterWrite(entry)
 	}
+	return nil
+}
+
+// prepareSegment rotates the active segment if the entry doesn't fit in it
+// A new segment is described before its first entry, the one with the seqNo sequence number
+// The caller must hold the lock
+func (wal *WriteAheadLog) prepareSegment(entry *Entry, seqNo uint64) error {
+	if wal.checkRotateLog(entry.Data) {
+		if err := wal.syncLocked(); err != nil {
+			return fmt.Errorf("Couldn't rotate log, error in syncing %v", err)
+		}
+		if err := wal.rotateLog(); err != nil {
+			return err
+		}
+	}
+	if wal.segmentMetaPending {
+		return wal.writeSegmentMeta(seqNo)
+	}
+	return nil
+}
 
-	if isCheckpoint {
-		if err := wal.Sync(); err != nil {
+// storeEntry writes an entry with its sequence number and checksum set into the active segment
+// The caller must hold the lock
+func (wal *WriteAheadLog) storeEntry(entry *Entry) error {
+	if entry.IsCheckpoint {
+		if err := wal.syncLocked(); err != nil {
 			return fmt.Errorf("Couldn't create checkpoint, error in syncing %v", err)
 		}
-		entry.IsCheckpoint = &isCheckpoint
 	}
-	return wal.WriteIntoBuffer(entry)
+	if wal.replicaSink != nil {
+		if err := wal.writeReplica(entry); err != nil {
+			return err
+		}
+	}
+	if err := encodeEntry(wal.bufWriter, wal.codec, wal.activeFraming, entry); err != nil {
+		return err
+	}
+	wal.countEntry(entry)
+	if wal.recentCache != nil {
+		// The cache serves reads, it holds the payload decrypted and decompressed
+		cached, err := wal.decodePayload(entry)
+		if err != nil {
+			return err
+		}
+		wal.recentCache.add(cached)
+	}
+	if entry.IsCheckpoint {
+		wal.sinceCheckpoint = 0
+		wal.lastCheckpointSeqNo = entry.SeqNo
+	} else if entry.ChunkIndex == 0 {
+		// The chunks of a split payload are read back as a single entry
+		wal.sinceCheckpoint++
+	}
+	if entry.IsBarrier {
+		if err := wal.syncLocked(); err != nil {
+			return fmt.Errorf("Couldn't write barrier, error in syncing %v", err)
+		}
+	}
+	if wal.maxTotalEntries > 0 {
+		wal.evictAfterWrite()
+	}
+	wal.notifyWrite(entry.SeqNo)
+	if wal.singleWriter {
+		wal.syncIfDue()
+	}
+	return nil
+}
+
+// entryChecksum is the checksum stored with an entry written with the given sequence number
+// It covers the payload, the low byte of the sequence number and the user version, nonce and transaction when they are set
+// The payload of a compressed entry is covered as stored, compressed, along with its uncompressed length
+// Writers and readers both go through it. Entries flagged HeaderChecked also cover the whole sequence number
+// and the checkpoint flag, CompactCheckpoints stamps the checkpoints it demotes again
+// An entry with a ChecksumType uses that algorithm instead of checksum, for a 64-bit one it's the low 32 bits
+func entryChecksum(checksum ChecksumFunc, entry *Entry, seqNo uint64) uint32 {
+	low, _ := entryChecksums(checksum, entry, seqNo)
+	return low
+}
+
+// writeChecksumInput writes the content covered by the checksum of an entry into hash
+func writeChecksumInput(hash hash.Hash, entry *Entry, seqNo uint64) {
+	hash.Write(entry.Data)
+	hash.Write([]byte{byte(seqNo)})
+	// Entries without a version or a nonce keep the checksum they always had
+	if entry.UserVersion != 0 {
+		hash.Write(binary.LittleEndian.AppendUint32(nil, entry.UserVersion))
+	}
+	if entry.Nonce != 0 {
+		hash.Write(binary.LittleEndian.AppendUint64(nil, entry.Nonce))
+	}
+	if entry.IsCompressed {
+		hash.Write(binary.LittleEndian.AppendUint32(nil, entry.UncompressedLength))
+		// Entries compressed with DEFLATE keep the checksum they always had
+		if entry.Compression != 0 {
+			hash.Write(binary.LittleEndian.AppendUint32(nil, entry.Compression))
+		}
+	}
+	hash.Write(entry.CipherNonce)
+	// Entries written before the checksum covered the timestamp aren't flagged and keep their checksum,
+	// clearing the flag drops the timestamp from the checksum input so it doesn't pass either
+	if entry.TimestampChecked {
+		hash.Write(binary.LittleEndian.AppendUint64(nil, uint64(entry.TimestampUnixNano)))
+	}
+	// Likewise for the records of a transaction, a torn commit must not pass for another record
+	if entry.TxnId != 0 {
+		hash.Write(binary.LittleEndian.AppendUint64(nil, entry.TxnId))
+		if entry.TxnCommit {
+			hash.Write([]byte{1})
+		}
+	}
+	// And for the whole sequence number and the checkpoint flag, older entries only cover the low byte
+	if entry.HeaderChecked {
+		hash.Write(binary.LittleEndian.AppendUint64(nil, seqNo))
+		if entry.IsCheckpoint {
+			hash.Write([]byte{1})
+		} else {
+			hash.Write([]byte{0})
+		}
+	}
+}
+
+// errFound stops a scan of the log once the entry looked for is found
+var errFound = errors.New("entry found")
+
+// OldestUncheckpointedSeq returns the seq number of the first entry after the most recent checkpoint,
+// or of the first entry of the log if there is no checkpoint yet, showing how far behind checkpointing is
+// It returns false if every entry is covered by a checkpoint
+func (wal *WriteAheadLog) OldestUncheckpointedSeq() (uint64, bool, error) {
+	wal.locker.Lock()
+	checkpointSeqNo, lastSeqNo := wal.lastCheckpointSeqNo, wal.lastSeqNo
+	err := wal.bufWriter.Flush()
+	wal.locker.Unlock()
+	if err != nil {
+		return 0, false, err
+	}
+	if lastSeqNo <= checkpointSeqNo {
+		return 0, false, nil
+	}
+
+	var oldest uint64
+	err = wal.forEach(func(entry *Entry) error {
+		if entry.SeqNo <= checkpointSeqNo {
+			return nil
+		}
+		oldest = entry.SeqNo
+		return errFound
+	})
+	if err != nil && !errors.Is(err, errFound) {
+		return 0, false, err
+	}
+	return oldest, oldest != 0, nil
 }
 
-// WriteIntoBuffer writes the WAL_DATA into the buffer writer
-// It marshals the WAL_DATA to bytes, writes the size of the data first, then
-func (wal *WriteAheadLog) WriteIntoBuffer(entry *wal_pb.WAL_DATA) error {
-	bytesWalData, err := pb.Marshal(entry)
+// CheckpointIfNeeded writes a checkpoint marker only once at least minEntries entries were written
+// after the most recent checkpoint, so it can be called often without checkpointing too much
+// It returns whether it wrote a checkpoint and its sequence number
+func (wal *WriteAheadLog) CheckpointIfNeeded(minEntries uint64) (bool, uint64, error) {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	if wal.file == nil || wal.ctx.Err() != nil {
+		return false, 0, fmt.Errorf("WAL is closed, cannot write data")
+	}
+	since, err := wal.entriesSinceCheckpoint()
+	if err != nil {
+		return false, 0, err
+	}
+	if since < minEntries {
+		return false, 0, nil
+	}
+	entry := &Entry{IsCheckpoint: true}
+	if err := wal.appendEntry(entry); err != nil {
+		return false, 0, err
+	}
+	return true, entry.SeqNo, nil
+}
+
+// EntriesSinceCheckpoint returns how many entries were written after the most recent checkpoint
+// If there is no checkpoint yet, all the entries are counted
+func (wal *WriteAheadLog) EntriesSinceCheckpoint() (uint64, error) {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+	return wal.entriesSinceCheckpoint()
+}
+
+// entriesSinceCheckpoint counts the entries written after the most recent checkpoint
+// The caller must hold the lock
+func (wal *WriteAheadLog) entriesSinceCheckpoint() (uint64, error) {
+	if !wal.sinceCheckpointKnown {
+		// Count the existing entries once, writes keep the counter up to date afterwards
+		if err := wal.bufWriter.Flush(); err != nil {
+			return 0, err
+		}
+		entries, err := wal.readAllEntries(true)
+		if err != nil {
+			return 0, err
+		}
+		wal.sinceCheckpoint = uint64(len(entries))
+		if len(entries) > 0 && entries[0].IsCheckpoint {
+			wal.sinceCheckpoint--
+		}
+		wal.sinceCheckpointKnown = true
+	}
+	return wal.sinceCheckpoint, nil
+}
+
+// nextNonce returns the nonce for a new entry, above the nonce of the previous entry
+// It starts from the wall time so nonces keep increasing across restarts
+func (wal *WriteAheadLog) nextNonce() uint64 {
+	wal.lastNonce = max(wal.lastNonce+1, uint64(time.Now().UnixNano()))
+	return wal.lastNonce
+}
+
+// nextTimestamp returns the timestamp for a new entry
+// If the wall clock went backwards it's reported, and with MonotonicTimestamps
+// the timestamp is taken from the monotonic clock and never goes below the previous one
+func (wal *WriteAheadLog) nextTimestamp() int64 {
+	var timestamp int64
+	if wal.monotonicTimestamps {
+		timestamp = wal.clockBase.Add(time.Since(wal.monotonicBase)).UnixNano()
+		if timestamp < wal.lastTimestamp {
+			timestamp = wal.lastTimestamp
+		}
+	} else {
+		timestamp = wal.clock().UnixNano()
+		if timestamp < wal.lastTimestamp {
+			wal.logger.Printf("wall clock moved backwards by %v, entry timestamps are not monotonic",
+				time.Duration(wal.lastTimestamp-timestamp))
+		}
+	}
+	wal.lastTimestamp = timestamp
+	return timestamp
+}
+
+// WriteIntoBuffer writes the entry into the buffer writer
+// It marshals the entry to bytes, writes the size of the data first, then
+func (wal *WriteAheadLog) WriteIntoBuffer(entry *Entry) error {
+	return encodeEntry(wal.bufWriter, wal.codec, wal.activeFraming, entry)
+}
+
+// FramedSize returns the bytes the payload would take in the active segment if it was written next,
+// its size prefix and the entry encoded with its sequence number, timestamp and checksum
+// A rotation adds the footer of the sealed segment and the header of the new one, they aren't counted
+// The checksum covers the timestamp of the write and is counted at its largest, so the entry may take
+// a few bytes less. It returns 0 if the entry can't be encoded
+func (wal *WriteAheadLog) FramedSize(data []byte) int {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+
+	entry := &Entry{
+		Data:              data,
+		SeqNo:             wal.lastSeqNo + 1,
+		TimestampUnixNano: max(wal.clock().UnixNano(), wal.lastTimestamp),
+		TimestampChecked:  true,
+		HeaderChecked:     true,
+	}
+	if wal.entryNonces {
+		entry.Nonce = max(wal.lastNonce+1, uint64(time.Now().UnixNano()))
+	}
+	entry.ChecksumType = uint32(wal.checksumType)
+	entry.Checksum = math.MaxUint32
+	if wal.checksumType == ChecksumCRC64ECMA {
+		entry.ChecksumHigh = math.MaxUint32
+	}
+	body, err := wal.codec.Marshal(entry)
+	if err != nil {
+		return 0
+	}
+	return len(appendFrameSize(nil, wal.activeFraming, uint32(len(body)))) + len(body)
+}
+
+// encodeEntry writes the entry to w in the segment format, its size framed with framing
+// followed by the body encoded with codec
+func encodeEntry(w io.Writer, codec EntryCodec, framing FramingMode, entry *Entry) error {
+	bytesWalData, err := codec.Marshal(entry)
 	if err != nil {
 		return err
 	}
-	// protobuf data length is written as 4 bytes in little-endian format 32 bits = 4 * 8 bits
+	// protobuf data length is written as 4 bytes in little-endian format 32 bits = 4 * 8 bits, or as a varint
 	size := uint32(len(bytesWalData))
+	if size == 0 {
+		// A zero size marks the end of the entries, it can't be the size of an entry
+		return fmt.Errorf("entry encodes to zero bytes")
+	}
 	// Protobuf messages are variable lenght encoding and have no built-in separator
 	// So we write the size of the message first, then the message itself. means next N bytes are the data
-	if err := binary.Write(wal.bufWriter, binary.LittleEndian, size); err != nil {
+	if _, err := w.Write(appendFrameSize(nil, framing, size)); err != nil {
 		return err
 	}
-	if _, err := wal.bufWriter.Write(bytesWalData); err != nil {
+	if _, err := w.Write(bytesWalData); err != nil {
 		return err
 	}
 	return nil
 }
 
-func (wal *WriteAheadLog) ReadAll() ([]*wal_pb.WAL_DATA, error) {
+// ReadAll returns the entries of every segment in order
+// The segments are opened by path under the log directory, so it also reads the log once the WAL is closed
+func (wal *WriteAheadLog) ReadAll() ([]*Entry, error) {
+	if err := wal.flushForRead(); err != nil {
+		return nil, err
+	}
 	entries, error := wal.readAllEntries(false)
 	return entries, error
 }
 
-func (wal *WriteAheadLog) ReadFromCheckPoint() ([]*wal_pb.WAL_DATA, error) {
+// ReadBarrierGroups returns the entries grouped by the barriers written with WriteBarrier
+// Each group holds the entries written between two barriers, the barrier entries are left out
+// Entries after the last barrier haven't been committed by a barrier yet and are not returned
+func (wal *WriteAheadLog) ReadBarrierGroups() ([][]*Entry, error) {
+	if err := wal.flushForRead(); err != nil {
+		return nil, err
+	}
+	entries, err := wal.readAllEntries(false)
+	if err != nil {
+		return nil, err
+	}
+	groups := [][]*Entry{}
+	group := []*Entry{}
+	for _, entry := range entries {
+		if entry.IsBarrier {
+			groups = append(groups, group)
+			group = []*Entry{}
+			continue
+		}
+		group = append(group, entry)
+	}
+	return groups, nil
+}
+
+func (wal *WriteAheadLog) ReadFromCheckPoint() ([]*Entry, error) {
+	if err := wal.flushForRead(); err != nil {
+		return nil, err
+	}
 	entries, error := wal.readAllEntries(true)
 	return entries, error
 }
 
-func (wal *WriteAheadLog) readAllEntries(fromCheckpoint bool) ([]*wal_pb.WAL_DATA, error) {
-	// checkpointLogSeqNo := uint64(0)
-	walFile, err := os.Open(wal.file.Name())
+// ReadAllBytes returns all the payloads concatenated back-to-back
+// along with the length of each payload, so the caller can split them again
+func (wal *WriteAheadLog) ReadAllBytes() ([]byte, []int, error) {
+	if err := wal.flushForRead(); err != nil {
+		return nil, nil, err
+	}
+	entries, err := wal.readAllEntries(false)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
-	defer walFile.Close()
-
-	entries := []*wal_pb.WAL_DATA{}
+	totalSize := 0
+	for _, entry := range entries {
+		totalSize += len(entry.Data)
+	}
+	payloads := make([]byte, 0, totalSize)
+	lengths := make([]int, 0, len(entries))
+	for _, entry := range entries {
+		payloads = append(payloads, entry.Data...)
+		lengths = append(lengths, len(entry.Data))
+	}
+	return payloads, lengths, nil
+}
 
-	for {
-		var size uint32
-		if err := binary.Read(walFile, binary.LittleEndian, &size); err != nil {
-			if err == io.EOF {
-				break
-			}
-			return nil, err
-		}
-		data := make([]byte, size)
-		_, err := walFile.Read(data)
-		if err != nil {
-			return nil, err
-		}
-		entry := &wal_pb.WAL_DATA{}
-		if err := pb.Unmarshal(data, entry); err != nil {
-			return nil, err
-		}
-		if crc32.ChecksumIEEE(append(entry.GetData(), byte(entry.GetLogSeqNo()))) != entry.GetChecksum() {
-			return nil, fmt.Errorf("CRC mismatch for entry with seq no %d", entry.GetLogSeqNo())
-		}
-		if fromCheckpoint && entry.GetIsCheckpoint() {
+// readAllEntries reads the entries of every segment in order, listed from the log directory
+// rather than the active file, which is gone once the WAL is closed
+// With fromCheckpoint it only keeps the entries starting at the last checkpoint
+func (wal *WriteAheadLog) readAllEntries(fromCheckpoint bool) ([]*Entry, error) {
+	entries := []*Entry{}
+	err := wal.forEach(func(entry *Entry) error {
+		if fromCheckpoint && entry.IsCheckpoint {
 			entries = entries[:0]
 		}
 		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if wal.orderingMode == OrderingLenient {
+		sortBySeqNo(entries)
 	}
 	return entries, nil
 }
 
+// sortBySeqNo sorts the entries by seq number, keeping the stored order of equal ones
+func sortBySeqNo(entries []*Entry) {
+	slices.SortStableFunc(entries, func(a, b *Entry) int {
+		return cmp.Compare(a.SeqNo, b.SeqNo)
+	})
+}
+
+// Sync flushes the buffered entries and fsyncs the segment file
+// A failure is returned as *ErrBufferFlush or *ErrFileSync depending on the step that failed
+// Once the WAL is closed there is nothing left to sync and it returns nil
 func (wal *WriteAheadLog) Sync() error {
+	wal.locker.Lock()
+	defer wal.locker.Unlock()
+	return wal.syncLocked()
+}
+
+// syncLocked is Sync for the callers holding the lock
+func (wal *WriteAheadLog) syncLocked() error {
+	// The entries were synced by Close, or by a TruncateAfter that failed to reopen the active segment
+	if wal.isClosed || wal.file == nil {
+		return nil
+	}
 	if err := wal.bufWriter.Flush(); err != nil {
-		return err
+		return &ErrBufferFlush{Err: err}
 	}
-	if err := wal.file.Sync(); err != nil {
-		return fmt.Errorf("failed to sync WAL file: %w", err)
+	if err := wal.fsyncActive(); err != nil {
+		return &ErrFileSync{Err: err}
 	}
 	return nil
 }
 
+// fsyncActive fsyncs the active segment, unless the WAL fell back to flush-only durability
+// With Options.SyncTimeout it gives up waiting once the timeout expires, the fsync runs on in the background
+func (wal *WriteAheadLog) fsyncActive() error {
+	if wal.flushOnly {
+		return nil
+	}
+	if wal.syncTimeout <= 0 {
+		return wal.fsync(wal.file)
+	}
+	file, done := wal.file, make(chan error, 1)
+	go func() { done <- wal.fsync(file) }()
+	timeout := time.NewTimer(wal.syncTimeout)
+	defer timeout.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timeout.C:
+		return fmt.Errorf("%w: fsync of %s took over %v", ErrSyncTimeout, file.Name(), wal.syncTimeout)
+	}
+}
+
+// probeFsync fsyncs the active segment once, if the filesystem doesn't support it
+// the WAL falls back to flush-only durability with Options.FlushOnlyWithoutFsync
+func (wal *WriteAheadLog) probeFsync() {
+	err := wal.fsync(wal.file)
+	if errors.Is(err, syscall.ENOTSUP) || errors.Is(err, syscall.EINVAL) {
+		wal.logger.Printf("fsync is not supported on %s, falling back to flush-only durability: %v", wal.logDir, err)
+		wal.flushOnly = true
+	}
+}
+
 func (wal *WriteAheadLog) keepSyncing() {
 	for {
 		select {
@@ -198,32 +987,76 @@ func (wal *WriteAheadLog) keepSyncing() {
 			return
 		case <-wal.syncDelay.C:
 			wal.locker.Lock()
-			err := wal.Sync()
+			err := wal.syncLocked()
 			wal.locker.Unlock()
 			if err != nil {
-				// Log the error
-				log.Printf("failed to sync WAL: %v", err)
+				wal.backgroundSyncFailed(err)
 			}
 		}
 	}
 }
 
-func (wal *WriteAheadLog) resetTimer() {
-	// Stop the ticker to reset the sync delay
-	wal.syncDelay.Stop()
-	// Reset the ticker to the sync interval
-	wal.syncDelay.Reset(wal.syncInterval)
+// backgroundSyncFailed reports a failed periodic sync to the error handler, by default it is logged
+func (wal *WriteAheadLog) backgroundSyncFailed(err error) {
+	if wal.errorHandler != nil {
+		wal.errorHandler(err)
+		return
+	}
+	wal.logger.Printf("failed to sync WAL: %v", err)
+}
+
+// syncIfDue runs the periodic sync in SingleWriter mode, where there is no keepSyncing goroutine
+func (wal *WriteAheadLog) syncIfDue() {
+	if wal.syncDelay == nil {
+		return
+	}
+	select {
+	case <-wal.syncDelay.C:
+		if err := wal.syncLocked(); err != nil {
+			wal.backgroundSyncFailed(err)
+		}
+	default:
+	}
 }
 
 func (wal *WriteAheadLog) Close() error {
+	// Readers like Tail flush the buffer concurrently
+	wal.locker.Lock()
+	if wal.isClosed {
+		wal.locker.Unlock()
+		return nil
+	}
 	// Cancel the context to stop any ongoing operations
 	wal.cancel()
-
-	if err := wal.Sync(); err != nil {
+	err := wal.syncLocked()
+	// The sync covers the entries of a pending group commit, its calls don't have to wait for the window
+	if group := wal.commitGroup; group != nil {
+		wal.commitGroup = nil
+		group.err = err
+		close(group.done)
+	}
+	if err != nil {
+		wal.locker.Unlock()
 		return err
 	}
-	wal.resetTimer()
-	err := wal.file.Close()
+	if wal.syncDelay != nil {
+		wal.syncDelay.Stop()
+	}
+	if err := wal.persistEntryCount(); err != nil {
+		wal.logger.Printf("%v", err)
+	}
+	// A TruncateAfter that failed to reopen the active segment left none
+	if wal.file != nil {
+		err = wal.file.Close()
+	}
 	wal.file = nil
+	wal.isClosed = true
+	wal.locker.Unlock()
+	// Wait for the background work on sealed segments to finish
+	wal.background.Wait()
+	unlockLogDir(wal.dirLock)
+	wal.dirLock = nil
+	// Wake up the tailers once everything is flushed, they deliver the last entries and stop
+	wal.closeOnce.Do(func() { close(wal.closed) })
 	return err
 }
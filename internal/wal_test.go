@@ -2,9 +2,22 @@ package wal
 
 import (
 	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"os"
 	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
 	"time"
 )
@@ -55,12 +68,12 @@ func TestWriteAndReadEntries(t *testing.T) {
 
 	// Verify data and sequence numbers
 	for i, entry := range entries {
-		if !bytes.Equal(entry.GetData(), testData[i]) {
-			t.Errorf("Entry %d data mismatch: got %v, want %v", i, entry.GetData(), testData[i])
+		if !bytes.Equal(entry.Data, testData[i]) {
+			t.Errorf("Entry %d data mismatch: got %v, want %v", i, entry.Data, testData[i])
 		}
 
-		if entry.GetLogSeqNo() != uint64(i+1) {
-			t.Errorf("Entry %d sequence number mismatch: got %d, want %d", i, entry.GetLogSeqNo(), i+1)
+		if entry.SeqNo != uint64(i+1) {
+			t.Errorf("Entry %d sequence number mismatch: got %d, want %d", i, entry.SeqNo, i+1)
 		}
 	}
 }
@@ -92,12 +105,12 @@ func TestReadWriteWithCheckpoint(t *testing.T) {
 	}
 
 	// Second entry should be a checkpoint
-	if !entries[0].GetIsCheckpoint() {
+	if !entries[0].IsCheckpoint {
 		t.Errorf("Entry 1 should be a checkpoint")
 	}
 
-	if !bytes.Equal(entries[0].GetData(), checkpointData) {
-		t.Errorf("Checkpoint data mismatch: got %v, want %v", entries[1].GetData(), checkpointData)
+	if !bytes.Equal(entries[0].Data, checkpointData) {
+		t.Errorf("Checkpoint data mismatch: got %v, want %v", entries[1].Data, checkpointData)
 	}
 }
 
@@ -119,7 +132,22 @@ func TestWriteAfterClose(t *testing.T) {
 func TestWALSyncing(t *testing.T) {
 	dir := tempWalDir(t)
 	syncDelay := 100 * time.Millisecond
-	wal, _ := Open(&Options{LogDir: dir + "/", SyncInterval: syncDelay})
+	// The fsync runs under the lock right after the flush, a signal means the entries written before are readable
+	synced := make(chan struct{}, 16)
+	fsync := func(file File) error {
+		select {
+		case synced <- struct{}{}:
+		default:
+		}
+		return file.Sync()
+	}
+	wal, _ := Open(&Options{LogDir: dir + "/", EnableSync: true, SyncInterval: syncDelay, fsync: fsync})
+	defer wal.Close()
+	drain := func() {
+		for len(synced) > 0 {
+			<-synced
+		}
+	}
 	// Write 3 entries
 	testData := make([][]byte, 3)
 	for i := 0; i < 3; i++ {
@@ -135,6 +163,7 @@ func TestWALSyncing(t *testing.T) {
 	if len(entries) != 3 {
 		t.Errorf("All data didn't synced, Got: %d", len(entries))
 	}
+	drain()
 	testData_2 := make([][]byte, 2)
 	for i := 0; i < 2; i++ {
 		testData_2[i] = []byte(fmt.Sprintf("Synced data-%d with delay", i))
@@ -143,11 +172,17 @@ func TestWALSyncing(t *testing.T) {
 		}
 	}
 	entries_2, _ := wal.ReadAll()
-	if len(entries_2) != 3 {
-		t.Errorf("Expected synced data 3 but Got: %d", len(entries))
+	// The new entries may still be buffered, ReadAll flushes them before reading
+	if len(entries_2) != 5 {
+		t.Errorf("Expected data 5 but Got: %d", len(entries_2))
+	}
+	// it will sync automatially with in the syncDelay, wait for a sync started after the writes
+	drain()
+	select {
+	case <-synced:
+	case <-time.After(10 * syncDelay):
+		t.Fatalf("The periodic sync didn't run within %v", 10*syncDelay)
 	}
-	// it will sync automatially with in the syncDelay
-	time.Sleep(syncDelay)
 	entries_3, _ := wal.ReadAll()
 	if len(entries_3) != 5 {
 		t.Errorf("Expected synced data 5 but Got: %d", len(entries_3))
@@ -178,14 +213,10 @@ func TestChecksumValidation(t *testing.T) {
 	defer wal.Close()
 
 	// Reading should either fail or return only valid entries
+	// The corrupted data reads as an entry cut short at the end, a torn write, so it's dropped
 	entries, err := wal.ReadAll()
-	// the err variable won't be nil because the file is corrupted
-	if err == nil {
-		if len(entries) != 1 {
-			t.Errorf("Expected 1 entries but got %d", len(entries))
-		} else {
-			t.Fatalf("Couldn't parse the error:- %v", err)
-		}
+	if err == nil && len(entries) != 1 {
+		t.Errorf("Expected 1 entries but got %d", len(entries))
 	}
 }
 
@@ -262,3 +293,4950 @@ func TestOldestSegmentDeletion(t *testing.T) {
 		t.Errorf("Expected exactly %d segment files, got %d", maxSegments, len(files))
 	}
 }
+
+func TestMissingSegments(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/"})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := wal.Write([]byte("entry before removal")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	wal.Sync()
+
+	// Remove all the segments out from under the open WAL
+	segments, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	for _, segment := range segments {
+		os.Remove(segment)
+	}
+	if _, err := wal.ReadAll(); !errors.Is(err, ErrNoSegments) {
+		t.Errorf("Expected ErrNoSegments from ReadAll, got %v", err)
+	}
+	wal.Close()
+	// Leave a stray file so the directory isn't empty on reopen
+	if err := os.WriteFile(filepath.Join(dir, "stray"), []byte("not a segment"), 0644); err != nil {
+		t.Fatalf("Failed to write stray file: %v", err)
+	}
+
+	if _, err := Open(&Options{LogDir: dir + "/"}); !errors.Is(err, ErrNoSegments) {
+		t.Fatalf("Expected ErrNoSegments from Open, got %v", err)
+	}
+
+	wal, err = Open(&Options{LogDir: dir + "/", OnMissingSegments: MissingSegmentsCreate})
+	if err != nil {
+		t.Fatalf("Open with MissingSegmentsCreate failed: %v", err)
+	}
+	defer wal.Close()
+	if err := wal.Write([]byte("entry after removal")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	wal.Sync()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Expected 1 entry in the fresh segment, got %d", len(entries))
+	}
+}
+
+func TestReadAllBytes(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+
+	testData := [][]byte{[]byte("first"), []byte(""), []byte("third entry"), []byte("4")}
+	for i, data := range testData {
+		if err := wal.Write(data); err != nil {
+			t.Fatalf("Write failed at entry %d: %v", i, err)
+		}
+	}
+	wal.Sync()
+
+	payloads, lengths, err := wal.ReadAllBytes()
+	if err != nil {
+		t.Fatalf("ReadAllBytes failed: %v", err)
+	}
+	if len(lengths) != len(testData) {
+		t.Fatalf("Expected %d lengths, got %d", len(testData), len(lengths))
+	}
+	offset := 0
+	for i, length := range lengths {
+		if got := payloads[offset : offset+length]; !bytes.Equal(got, testData[i]) {
+			t.Errorf("Entry %d mismatch: got %q, want %q", i, got, testData[i])
+		}
+		offset += length
+	}
+	if offset != len(payloads) {
+		t.Errorf("Lengths cover %d bytes but payloads has %d", offset, len(payloads))
+	}
+}
+
+func TestMonotonicTimestamps(t *testing.T) {
+	// The injected clock jumps an hour back after the second entry
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	skewedClock := func() func() time.Time {
+		calls := 0
+		return func() time.Time {
+			calls++
+			if calls > 3 {
+				return now.Add(-time.Hour)
+			}
+			return now.Add(time.Duration(calls) * time.Millisecond)
+		}
+	}
+
+	readTimestamps := func(t *testing.T, monotonic bool) []int64 {
+		dir := tempWalDir(t)
+		wal, _ := Open(&Options{LogDir: dir + "/", Clock: skewedClock(), MonotonicTimestamps: monotonic})
+		defer wal.Close()
+		for i := 0; i < 5; i++ {
+			if err := wal.Write([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		wal.Sync()
+		entries, err := wal.ReadAll()
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		timestamps := make([]int64, len(entries))
+		for i, entry := range entries {
+			timestamps[i] = entry.TimestampUnixNano
+		}
+		return timestamps
+	}
+
+	wallTimestamps := readTimestamps(t, false)
+	if wallTimestamps[2] >= wallTimestamps[1] {
+		t.Errorf("Expected the wall clock timestamps to go backwards, got %v", wallTimestamps)
+	}
+
+	monotonicTimestamps := readTimestamps(t, true)
+	for i := 1; i < len(monotonicTimestamps); i++ {
+		if monotonicTimestamps[i] < monotonicTimestamps[i-1] {
+			t.Errorf("Timestamp %d went backwards: %d < %d", i, monotonicTimestamps[i], monotonicTimestamps[i-1])
+		}
+	}
+	if base := now.Add(time.Millisecond).UnixNano(); monotonicTimestamps[0] < base {
+		t.Errorf("Expected timestamps based on the clock at Open, got %d < %d", monotonicTimestamps[0], base)
+	}
+}
+
+func TestRecoveryScanBudget(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	for i := 0; i < 100; i++ {
+		if err := wal.Write(bytes.Repeat([]byte("x"), 100)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	// The segment holds ~10 KB, way over a 1 KB budget
+	if _, err := Open(&Options{LogDir: dir + "/", MaxRecoveryScanBytes: 1024}); !errors.Is(err, ErrRecoveryBudgetExceeded) {
+		t.Fatalf("Expected ErrRecoveryBudgetExceeded, got %v", err)
+	}
+
+	wal, err := Open(&Options{LogDir: dir + "/", MaxRecoveryScanBytes: 1024 * 1024})
+	if err != nil {
+		t.Fatalf("Open within the budget failed: %v", err)
+	}
+	wal.Close()
+}
+
+func TestWriteReader(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+
+	payload := []byte("payload streamed from a reader")
+	reader := bytes.NewReader(append(payload, []byte("-trailing bytes")...))
+	if err := wal.WriteReader(reader, len(payload)); err != nil {
+		t.Fatalf("WriteReader failed: %v", err)
+	}
+	// A short reader must not produce an entry
+	if err := wal.WriteReader(bytes.NewReader([]byte("short")), 100); err == nil {
+		t.Errorf("Expected an error for a short reader")
+	}
+	wal.Sync()
+
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 1 {
+		t.Fatalf("Expected 1 entry, got %d", len(entries))
+	}
+	if !bytes.Equal(entries[0].Data, payload) {
+		t.Errorf("Entry mismatch: got %q, want %q", entries[0].Data, payload)
+	}
+}
+
+func TestSegmentOverlaps(t *testing.T) {
+	// writeSegment writes the entries with a fresh WAL and returns the raw segment bytes
+	writeSegment := func(prefix string, count int) []byte {
+		dir := tempWalDir(t)
+		wal, _ := Open(&Options{LogDir: dir + "/"})
+		for i := 1; i <= count; i++ {
+			if err := wal.Write([]byte(fmt.Sprintf("%s-%d", prefix, i))); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		wal.Close()
+		data, err := os.ReadFile(filepath.Join(dir, segmentPrefix+"1"))
+		if err != nil {
+			t.Fatalf("Failed to read segment: %v", err)
+		}
+		return data
+	}
+
+	// segment-1 holds seq 1..5 and segment-2 holds seq 1..3 again
+	dir := tempWalDir(t)
+	os.WriteFile(filepath.Join(dir, segmentPrefix+"1"), writeSegment("old", 5), 0644)
+	os.WriteFile(filepath.Join(dir, segmentPrefix+"2"), writeSegment("new", 3), 0644)
+
+	wal, err := Open(&Options{LogDir: dir + "/"})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+
+	overlaps, err := wal.CheckSegmentOverlaps()
+	if err != nil {
+		t.Fatalf("CheckSegmentOverlaps failed: %v", err)
+	}
+	expected := Overlap{FirstSegment: 1, SecondSegment: 2, FromSeqNo: 1, ToSeqNo: 3}
+	if len(overlaps) != 1 || overlaps[0] != expected {
+		t.Fatalf("Expected overlaps %+v, got %+v", []Overlap{expected}, overlaps)
+	}
+
+	entries, err := wal.ReadAllResolved()
+	if err != nil {
+		t.Fatalf("ReadAllResolved failed: %v", err)
+	}
+	want := []string{"new-1", "new-2", "new-3", "old-4", "old-5"}
+	if len(entries) != len(want) {
+		t.Fatalf("Expected %d entries, got %d", len(want), len(entries))
+	}
+	for i, entry := range entries {
+		if entry.SeqNo != uint64(i+1) || string(entry.Data) != want[i] {
+			t.Errorf("Entry %d: got seq %d data %q, want seq %d data %q",
+				i, entry.SeqNo, entry.Data, i+1, want[i])
+		}
+	}
+}
+
+func TestCompressSealedSegments(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024, CompressSealedSegments: true})
+	defer wal.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	wal.Sync()
+	wal.background.Wait()
+
+	if _, err := os.Stat(filepath.Join(dir, segmentPrefix+"1"+compressedSuffix)); err != nil {
+		t.Errorf("Expected the sealed segment to be compressed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, segmentPrefix+"1")); !os.IsNotExist(err) {
+		t.Errorf("Expected the uncompressed sealed segment to be removed, got %v", err)
+	}
+	activeSegment := filepath.Join(dir, segmentPrefix+strconv.Itoa(wal.currentSegmentNo))
+	if _, err := os.Stat(activeSegment); err != nil {
+		t.Errorf("Expected the active segment to stay uncompressed: %v", err)
+	}
+
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 100 {
+		t.Fatalf("Expected 100 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.SeqNo != uint64(i+1) {
+			t.Errorf("Entry %d sequence number mismatch: got %d", i, entry.SeqNo)
+		}
+	}
+}
+
+func TestSyncErrorTypes(t *testing.T) {
+	t.Run("buffer flush", func(t *testing.T) {
+		dir := tempWalDir(t)
+		wal, _ := Open(&Options{LogDir: dir + "/"})
+		if err := wal.Write([]byte("buffered entry")); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		// The buffered entry can't be written to a closed file
+		wal.file.Close()
+		err := wal.Sync()
+		var flushErr *ErrBufferFlush
+		if !errors.As(err, &flushErr) {
+			t.Fatalf("Expected ErrBufferFlush, got %v", err)
+		}
+		var syncErr *ErrFileSync
+		if errors.As(err, &syncErr) {
+			t.Errorf("Didn't expect ErrFileSync for a flush failure")
+		}
+	})
+
+	t.Run("file sync", func(t *testing.T) {
+		dir := tempWalDir(t)
+		wal, _ := Open(&Options{LogDir: dir + "/"})
+		// Nothing is buffered, so only the fsync of the closed file fails
+		wal.file.Close()
+		err := wal.Sync()
+		var syncErr *ErrFileSync
+		if !errors.As(err, &syncErr) {
+			t.Fatalf("Expected ErrFileSync, got %v", err)
+		}
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("Expected the underlying error to be kept, got %v", err)
+		}
+	})
+}
+
+func TestSyncTimeout(t *testing.T) {
+	dir := tempWalDir(t)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	hung, syncs := true, 0
+	fsync := func(file File) error {
+		mu.Lock()
+		wait := hung
+		mu.Unlock()
+		if wait {
+			<-release
+		}
+		mu.Lock()
+		syncs++
+		mu.Unlock()
+		return file.Sync()
+	}
+	wal, err := Open(&Options{LogDir: dir + "/", EnableSync: true, SyncInterval: 20 * time.Millisecond, SyncTimeout: 50 * time.Millisecond,
+		fsync: fsync})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	wal.Write([]byte("data"))
+	start := time.Now()
+	err = wal.Sync()
+	if !errors.Is(err, ErrSyncTimeout) {
+		t.Fatalf("Expected ErrSyncTimeout, got %v", err)
+	}
+	var syncErr *ErrFileSync
+	if !errors.As(err, &syncErr) {
+		t.Errorf("Expected the timeout to be an ErrFileSync, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected Sync to give up after the timeout, it took %v", elapsed)
+	}
+
+	// The periodic sync times out as well and keeps going, it syncs again once fsync recovers
+	time.Sleep(150 * time.Millisecond)
+	mu.Lock()
+	hung = false
+	mu.Unlock()
+	close(release)
+	time.Sleep(20 * time.Millisecond)
+	mu.Lock()
+	syncs = 0
+	mu.Unlock()
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	periodic := syncs
+	mu.Unlock()
+	if periodic == 0 {
+		t.Errorf("Expected the periodic sync to survive the timeouts")
+	}
+	if err := wal.Close(); err != nil {
+		t.Errorf("Close failed: %v", err)
+	}
+}
+
+func TestEntriesSinceCheckpoint(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+
+	for i := 0; i < 3; i++ {
+		wal.Write([]byte(fmt.Sprintf("before checkpoint-%d", i)))
+	}
+	if count, err := wal.EntriesSinceCheckpoint(); err != nil || count != 3 {
+		t.Fatalf("Expected 3 entries without a checkpoint, got %d (%v)", count, err)
+	}
+	if err := wal.WriteWithCheckpoint([]byte("checkpoint")); err != nil {
+		t.Fatalf("WriteWithCheckpoint failed: %v", err)
+	}
+	for i := 0; i < 4; i++ {
+		wal.Write([]byte(fmt.Sprintf("after checkpoint-%d", i)))
+	}
+	if count, err := wal.EntriesSinceCheckpoint(); err != nil || count != 4 {
+		t.Fatalf("Expected 4 entries since the checkpoint, got %d (%v)", count, err)
+	}
+	wal.Close()
+
+	// A reopened WAL counts the entries from disk
+	wal, _ = Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+	if count, err := wal.EntriesSinceCheckpoint(); err != nil || count != 4 {
+		t.Fatalf("Expected 4 entries since the checkpoint after reopen, got %d (%v)", count, err)
+	}
+}
+
+func TestSegmentFormatVersion(t *testing.T) {
+	// writeLog writes a few entries and returns the path of the segment file
+	writeLog := func(dir string) string {
+		wal, _ := Open(&Options{LogDir: dir + "/"})
+		for i := 0; i < 3; i++ {
+			wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+		}
+		wal.Close()
+		return filepath.Join(dir, segmentPrefix+"1")
+	}
+	readLog := func(dir string) (*WriteAheadLog, int, error) {
+		wal, err := Open(&Options{LogDir: dir + "/"})
+		if err != nil {
+			return nil, 0, err
+		}
+		defer wal.Close()
+		entries, err := wal.ReadAll()
+		return wal, len(entries), err
+	}
+	// headerVersion returns the format version read from the header of the segment
+	headerVersion := func(wal *WriteAheadLog, segment string) uint16 {
+		sr, err := wal.openSegmentReader(segment)
+		if err != nil {
+			t.Fatalf("Failed to read the segment header: %v", err)
+		}
+		defer sr.Close()
+		return sr.header.version
+	}
+
+	t.Run("current", func(t *testing.T) {
+		dir := tempWalDir(t)
+		segment := writeLog(dir)
+		wal, count, err := readLog(dir)
+		if err != nil || count != 3 {
+			t.Fatalf("Expected 3 entries, got %d (%v)", count, err)
+		}
+		if version := headerVersion(wal, segment); version != formatVersionCurrent {
+			t.Errorf("Expected format version %d, got %d", formatVersionCurrent, version)
+		}
+	})
+
+	t.Run("legacy without header", func(t *testing.T) {
+		dir := tempWalDir(t)
+		segment := writeLog(dir)
+		data, _ := os.ReadFile(segment)
+		os.WriteFile(segment, data[segmentHeaderSize:], 0644)
+		wal, count, err := readLog(dir)
+		if err != nil || count != 3 {
+			t.Fatalf("Expected 3 entries, got %d (%v)", count, err)
+		}
+		if version := headerVersion(wal, segment); version != formatVersionLegacy {
+			t.Errorf("Expected format version %d, got %d", formatVersionLegacy, version)
+		}
+	})
+
+	t.Run("wrong magic", func(t *testing.T) {
+		dir := tempWalDir(t)
+		segment := writeLog(dir)
+		data, _ := os.ReadFile(segment)
+		copy(data, "XWAL")
+		os.WriteFile(segment, data, 0644)
+		if _, _, err := readLog(dir); !errors.Is(err, ErrUnsupportedFormatVersion) {
+			t.Fatalf("Expected ErrUnsupportedFormatVersion, got %v", err)
+		}
+		// The segment isn't mistaken for a torn legacy one and truncated
+		if kept, _ := os.ReadFile(segment); !bytes.Equal(kept, data) {
+			t.Errorf("Expected the segment to be left as is")
+		}
+	})
+
+	t.Run("unsupported", func(t *testing.T) {
+		dir := tempWalDir(t)
+		segment := writeLog(dir)
+		data, _ := os.ReadFile(segment)
+		data[4] = 99
+		os.WriteFile(segment, data, 0644)
+		if _, _, err := readLog(dir); !errors.Is(err, ErrUnsupportedFormatVersion) {
+			t.Fatalf("Expected ErrUnsupportedFormatVersion, got %v", err)
+		}
+	})
+}
+
+func TestRecentCache(t *testing.T) {
+	dir := tempWalDir(t)
+	fileOpens := 0
+	countingOpen := func(name string, flag int, perm os.FileMode) (File, error) {
+		fileOpens++
+		return os.OpenFile(name, flag, perm)
+	}
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024, RecentCacheSize: 10, openFile: countingOpen})
+	defer wal.Close()
+
+	for i := 1; i <= 60; i++ {
+		if err := wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if wal.currentSegmentNo == 1 {
+		t.Fatalf("Expected the writes to rotate the segment")
+	}
+
+	// The cache spans the rotation, so no file is read
+	fileOpens = 0
+	entries, err := wal.LastN(10)
+	if err != nil {
+		t.Fatalf("LastN failed: %v", err)
+	}
+	if fileOpens != 0 {
+		t.Errorf("Expected LastN to be served from the cache, got %d file opens", fileOpens)
+	}
+	for i, entry := range entries {
+		if entry.SeqNo != uint64(51+i) {
+			t.Errorf("Entry %d: got seq %d, want %d", i, entry.SeqNo, 51+i)
+		}
+	}
+
+	// More than the cache holds falls back to the segment files
+	entries, err = wal.LastN(20)
+	if err != nil {
+		t.Fatalf("LastN failed: %v", err)
+	}
+	if fileOpens == 0 {
+		t.Errorf("Expected LastN beyond the cache size to read the segment files")
+	}
+	if len(entries) != 20 || entries[0].SeqNo != 41 || entries[19].SeqNo != 60 {
+		t.Errorf("Expected entries 41..60, got %d entries", len(entries))
+	}
+
+	// A negative count is rejected, with or without the cache
+	if _, err := wal.LastN(-1); err == nil {
+		t.Errorf("Expected LastN(-1) to fail")
+	}
+	wal.recentCache = nil
+	if _, err := wal.LastN(-1); err == nil {
+		t.Errorf("Expected LastN(-1) to fail without the cache")
+	}
+}
+
+func TestVerifyAppendOnly(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+	defer wal.Close()
+
+	for i := 0; i < 100; i++ {
+		wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+	wal.Sync()
+	snapshot, err := wal.SnapshotChecksums()
+	if err != nil {
+		t.Fatalf("SnapshotChecksums failed: %v", err)
+	}
+	if len(snapshot) < 2 {
+		t.Fatalf("Expected multiple segments, got %d", len(snapshot))
+	}
+
+	// Appending to the active segment is not a modification
+	wal.Write([]byte("appended entry"))
+	wal.Sync()
+	if changed, err := wal.VerifyAgainst(snapshot); err != nil || len(changed) != 0 {
+		t.Fatalf("Expected no changed segments, got %v (%v)", changed, err)
+	}
+
+	// Flip a byte in the middle of the first sealed segment
+	segment := filepath.Join(dir, segmentPrefix+"1")
+	data, _ := os.ReadFile(segment)
+	data[len(data)/2] ^= 0xff
+	os.WriteFile(segment, data, 0644)
+
+	changed, err := wal.VerifyAgainst(snapshot)
+	if err != nil {
+		t.Fatalf("VerifyAgainst failed: %v", err)
+	}
+	if len(changed) != 1 || changed[0] != 1 {
+		t.Errorf("Expected segment 1 to be flagged, got %v", changed)
+	}
+}
+
+func TestBarrierGroups(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+
+	wal.Write([]byte("group-1 entry-1"))
+	wal.Write([]byte("group-1 entry-2"))
+	barrierSeqNo, err := wal.WriteBarrier()
+	if err != nil {
+		t.Fatalf("WriteBarrier failed: %v", err)
+	}
+	if barrierSeqNo != 3 {
+		t.Errorf("Expected the barrier seq no to be 3, got %d", barrierSeqNo)
+	}
+	wal.Write([]byte("group-2 entry-1"))
+	wal.WriteBarrier()
+	wal.Write([]byte("not committed by a barrier"))
+
+	// The barrier fsyncs the data, the groups are readable without an explicit Sync
+	groups, err := wal.ReadBarrierGroups()
+	if err != nil {
+		t.Fatalf("ReadBarrierGroups failed: %v", err)
+	}
+	want := [][]string{{"group-1 entry-1", "group-1 entry-2"}, {"group-2 entry-1"}}
+	if len(groups) != len(want) {
+		t.Fatalf("Expected %d groups, got %d", len(want), len(groups))
+	}
+	for i, group := range groups {
+		if len(group) != len(want[i]) {
+			t.Fatalf("Group %d: expected %d entries, got %d", i, len(want[i]), len(group))
+		}
+		for j, entry := range group {
+			if string(entry.Data) != want[i][j] {
+				t.Errorf("Group %d entry %d: got %q, want %q", i, j, entry.Data, want[i][j])
+			}
+		}
+	}
+}
+
+func TestForEach(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+	defer wal.Close()
+
+	for i := 0; i < 100; i++ {
+		wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+	wal.Sync()
+
+	count := 0
+	err := wal.ForEach(func(entry *Entry) error {
+		count++
+		if entry.SeqNo != uint64(count) {
+			return fmt.Errorf("unexpected seq no %d at position %d", entry.SeqNo, count)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ForEach failed: %v", err)
+	}
+	if count != 100 {
+		t.Errorf("Expected 100 entries, got %d", count)
+	}
+
+	// ForEach stops at the first error returned by the callback
+	errStop := errors.New("stop")
+	count = 0
+	err = wal.ForEach(func(entry *Entry) error {
+		count++
+		if count == 10 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("Expected the callback error, got %v", err)
+	}
+	if count != 10 {
+		t.Errorf("Expected ForEach to stop after 10 entries, got %d", count)
+	}
+}
+
+func TestReadsFlushBufferedEntries(t *testing.T) {
+	wal, _ := Open(&Options{LogDir: tempWalDir(t) + "/"})
+	defer wal.Close()
+	wal.WriteWithCheckpoint([]byte("checkpoint"))
+	wal.WriteBarrier()
+	// Left in the write buffer, every read flushes it first
+	wal.Write([]byte("buffered"))
+
+	count := func(entries []*Entry, err error) int {
+		if err != nil {
+			t.Fatalf("Read failed: %v", err)
+		}
+		return len(entries)
+	}
+	reads := map[string]func() int{
+		"ReadAll":            func() int { return count(wal.ReadAll()) },
+		"ReadFromCheckPoint": func() int { return count(wal.ReadFromCheckPoint()) },
+		"ReadAllResolved":    func() int { return count(wal.ReadAllResolved()) },
+		"ReadAllDeadline": func() int {
+			entries, _, err := wal.ReadAllDeadline(time.Minute)
+			return count(entries, err)
+		},
+		"ReadAllBytes": func() int {
+			_, lengths, err := wal.ReadAllBytes()
+			return count(make([]*Entry, len(lengths)), err)
+		},
+		"ForEach": func() int {
+			n := 0
+			if err := wal.ForEach(func(*Entry) error { n++; return nil }); err != nil {
+				t.Fatalf("ForEach failed: %v", err)
+			}
+			return n
+		},
+	}
+	for name, read := range reads {
+		if n := read(); n != 3 {
+			t.Errorf("Expected %s to read 3 entries, got %d", name, n)
+		}
+	}
+	wal.WriteBarrier()
+	if groups, err := wal.ReadBarrierGroups(); err != nil || len(groups) != 2 || len(groups[1]) != 1 {
+		t.Errorf("Expected the buffered entry in the second barrier group, got %v, %v", groups, err)
+	}
+}
+
+func TestSegmentCountWarning(t *testing.T) {
+	dir := tempWalDir(t)
+	warnings := []int{}
+	wal, _ := Open(&Options{
+		LogDir:                    dir + "/",
+		MaxLogFileSize:            5 * 1024,
+		maxSegments:               10,
+		SegmentCountWarnThreshold: 2,
+		OnSegmentCountWarning:     func(segmentCount int) { warnings = append(warnings, segmentCount) },
+	})
+	defer wal.Close()
+
+	for i := 0; i < 200; i++ {
+		wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+	if wal.currentSegmentNo < 4 {
+		t.Fatalf("Expected at least 4 segments, got %d", wal.currentSegmentNo)
+	}
+	if len(warnings) != 1 {
+		t.Fatalf("Expected the warning to fire once, got %v", warnings)
+	}
+	if warnings[0] != 3 {
+		t.Errorf("Expected the warning when crossing to 3 segments, got %d", warnings[0])
+	}
+}
+
+func TestResumeFromCursor(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+
+	for i := 0; i < 100; i++ {
+		wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+
+	// Apply the first half, then fail as if the process crashed
+	errStop := errors.New("stop")
+	applied := []uint64{}
+	err := wal.ResumeFromCursor(func(entry *Entry) error {
+		if len(applied) == 50 {
+			return errStop
+		}
+		applied = append(applied, entry.SeqNo)
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Fatalf("Expected the handler error, got %v", err)
+	}
+	wal.Close()
+
+	wal, err = Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer wal.Close()
+
+	err = wal.ResumeFromCursor(func(entry *Entry) error {
+		applied = append(applied, entry.SeqNo)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ResumeFromCursor failed: %v", err)
+	}
+	if len(applied) != 100 {
+		t.Fatalf("Expected 100 applied entries, got %d", len(applied))
+	}
+	for i, seqNo := range applied {
+		if seqNo != uint64(i+1) {
+			t.Fatalf("Expected seq no %d at position %d, got %d", i+1, i, seqNo)
+		}
+	}
+
+	// Nothing is left to apply once the cursor reached the end
+	err = wal.ResumeFromCursor(func(entry *Entry) error {
+		t.Errorf("Unexpected entry with seq no %d", entry.SeqNo)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ResumeFromCursor failed: %v", err)
+	}
+}
+
+func TestSingleWriter(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{
+		LogDir:                 dir + "/",
+		MaxLogFileSize:         5 * 1024,
+		SingleWriter:           true,
+		CompressSealedSegments: true,
+		EnableSync:             true,
+		SyncInterval:           10 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to open WAL: %v", err)
+	}
+
+	for i := 0; i < 50; i++ {
+		if err := wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100)); err != nil {
+			t.Fatalf("Failed to write entry %d: %v", i, err)
+		}
+	}
+
+	// The periodic sync runs on the next write once the interval elapsed
+	time.Sleep(20 * time.Millisecond)
+	if err := wal.Write([]byte("synced")); err != nil {
+		t.Fatalf("Failed to write entry: %v", err)
+	}
+	entries, err := wal.readSegment(wal.file.Name())
+	if err != nil {
+		t.Fatalf("Failed to read the active segment: %v", err)
+	}
+	if len(entries) == 0 || string(entries[len(entries)-1].Data) != "synced" {
+		t.Errorf("Expected the last write to be synced by the periodic sync")
+	}
+
+	// Sealed segments were compressed inline during rotation
+	compressed, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"+compressedSuffix))
+	if len(compressed) == 0 {
+		t.Errorf("Expected sealed segments to be compressed")
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Failed to close WAL: %v", err)
+	}
+
+	wal, err = Open(&Options{LogDir: dir + "/", SingleWriter: true})
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer wal.Close()
+	readBack, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("Failed to read entries: %v", err)
+	}
+	if len(readBack) != 51 {
+		t.Fatalf("Expected 51 entries, got %d", len(readBack))
+	}
+	for i, entry := range readBack {
+		if entry.SeqNo != uint64(i+1) {
+			t.Fatalf("Expected seq no %d at position %d, got %d", i+1, i, entry.SeqNo)
+		}
+	}
+}
+
+func benchmarkWrite(b *testing.B, singleWriter bool) {
+	wal, err := Open(&Options{LogDir: b.TempDir() + "/", SingleWriter: singleWriter})
+	if err != nil {
+		b.Fatalf("Failed to open WAL: %v", err)
+	}
+	defer wal.Close()
+
+	data := bytes.Repeat([]byte("a"), 100)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := wal.Write(data); err != nil {
+			b.Fatalf("Failed to write entry: %v", err)
+		}
+	}
+}
+
+func BenchmarkWrite(b *testing.B) {
+	benchmarkWrite(b, false)
+}
+
+func BenchmarkWriteSingleWriter(b *testing.B) {
+	benchmarkWrite(b, true)
+}
+
+func TestSegmentFooter(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+	defer wal.Close()
+
+	for i := 0; i < 100; i++ {
+		wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+	segmentNos, err := wal.Segments()
+	if err != nil {
+		t.Fatalf("Segments failed: %v", err)
+	}
+	if len(segmentNos) < 2 || segmentNos[0] != 1 {
+		t.Fatalf("Expected multiple segments starting at 1, got %v", segmentNos)
+	}
+
+	// Sealed segments carry the footer, the active one doesn't
+	sealed, _ := os.ReadFile(filepath.Join(dir, segmentPrefix+"1"))
+	if !hasSegmentFooter(sealed) {
+		t.Errorf("Expected sealed segment 1 to end with a footer")
+	}
+	active, _ := os.ReadFile(wal.file.Name())
+	if hasSegmentFooter(active) {
+		t.Errorf("Expected the active segment to have no footer")
+	}
+
+	// The footer is skipped when the entries are read
+	total := 0
+	for _, segmentNo := range segmentNos {
+		entries, err := wal.ReadSegment(segmentNo)
+		if err != nil {
+			t.Fatalf("ReadSegment(%d) failed: %v", segmentNo, err)
+		}
+		total += len(entries)
+	}
+	if total != 100 {
+		t.Errorf("Expected 100 entries across segments, got %d", total)
+	}
+	if _, err := wal.ReadSegment(1000); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("Expected ErrSegmentNotFound, got %v", err)
+	}
+
+	// Corrupt the payload of the last entry of segment 1, decoding would only fail on that entry
+	sealed[len(sealed)-segmentFooterSize-20] ^= 0xff
+	os.WriteFile(filepath.Join(dir, segmentPrefix+"1"), sealed, 0644)
+
+	_, err = wal.ReadSegment(1)
+	if !errors.Is(err, ErrSegmentChecksumMismatch) {
+		t.Fatalf("Expected ErrSegmentChecksumMismatch, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "segment 1") {
+		t.Errorf("Expected the error to name the segment, got %v", err)
+	}
+}
+
+func TestWriteLarge(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 16 * 1024, MaxEntrySize: 4 * 1024})
+	defer wal.Close()
+
+	payload := make([]byte, 20*1024)
+	for i := range payload {
+		payload[i] = byte(i % 251)
+	}
+	wal.Write([]byte("before"))
+	if err := wal.WriteLarge(payload); err != nil {
+		t.Fatalf("WriteLarge failed: %v", err)
+	}
+	wal.Write([]byte("after"))
+	wal.Sync()
+
+	segmentNos, _ := wal.Segments()
+	if len(segmentNos) < 2 {
+		t.Fatalf("Expected the payload to span segments, got %v", segmentNos)
+	}
+
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	if string(entries[0].Data) != "before" || string(entries[2].Data) != "after" {
+		t.Errorf("Unexpected entries around the payload")
+	}
+	if !bytes.Equal(entries[1].Data, payload) {
+		t.Errorf("Reassembled payload doesn't match, got %d bytes", len(entries[1].Data))
+	}
+	if entries[1].SeqNo != 2 {
+		t.Errorf("Expected the payload to keep the seq no of its first chunk, got %d", entries[1].SeqNo)
+	}
+}
+
+func TestCompactCheckpoints(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+	defer wal.Close()
+
+	for i := 0; i < 6; i++ {
+		wal.WriteWithCheckpoint([]byte("checkpoint " + strconv.Itoa(i)))
+		for j := 0; j < 5; j++ {
+			wal.Write(bytes.Repeat([]byte{byte('a' + j)}, 100))
+		}
+	}
+	if err := wal.CompactCheckpoints(2); err != nil {
+		t.Fatalf("CompactCheckpoints failed: %v", err)
+	}
+
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 36 {
+		t.Fatalf("Expected all 36 entries to be kept, got %d", len(entries))
+	}
+	checkpoints := []string{}
+	for _, entry := range entries {
+		if entry.IsCheckpoint {
+			checkpoints = append(checkpoints, string(entry.Data))
+		}
+	}
+	if len(checkpoints) != 2 || checkpoints[0] != "checkpoint 4" || checkpoints[1] != "checkpoint 5" {
+		t.Errorf("Expected the last 2 checkpoints to remain, got %v", checkpoints)
+	}
+
+	// The log is still appendable after rewriting the active segment
+	if err := wal.Write([]byte("after compaction")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	wal.Sync()
+	entries, err = wal.ReadFromCheckPoint()
+	if err != nil {
+		t.Fatalf("ReadFromCheckPoint failed: %v", err)
+	}
+	if len(entries) != 7 || string(entries[0].Data) != "checkpoint 5" {
+		t.Errorf("Expected 7 entries from the last checkpoint, got %d", len(entries))
+	}
+
+	// The entries LastN already returned keep their flag, the cache serves demoted copies
+	cached, _ := Open(&Options{LogDir: tempWalDir(t) + "/", RecentCacheSize: 10})
+	defer cached.Close()
+	cached.WriteWithCheckpoint([]byte("first"))
+	cached.WriteWithCheckpoint([]byte("second"))
+	returned, _ := cached.LastN(2)
+	if err := cached.CompactCheckpoints(1); err != nil {
+		t.Fatalf("CompactCheckpoints failed: %v", err)
+	}
+	if !returned[0].IsCheckpoint {
+		t.Errorf("Expected the entry returned before the compaction to be left alone")
+	}
+	if demoted, _ := cached.LastN(2); demoted[0].IsCheckpoint || !demoted[1].IsCheckpoint {
+		t.Errorf("Expected the cache to serve the demoted checkpoint")
+	}
+
+	// A compression of a segment started before its rewrite doesn't swap in the old content
+	compressed, _ := Open(&Options{LogDir: tempWalDir(t) + "/", MaxLogFileSize: 5 * 1024})
+	defer compressed.Close()
+	compressed.WriteWithCheckpoint([]byte("checkpoint"))
+	for compressed.currentSegmentNo == 1 {
+		compressed.Write(bytes.Repeat([]byte("x"), 100))
+	}
+	sealed, rewrites := compressed.logFileNamePrefix+"1", compressed.segmentRewrites
+	if err := compressed.CompactCheckpoints(0); err != nil {
+		t.Fatalf("CompactCheckpoints failed: %v", err)
+	}
+	if err := compressed.compressSegment(sealed, rewrites); err != nil {
+		t.Fatalf("compressSegment failed: %v", err)
+	}
+	if _, err := os.Stat(sealed + compressedSuffix); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the stale compressed copy to be dropped, got %v", err)
+	}
+	if first, _ := compressed.readSegment(sealed); len(first) == 0 || first[0].IsCheckpoint {
+		t.Errorf("Expected the demoted checkpoint to stay demoted")
+	}
+}
+
+func TestReplaceAll(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+
+	for i := 0; i < 40; i++ {
+		wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+	wal.Sync()
+
+	snapshot := []*Entry{}
+	for i := 0; i < 30; i++ {
+		snapshot = append(snapshot, &Entry{
+			SeqNo: uint64(100 + i),
+			Data:  []byte("snapshot entry " + strconv.Itoa(i)),
+		})
+	}
+	if err := wal.ReplaceAll(snapshot); err != nil {
+		t.Fatalf("ReplaceAll failed: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, replaceReadyDirName)); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected the staging directory to be removed, got %v", err)
+	}
+
+	checkEntries := func(entries []*Entry, want int) {
+		t.Helper()
+		if len(entries) != want {
+			t.Fatalf("Expected %d entries, got %d", want, len(entries))
+		}
+		for i, entry := range snapshot {
+			if entries[i].SeqNo != entry.SeqNo || !bytes.Equal(entries[i].Data, entry.Data) {
+				t.Fatalf("Entry %d doesn't match the snapshot, got seq no %d", i, entries[i].SeqNo)
+			}
+		}
+	}
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	checkEntries(entries, 30)
+
+	// Writes continue after the highest provided seq no
+	wal.Write([]byte("after replace"))
+	wal.Close()
+
+	wal, err = Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+	if err != nil {
+		t.Fatalf("Failed to reopen WAL: %v", err)
+	}
+	defer wal.Close()
+	entries, err = wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	checkEntries(entries, 31)
+	if entries[30].SeqNo != 130 || string(entries[30].Data) != "after replace" {
+		t.Errorf("Expected the new entry with seq no 130, got %d", entries[30].SeqNo)
+	}
+}
+
+func TestReadFromGlobalOffset(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+	defer wal.Close()
+
+	for i := 0; i < 25; i++ {
+		wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+	first, cur, err := wal.ReadFromGlobalOffset(GlobalOffset{})
+	if err != nil {
+		t.Fatalf("ReadFromGlobalOffset failed: %v", err)
+	}
+
+	// Continue from the returned cursor after more writes, some in new segments
+	for i := 25; i < 50; i++ {
+		wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+	second, next, err := wal.ReadFromGlobalOffset(cur)
+	if err != nil {
+		t.Fatalf("ReadFromGlobalOffset failed: %v", err)
+	}
+	if next.Segment <= cur.Segment {
+		t.Errorf("Expected the cursor to move to a later segment, got %+v after %+v", next, cur)
+	}
+
+	all := append(first, second...)
+	if len(first) != 25 || len(all) != 50 {
+		t.Fatalf("Expected 25 then 50 entries, got %d and %d", len(first), len(all))
+	}
+	for i, entry := range all {
+		if entry.SeqNo != uint64(i+1) {
+			t.Fatalf("Expected seq no %d at position %d, got %d", i+1, i, entry.SeqNo)
+		}
+	}
+
+	// Nothing new to read at the end of the log
+	rest, last, err := wal.ReadFromGlobalOffset(next)
+	if err != nil || len(rest) != 0 || last != next {
+		t.Errorf("Expected no entries and the same cursor, got %d entries, %+v (%v)", len(rest), last, err)
+	}
+}
+
+func TestVerifySeqNo(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", VerifySeqNo: true})
+	defer wal.Close()
+
+	for i := 0; i < 10; i++ {
+		wal.Write([]byte("entry " + strconv.Itoa(i)))
+	}
+	wal.Sync()
+
+	// Altering the low byte of the seq no is caught by the checksum cross-check
+	entries, _ := wal.ReadAll()
+	tampered := entries[4].clone()
+	tampered.SeqNo++
+	data, _ := ProtobufCodec{}.Marshal(tampered)
+	if _, err := UnmarshalAndValidateEntry(data); !errors.Is(err, ErrSeqNoMismatch) {
+		t.Errorf("Expected ErrSeqNoMismatch from UnmarshalAndValidateEntry, got %v", err)
+	}
+	data, _ = ProtobufCodec{}.Marshal(entries[4])
+	if _, err := UnmarshalAndValidateEntry(data); err != nil {
+		t.Errorf("Expected the untouched entry to be valid, got %v", err)
+	}
+
+	// Entries written before HeaderChecked only cover the low byte of the seq no
+	wal.rewriteSegment(wal.file.Name(), func(entries []*Entry) []*Entry {
+		for _, entry := range entries {
+			entry.HeaderChecked = false
+			stampChecksum(wal.checksum, entry, entry.SeqNo)
+		}
+		return entries
+	})
+	tamper := func(delta uint64) {
+		t.Helper()
+		err := wal.rewriteSegment(wal.file.Name(), func(entries []*Entry) []*Entry {
+			entries[4].SeqNo += delta
+			return entries
+		})
+		if err != nil {
+			t.Fatalf("Failed to rewrite segment: %v", err)
+		}
+	}
+	// A change keeping the low byte passes the checksum, the contiguity check catches it
+	tamper(256)
+	if _, err := wal.ReadAll(); !errors.Is(err, ErrSeqNoMismatch) {
+		t.Errorf("Expected ErrSeqNoMismatch with VerifySeqNo, got %v", err)
+	}
+	wal.verifySeqNo = false
+	if _, err := wal.ReadAll(); err != nil {
+		t.Errorf("Expected the checksum alone to pass, got %v", err)
+	}
+
+	// Any other change is caught on read even without VerifySeqNo
+	tamper(1)
+	if _, err := wal.ReadAll(); !errors.Is(err, ErrSeqNoMismatch) {
+		t.Errorf("Expected ErrSeqNoMismatch on read, got %v", err)
+	}
+}
+
+func TestCopySegmentTo(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+	defer wal.Close()
+
+	for i := 0; i < 40; i++ {
+		wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+
+	// A sealed segment is copied as it is on disk
+	var buf bytes.Buffer
+	n, err := wal.CopySegmentTo(1, &buf)
+	if err != nil {
+		t.Fatalf("CopySegmentTo failed: %v", err)
+	}
+	onDisk, _ := os.ReadFile(filepath.Join(dir, segmentPrefix+"1"))
+	if n != int64(len(onDisk)) || !bytes.Equal(buf.Bytes(), onDisk) {
+		t.Errorf("Copied %d bytes not matching the %d bytes on disk", n, len(onDisk))
+	}
+
+	// The active segment is copied including the buffered entries
+	buf.Reset()
+	if _, err := wal.CopySegmentTo(wal.currentSegmentNo, &buf); err != nil {
+		t.Fatalf("CopySegmentTo failed: %v", err)
+	}
+	onDisk, _ = os.ReadFile(wal.file.Name())
+	if !bytes.Equal(buf.Bytes(), onDisk) {
+		t.Errorf("Copied %d bytes of the active segment, %d on disk", buf.Len(), len(onDisk))
+	}
+	if _, err := wal.CopySegmentTo(1000, &buf); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("Expected ErrSegmentNotFound, got %v", err)
+	}
+}
+
+func TestInstallSegment(t *testing.T) {
+	leader, _ := Open(&Options{LogDir: tempWalDir(t) + "/", MaxLogFileSize: 5 * 1024})
+	defer leader.Close()
+	follower, _ := Open(&Options{LogDir: tempWalDir(t) + "/", MaxLogFileSize: 5 * 1024})
+	defer follower.Close()
+
+	for i := 0; i < 40; i++ {
+		leader.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+	segmentNos, _ := leader.Segments()
+	if len(segmentNos) < 2 {
+		t.Fatalf("Expected multiple segments, got %v", segmentNos)
+	}
+	for _, segmentNo := range segmentNos {
+		var buf bytes.Buffer
+		if _, err := leader.CopySegmentTo(segmentNo, &buf); err != nil {
+			t.Fatalf("CopySegmentTo(%d) failed: %v", segmentNo, err)
+		}
+		if err := follower.InstallSegment(segmentNo, &buf); err != nil {
+			t.Fatalf("InstallSegment(%d) failed: %v", segmentNo, err)
+		}
+	}
+
+	leaderEntries, _ := leader.ReadAll()
+	followerEntries, err := follower.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(followerEntries) != len(leaderEntries) {
+		t.Fatalf("Expected %d entries on the follower, got %d", len(leaderEntries), len(followerEntries))
+	}
+	for i := range leaderEntries {
+		if fmt.Sprint(leaderEntries[i]) != fmt.Sprint(followerEntries[i]) {
+			t.Fatalf("Entry %d differs between leader and follower", i)
+		}
+	}
+
+	// A segment that doesn't continue the log is rejected
+	var buf bytes.Buffer
+	leader.CopySegmentTo(segmentNos[0], &buf)
+	if err := follower.InstallSegment(100, &buf); !errors.Is(err, ErrSegmentNotContiguous) {
+		t.Errorf("Expected ErrSegmentNotContiguous, got %v", err)
+	}
+
+	// The follower keeps writing after the installed entries
+	follower.Write([]byte("follower entry"))
+	follower.Sync()
+	followerEntries, _ = follower.ReadAll()
+	if last := followerEntries[len(followerEntries)-1]; last.SeqNo != 41 {
+		t.Errorf("Expected the next write to get seq no 41, got %d", last.SeqNo)
+	}
+}
+
+func TestWriteVersioned(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+
+	for i := 0; i < 9; i++ {
+		if err := wal.WriteVersioned(uint32(i%3+1), []byte("entry "+strconv.Itoa(i))); err != nil {
+			t.Fatalf("WriteVersioned failed: %v", err)
+		}
+	}
+	wal.Write([]byte("unversioned"))
+	wal.Sync()
+
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	v2 := []string{}
+	for _, entry := range entries {
+		if entry.UserVersion == 2 {
+			v2 = append(v2, string(entry.Data))
+		}
+	}
+	if len(v2) != 3 || v2[0] != "entry 1" || v2[1] != "entry 4" || v2[2] != "entry 7" {
+		t.Errorf("Expected the entries of version 2, got %v", v2)
+	}
+	if entries[9].UserVersion != 0 {
+		t.Errorf("Expected no version on a plain write, got %d", entries[9].UserVersion)
+	}
+
+	// The version is covered by the checksum
+	tampered := entries[0].clone()
+	tampered.UserVersion = 3
+	data, _ := ProtobufCodec{}.Marshal(tampered)
+	if _, err := UnmarshalAndValidateEntry(data); err == nil {
+		t.Errorf("Expected a changed version to fail validation")
+	}
+}
+
+func TestWaitForWrite(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+
+	wal.Write([]byte("before waiting"))
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		wal.Write([]byte("awaited"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	seqNo, err := wal.WaitForWrite(ctx)
+	if err != nil || seqNo != 2 {
+		t.Errorf("Expected WaitForWrite to return seq no 2, got %d (%v)", seqNo, err)
+	}
+
+	// The context bounds the wait
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := wal.WaitForWrite(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestTailAcrossRotation(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024, RecentCacheSize: 100})
+	defer wal.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	done := make(chan error)
+	seqNos := []uint64{}
+	go func() {
+		errDone := errors.New("done")
+		err := wal.Tail(ctx, 0, func(entry *Entry) error {
+			seqNos = append(seqNos, entry.SeqNo)
+			if len(seqNos) == 60 {
+				return errDone
+			}
+			return nil
+		})
+		if errors.Is(err, errDone) {
+			err = nil
+		}
+		done <- err
+	}()
+
+	for i := 0; i < 60; i++ {
+		wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+		if i%7 == 0 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("Tail failed: %v", err)
+	}
+	if wal.currentSegmentNo < 2 {
+		t.Fatalf("Expected the writes to rotate segments, at segment %d", wal.currentSegmentNo)
+	}
+	for i, seqNo := range seqNos {
+		if seqNo != uint64(i+1) {
+			t.Fatalf("Expected seq no %d at position %d, got %d", i+1, i, seqNo)
+		}
+	}
+
+	// Without the cache the tail is read from the segment files
+	wal.recentCache = nil
+	seqNos = seqNos[:0]
+	err := wal.Tail(ctx, 55, func(entry *Entry) error {
+		seqNos = append(seqNos, entry.SeqNo)
+		if len(seqNos) == 5 {
+			return context.Canceled
+		}
+		return nil
+	})
+	if !errors.Is(err, context.Canceled) || len(seqNos) != 5 || seqNos[0] != 56 {
+		t.Errorf("Expected entries 56..60 from disk, got %v (%v)", seqNos, err)
+	}
+}
+
+func FuzzDecodeFramed(f *testing.F) {
+	var valid bytes.Buffer
+	for i := 0; i < 3; i++ {
+		data := []byte("entry " + strconv.Itoa(i))
+		entry := &Entry{SeqNo: uint64(i + 1), Data: data}
+		entry.Checksum = entryChecksum(CRC32IEEE, entry, entry.SeqNo)
+		encodeEntry(&valid, ProtobufCodec{}, FramingFixed32, entry)
+	}
+	f.Add(valid.Bytes())
+	f.Add(valid.Bytes()[:valid.Len()-3])
+	f.Add([]byte{0xff, 0xff, 0xff, 0x7f, 1, 2, 3})
+	f.Add([]byte{})
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		for _, codec := range []EntryCodec{ProtobufCodec{}, RawCodec{}} {
+			for _, framing := range []FramingMode{FramingFixed32, FramingVarint} {
+				// Arbitrary input must never panic
+				DecodeFramed(b, codec, framing)
+
+				// Any payload round-trips
+				entry := &Entry{SeqNo: 7, Data: b, UserVersion: uint32(len(b))}
+				entry.Checksum = entryChecksum(CRC32IEEE, entry, entry.SeqNo)
+				var framed bytes.Buffer
+				if err := encodeEntry(&framed, codec, framing, entry); err != nil {
+					t.Fatalf("encodeEntry failed: %v", err)
+				}
+				entries, err := DecodeFramed(framed.Bytes(), codec, framing)
+				if err != nil {
+					t.Fatalf("DecodeFramed failed on a valid frame with %T and framing %d: %v", codec, framing, err)
+				}
+				if len(entries) != 1 || fmt.Sprint(entries[0]) != fmt.Sprint(entry) {
+					t.Fatalf("Round-trip mismatch for %d bytes of payload with %T and framing %d", len(b), codec, framing)
+				}
+			}
+		}
+	})
+}
+
+func TestEntryNonces(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", EntryNonces: true})
+
+	for i := 0; i < 10; i++ {
+		wal.Write([]byte("entry " + strconv.Itoa(i)))
+	}
+	wal.Close()
+	wal, _ = Open(&Options{LogDir: dir + "/", EntryNonces: true})
+	defer wal.Close()
+	for i := 10; i < 20; i++ {
+		wal.Write([]byte("entry " + strconv.Itoa(i)))
+	}
+	wal.Sync()
+
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].Nonce <= entries[i-1].Nonce {
+			t.Fatalf("Expected increasing nonces, got %d after %d", entries[i].Nonce, entries[i-1].Nonce)
+		}
+	}
+
+	// Replaying an older nonce is flagged even with a valid checksum
+	err = wal.rewriteSegment(wal.file.Name(), func(entries []*Entry) []*Entry {
+		entries[5].Nonce = entries[3].Nonce
+		entries[5].Checksum = entryChecksum(CRC32IEEE, entries[5], entries[5].SeqNo)
+		return entries
+	})
+	if err != nil {
+		t.Fatalf("Failed to rewrite segment: %v", err)
+	}
+	if _, err := wal.ReadAll(); !errors.Is(err, ErrNonceRegression) {
+		t.Errorf("Expected ErrNonceRegression, got %v", err)
+	}
+}
+
+func TestHas(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+	defer wal.Close()
+
+	for i := 0; i < 40; i++ {
+		wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100))
+	}
+	for _, seqNo := range []uint64{1, 17, 40} {
+		if ok, err := wal.Has(seqNo); err != nil || !ok {
+			t.Errorf("Expected seq no %d to be present, got %v (%v)", seqNo, ok, err)
+		}
+	}
+	for _, seqNo := range []uint64{0, 41, 1000} {
+		if ok, err := wal.Has(seqNo); err != nil || ok {
+			t.Errorf("Expected seq no %d to be out of range, got %v (%v)", seqNo, ok, err)
+		}
+	}
+
+	// Entries of a removed segment are gone
+	first, _, _ := wal.segmentFirstSeqNo(filepath.Join(dir, segmentPrefix+"2"))
+	os.Remove(filepath.Join(dir, segmentPrefix+"1"))
+	if ok, err := wal.Has(first - 1); err != nil || ok {
+		t.Errorf("Expected seq no %d to be trimmed, got %v (%v)", first-1, ok, err)
+	}
+	if ok, err := wal.Has(first); err != nil || !ok {
+		t.Errorf("Expected seq no %d to be present, got %v (%v)", first, ok, err)
+	}
+}
+
+func TestEmptyPayloadCheckpoint(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+
+	wal.Write([]byte("before"))
+	if err := wal.WriteWithCheckpoint(nil); err != nil {
+		t.Fatalf("WriteWithCheckpoint failed: %v", err)
+	}
+	wal.Write([]byte("after"))
+	wal.Sync()
+
+	check := func() {
+		t.Helper()
+		entries, err := wal.ReadAll()
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if len(entries) != 3 {
+			t.Fatalf("Expected 3 entries, got %d", len(entries))
+		}
+		if !entries[1].IsCheckpoint || len(entries[1].Data) != 0 || entries[1].SeqNo != 2 {
+			t.Errorf("Expected an empty checkpoint with seq no 2, got %v", entries[1])
+		}
+		if string(entries[2].Data) != "after" {
+			t.Errorf("Expected the entry after the checkpoint to be read")
+		}
+	}
+	check()
+
+	// A zero filled tail is the end of the entries, not an empty entry
+	file, _ := os.OpenFile(wal.file.Name(), os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write(make([]byte, 64))
+	file.Close()
+	check()
+}
+
+func TestMoveLog(t *testing.T) {
+	dir := tempWalDir(t)
+	newDir := filepath.Join(tempWalDir(t), "moved")
+	wal, err := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := MoveLog(dir, newDir); !errors.Is(err, ErrLogOpen) {
+		t.Fatalf("Expected ErrLogOpen while the log is open, got %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	segments, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+
+	if err := MoveLog(dir, newDir); err != nil {
+		t.Fatalf("MoveLog failed: %v", err)
+	}
+	if left, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*")); len(left) != 0 {
+		t.Errorf("Expected no segment left in the old directory, got %v", left)
+	}
+	for _, segment := range segments {
+		if _, err := os.Stat(filepath.Join(newDir, filepath.Base(segment))); err != nil {
+			t.Errorf("Expected %s in the new directory: %v", filepath.Base(segment), err)
+		}
+	}
+
+	wal, err = Open(&Options{LogDir: newDir + "/", MaxLogFileSize: 5 * 1024})
+	if err != nil {
+		t.Fatalf("Open after MoveLog failed: %v", err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 100 {
+		t.Fatalf("Expected 100 entries, got %d", len(entries))
+	}
+	if string(entries[99].Data) != "entry-99" {
+		t.Errorf("Expected entry-99, got %s", entries[99].Data)
+	}
+}
+
+// fixedCodec stores the metadata as fixed size fields in front of the payload
+type fixedCodec struct{}
+
+const fixedCodecHeaderSize = 37
+
+func (fixedCodec) Marshal(entry *Entry) ([]byte, error) {
+	b := make([]byte, fixedCodecHeaderSize, fixedCodecHeaderSize+len(entry.Data))
+	binary.LittleEndian.PutUint64(b[0:], entry.SeqNo)
+	binary.LittleEndian.PutUint32(b[8:], entry.Checksum)
+	binary.LittleEndian.PutUint64(b[12:], uint64(entry.TimestampUnixNano))
+	binary.LittleEndian.PutUint32(b[20:], entry.ChunkIndex)
+	binary.LittleEndian.PutUint32(b[24:], entry.UserVersion)
+	binary.LittleEndian.PutUint64(b[28:], entry.Nonce)
+	for i, flag := range []bool{entry.IsCheckpoint, entry.IsBarrier, entry.MoreChunks, entry.TimestampChecked, entry.HeaderChecked} {
+		if flag {
+			b[36] |= 1 << i
+		}
+	}
+	return append(b, entry.Data...), nil
+}
+
+func (fixedCodec) Unmarshal(b []byte) (*Entry, error) {
+	if len(b) < fixedCodecHeaderSize {
+		return nil, fmt.Errorf("entry of %d bytes is too short", len(b))
+	}
+	return &Entry{
+		SeqNo:             binary.LittleEndian.Uint64(b[0:]),
+		Data:              b[fixedCodecHeaderSize:],
+		Checksum:          binary.LittleEndian.Uint32(b[8:]),
+		TimestampUnixNano: int64(binary.LittleEndian.Uint64(b[12:])),
+		ChunkIndex:        binary.LittleEndian.Uint32(b[20:]),
+		UserVersion:       binary.LittleEndian.Uint32(b[24:]),
+		Nonce:             binary.LittleEndian.Uint64(b[28:]),
+		IsCheckpoint:      b[36]&1 != 0,
+		IsBarrier:         b[36]&2 != 0,
+		MoreChunks:        b[36]&4 != 0,
+		TimestampChecked:  b[36]&8 != 0,
+		HeaderChecked:     b[36]&16 != 0,
+	}, nil
+}
+
+func TestEntryCodecs(t *testing.T) {
+	entry := &Entry{SeqNo: 42, Data: []byte("payload"), Checksum: 0xdeadbeef, IsCheckpoint: true,
+		TimestampUnixNano: -5, IsBarrier: true, ChunkIndex: 2, MoreChunks: true, UserVersion: 7, Nonce: 1 << 40,
+		IsCompressed: true, UncompressedLength: 300, TxnId: 9, TxnCommit: true, ChecksumType: 2, ChecksumHigh: 11,
+		Compression: 1, CipherNonce: []byte("nonce"), TimestampChecked: true, HeaderChecked: true,
+	}
+	for name, codec := range map[string]EntryCodec{"protobuf": ProtobufCodec{}, "raw": RawCodec{}} {
+		t.Run(name, func(t *testing.T) {
+			b, err := codec.Marshal(entry)
+			if err != nil {
+				t.Fatalf("Marshal failed: %v", err)
+			}
+			decoded, err := codec.Unmarshal(b)
+			if err != nil {
+				t.Fatalf("Unmarshal failed: %v", err)
+			}
+			if fmt.Sprint(decoded) != fmt.Sprint(entry) {
+				t.Errorf("Expected %+v, got %+v", entry, decoded)
+			}
+			if _, err := codec.Unmarshal(b[:len(b)-len(entry.Data)-3]); err == nil {
+				t.Errorf("Expected a truncated entry to fail")
+			}
+
+			// The log reads back what it wrote with the codec
+			dir := tempWalDir(t)
+			wal, err := Open(&Options{LogDir: dir + "/", Codec: codec})
+			if err != nil {
+				t.Fatalf("Open failed: %v", err)
+			}
+			wal.Write([]byte("first"))
+			wal.WriteWithCheckpoint([]byte("checkpoint"))
+			wal.Close()
+			wal, err = Open(&Options{LogDir: dir + "/", Codec: codec})
+			if err != nil {
+				t.Fatalf("Reopen failed: %v", err)
+			}
+			defer wal.Close()
+			entries, err := wal.ReadAll()
+			if err != nil || len(entries) != 2 {
+				t.Fatalf("Expected 2 entries, got %d, %v", len(entries), err)
+			}
+			if string(entries[0].Data) != "first" || !entries[1].IsCheckpoint || entries[1].SeqNo != 2 {
+				t.Errorf("Expected the entries written, got %v", entries)
+			}
+		})
+	}
+
+	// The payload a codec stores may be compressed
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/", Codec: RawCodec{}, CompressEntries: true})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	wal.Write([]byte(strings.Repeat("raw", 100)))
+	wal.Sync()
+	if entries, err := wal.ReadAll(); err != nil || len(entries) != 1 || string(entries[0].Data) != strings.Repeat("raw", 100) {
+		t.Errorf("Expected the compressed entry read back, got %v, %v", entries, err)
+	}
+}
+
+func TestCustomCodec(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/", Codec: fixedCodec{}})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := wal.WriteWithCheckpoint([]byte("checkpoint")); err != nil {
+		t.Fatalf("WriteWithCheckpoint failed: %v", err)
+	}
+	if err := wal.WriteVersioned(3, []byte("versioned")); err != nil {
+		t.Fatalf("WriteVersioned failed: %v", err)
+	}
+	wal.Close()
+
+	// The protobuf codec can't make sense of the entries
+	protobufWal, err := Open(&Options{LogDir: dir + "/"})
+	if err == nil {
+		if _, err := protobufWal.ReadAll(); err == nil {
+			t.Errorf("Expected reading with the protobuf codec to fail")
+		}
+		protobufWal.Close()
+	}
+
+	wal, err = Open(&Options{LogDir: dir + "/", Codec: fixedCodec{}})
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 12 {
+		t.Fatalf("Expected 12 entries, got %d", len(entries))
+	}
+	for i := 0; i < 10; i++ {
+		if string(entries[i].Data) != fmt.Sprintf("entry-%d", i) || entries[i].SeqNo != uint64(i+1) {
+			t.Errorf("Expected entry-%d with seq no %d, got %s with %d", i, i+1, entries[i].Data, entries[i].SeqNo)
+		}
+	}
+	if !entries[10].IsCheckpoint || string(entries[10].Data) != "checkpoint" {
+		t.Errorf("Expected a checkpoint entry, got %v", entries[10])
+	}
+	if entries[11].UserVersion != 3 {
+		t.Errorf("Expected user version 3, got %d", entries[11].UserVersion)
+	}
+
+	// The framing around the entries doesn't depend on the codec
+	wal.Close()
+	if err := ConvertFraming(dir, FramingVarint); err != nil {
+		t.Fatalf("ConvertFraming failed: %v", err)
+	}
+	wal, err = Open(&Options{LogDir: dir + "/", Codec: fixedCodec{}})
+	if err != nil {
+		t.Fatalf("Reopen after ConvertFraming failed: %v", err)
+	}
+	defer wal.Close()
+	converted, err := wal.ReadAll()
+	if err != nil || len(converted) != len(entries) {
+		t.Fatalf("Expected %d entries after ConvertFraming, got %d, %v", len(entries), len(converted), err)
+	}
+	for i, entry := range converted {
+		if entry.SeqNo != entries[i].SeqNo || !bytes.Equal(entry.Data, entries[i].Data) ||
+			entry.IsCheckpoint != entries[i].IsCheckpoint || entry.UserVersion != entries[i].UserVersion {
+			t.Errorf("Expected entry %d unchanged by the framing, got %v", entries[i].SeqNo, entry)
+		}
+	}
+}
+
+func TestRecoverLastSeqNoAcrossSegments(t *testing.T) {
+	dir := tempWalDir(t)
+	options := &Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024}
+	wal, err := Open(options)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := wal.Write(bytes.Repeat([]byte("x"), 1000)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := wal.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+	}
+	segments, err := wal.Segments()
+	if err != nil {
+		t.Fatalf("Segments failed: %v", err)
+	}
+	if len(segments) < 3 {
+		t.Fatalf("Expected entries spread across at least 3 segments, got %d", len(segments))
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	wal, err = Open(options)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer wal.Close()
+	if err := wal.Write([]byte("after reopen")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	wal.Sync()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 11 {
+		t.Fatalf("Expected 11 entries, got %d", len(entries))
+	}
+	if last := entries[len(entries)-1]; last.SeqNo != 11 || string(last.Data) != "after reopen" {
+		t.Errorf("Expected the write after reopen to get seq no 11, got %d", last.SeqNo)
+	}
+}
+
+func TestRecoverLastSeqNoWithCorruptedEntry(t *testing.T) {
+	dir := tempWalDir(t) + "/"
+	wal, _ := Open(&Options{LogDir: dir})
+	for i := 1; i <= 5; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+	}
+	wal.Close()
+
+	// A corrupted entry in the middle of the log isn't a torn tail, the entries after it still count
+	segmentPath := dir + segmentPrefix + "1"
+	content, _ := os.ReadFile(segmentPath)
+	content[bytes.Index(content, []byte("entry-3"))] = 'E'
+	os.WriteFile(segmentPath, content, 0644)
+
+	if _, err := Open(&Options{LogDir: dir}); err == nil {
+		t.Fatalf("Expected Open to fail on the corrupted entry")
+	}
+	// The failed Open released the directory, nothing holds it open anymore
+	lock, err := lockLogDir(dir, true)
+	if err != nil {
+		t.Fatalf("Failed Open left the log directory locked: %v", err)
+	}
+	unlockLogDir(lock)
+	wal, err = Open(&Options{LogDir: dir, OnCorruption: CorruptSkip})
+	if err != nil {
+		t.Fatalf("Open with CorruptSkip failed: %v", err)
+	}
+	defer wal.Close()
+	if wal.lastSeqNo != 5 {
+		t.Errorf("Expected the last seq no 5, got %d", wal.lastSeqNo)
+	}
+	wal.Write([]byte("entry-6"))
+	wal.Sync()
+	entries, _ := wal.ReadAll()
+	seqNos := []uint64{}
+	for _, entry := range entries {
+		seqNos = append(seqNos, entry.SeqNo)
+	}
+	if !slices.Equal(seqNos, []uint64{1, 2, 4, 5, 6}) {
+		t.Errorf("Expected the write to follow the last entry, got %v", seqNos)
+	}
+}
+
+func TestRechecksumLog(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := wal.Write(bytes.Repeat([]byte{byte('a' + i)}, 1000)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		wal.Sync()
+	}
+	// The entries record ChecksumCRC32IEEE, which the conversion replaces
+	if entries, _ := wal.ReadAll(); ChecksumType(entries[0].ChecksumType) != ChecksumCRC32IEEE {
+		t.Fatalf("Expected the entries to record ChecksumCRC32IEEE, got %d", entries[0].ChecksumType)
+	}
+	if err := RechecksumLog(dir, CRC32IEEE, CRC32C); !errors.Is(err, ErrLogOpen) {
+		t.Fatalf("Expected ErrLogOpen while the log is open, got %v", err)
+	}
+	wal.Close()
+
+	if err := RechecksumLog(dir, CRC32IEEE, CRC32C); err != nil {
+		t.Fatalf("RechecksumLog failed: %v", err)
+	}
+	// Converting again keeps the entries already converted
+	if err := RechecksumLog(dir, CRC32IEEE, CRC32C); err != nil {
+		t.Fatalf("Second RechecksumLog failed: %v", err)
+	}
+
+	wal, err = Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, Checksum: CRC32C})
+	if err != nil {
+		t.Fatalf("Open with CRC32C failed: %v", err)
+	}
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll with CRC32C failed: %v", err)
+	}
+	if len(entries) != 10 {
+		t.Fatalf("Expected 10 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if !bytes.Equal(entry.Data, bytes.Repeat([]byte{byte('a' + i)}, 1000)) {
+			t.Errorf("Entry %d has unexpected data", i)
+		}
+		if ChecksumType(entry.ChecksumType) != ChecksumConfigured {
+			t.Errorf("Expected entry %d converted to the configured checksum, got type %d", i, entry.ChecksumType)
+		}
+	}
+	wal.Close()
+
+	if _, err := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024}); err == nil {
+		t.Errorf("Expected Open with the old checksum to fail")
+	}
+}
+
+// failingWriter fails every write
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("replica unavailable")
+}
+
+func TestReplicaSink(t *testing.T) {
+	dir := tempWalDir(t)
+	var replica bytes.Buffer
+	wal, err := Open(&Options{LogDir: dir + "/", ReplicaSink: &replica})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	wal.WriteWithCheckpoint([]byte("checkpoint"))
+	wal.Close()
+
+	entries, err := DecodeFramed(replica.Bytes(), ProtobufCodec{}, FramingFixed32)
+	if err != nil {
+		t.Fatalf("DecodeFramed of the replica stream failed: %v", err)
+	}
+	if len(entries) != 21 {
+		t.Fatalf("Expected 21 entries on the replica, got %d", len(entries))
+	}
+	for i, entry := range entries[:20] {
+		if entry.SeqNo != uint64(i+1) || string(entry.Data) != fmt.Sprintf("entry-%d", i) {
+			t.Errorf("Expected entry-%d with seq no %d, got %s with %d", i, i+1, entry.Data, entry.SeqNo)
+		}
+	}
+	if !entries[20].IsCheckpoint {
+		t.Errorf("Expected the checkpoint flag on the replica")
+	}
+
+	// A failing replica only fails the writes when asked to
+	lenient, _ := Open(&Options{LogDir: tempWalDir(t) + "/", ReplicaSink: failingWriter{}})
+	defer lenient.Close()
+	if err := lenient.Write([]byte("data")); err != nil {
+		t.Errorf("Expected the write to succeed despite the replica, got %v", err)
+	}
+	strict, _ := Open(&Options{LogDir: tempWalDir(t) + "/", ReplicaSink: failingWriter{}, FailOnReplicaError: true})
+	defer strict.Close()
+	if err := strict.Write([]byte("data")); err == nil {
+		t.Errorf("Expected the write to fail with the replica")
+	}
+	if entries, _ := strict.ReadAll(); len(entries) != 0 {
+		t.Errorf("Expected no local entry after a failed replica write, got %d", len(entries))
+	}
+}
+
+func TestFramedSize(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+
+	for _, size := range []int{0, 1, 100, 127, 128, 1000, 20000} {
+		data := bytes.Repeat([]byte("x"), size)
+		predicted := wal.FramedSize(data)
+		before, _ := os.Stat(wal.file.Name())
+		if err := wal.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := wal.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+		after, _ := os.Stat(wal.file.Name())
+		// The checksum is counted at its largest, it takes 1 to 5 bytes
+		if written := int(after.Size() - before.Size()); written > predicted || written < predicted-4 {
+			t.Errorf("Payload of %d bytes: FramedSize predicted %d bytes, %d were written", size, predicted, written)
+		}
+	}
+}
+
+func TestOpenRetries(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	wal.Write([]byte("data"))
+	wal.Close()
+
+	failures := 0
+	lockedOnce := func(name string, flag int, perm os.FileMode) (File, error) {
+		if flag&os.O_APPEND != 0 && failures == 0 {
+			failures++
+			return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("file is locked")}
+		}
+		return os.OpenFile(name, flag, perm)
+	}
+	if _, err := Open(&Options{LogDir: dir + "/", openFile: lockedOnce}); err == nil {
+		t.Fatalf("Expected Open without retries to fail")
+	}
+
+	failures = 0
+	wal, err := Open(&Options{LogDir: dir + "/", openFile: lockedOnce, OpenRetries: 3, OpenRetryBackoff: time.Millisecond})
+	if err != nil {
+		t.Fatalf("Expected Open to succeed after a retry, got %v", err)
+	}
+	defer wal.Close()
+	if failures != 1 {
+		t.Errorf("Expected 1 failed open, got %d", failures)
+	}
+	if err := wal.Write([]byte("after retry")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	wal.Sync()
+	if entries, _ := wal.ReadAll(); len(entries) != 2 {
+		t.Errorf("Expected 2 entries, got %d", len(entries))
+	}
+}
+
+func TestCloseStopsSubscribers(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+
+	received := []uint64{}
+	consumerDone := make(chan struct{})
+	entries := wal.Subscribe(context.Background(), 0)
+	go func() {
+		defer close(consumerDone)
+		for entry := range entries {
+			received = append(received, entry.SeqNo)
+		}
+	}()
+	tailErr := make(chan error, 1)
+	go func() {
+		tailErr <- wal.Tail(context.Background(), 0, func(*Entry) error { return nil })
+	}()
+
+	for i := 0; i < 5; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	select {
+	case <-consumerDone:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the subscription channel to close on Close")
+	}
+	if len(received) != 5 || received[4] != 5 {
+		t.Errorf("Expected the 5 entries written before Close, got %v", received)
+	}
+	select {
+	case err := <-tailErr:
+		if !errors.Is(err, ErrClosed) {
+			t.Errorf("Expected Tail to return ErrClosed, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Tail to return on Close")
+	}
+	if _, err := wal.WaitForWrite(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected WaitForWrite to return ErrClosed, got %v", err)
+	}
+}
+
+func TestSegmentGap(t *testing.T) {
+	dir := tempWalDir(t)
+	options := &Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024}
+	wal, _ := Open(options)
+	for i := 0; i < 10; i++ {
+		if err := wal.Write(bytes.Repeat([]byte("x"), 1000)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		wal.Sync()
+	}
+	if wal.currentSegmentNo < 3 {
+		t.Fatalf("Expected at least 3 segments, got %d", wal.currentSegmentNo)
+	}
+	wal.Close()
+	if err := os.Remove(filepath.Join(dir, segmentPrefix+"2")); err != nil {
+		t.Fatalf("Failed to remove segment 2: %v", err)
+	}
+
+	var gapErr *ErrSegmentGap
+	if _, err := Open(options); !errors.As(err, &gapErr) {
+		t.Fatalf("Expected ErrSegmentGap, got %v", err)
+	}
+	if len(gapErr.Missing) != 1 || gapErr.Missing[0] != 2 {
+		t.Errorf("Expected segment 2 to be reported missing, got %v", gapErr.Missing)
+	}
+
+	wal, err := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, OnSegmentGap: SegmentGapWarn})
+	if err != nil {
+		t.Fatalf("Open with SegmentGapWarn failed: %v", err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll with SegmentGapWarn failed: %v", err)
+	}
+	if len(entries) == 0 || len(entries) >= 10 {
+		t.Errorf("Expected the entries of the remaining segments, got %d", len(entries))
+	}
+}
+
+func TestOrderingMode(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	for i := 1; i <= 5; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	wal.Sync()
+	// Store entry 3 before entry 2
+	wal.locker.Lock()
+	err := wal.rewriteSegment(wal.file.Name(), func(entries []*Entry) []*Entry {
+		entries[1], entries[2] = entries[2], entries[1]
+		return entries
+	})
+	wal.locker.Unlock()
+	if err != nil {
+		t.Fatalf("rewriteSegment failed: %v", err)
+	}
+	wal.Close()
+
+	seqNos := func(entries []*Entry) []uint64 {
+		seqs := []uint64{}
+		for _, entry := range entries {
+			seqs = append(seqs, entry.SeqNo)
+		}
+		return seqs
+	}
+
+	strict, _ := Open(&Options{LogDir: dir + "/", OrderingMode: OrderingStrict})
+	if _, err := strict.ReadAll(); !errors.Is(err, ErrOutOfOrder) {
+		t.Errorf("Expected ErrOutOfOrder in strict mode, got %v", err)
+	}
+	strict.Close()
+
+	lenient, _ := Open(&Options{LogDir: dir + "/", OrderingMode: OrderingLenient})
+	entries, err := lenient.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll in lenient mode failed: %v", err)
+	}
+	if got := fmt.Sprint(seqNos(entries)); got != "[1 2 3 4 5]" {
+		t.Errorf("Expected the entries sorted in lenient mode, got %s", got)
+	}
+	lenient.Close()
+
+	asStored, _ := Open(&Options{LogDir: dir + "/"})
+	defer asStored.Close()
+	entries, err = asStored.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if got := fmt.Sprint(seqNos(entries)); got != "[1 3 2 4 5]" {
+		t.Errorf("Expected the entries as stored by default, got %s", got)
+	}
+}
+
+func TestPrefetch(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024})
+	defer wal.Close()
+	for i := 0; i < 10; i++ {
+		if err := wal.Write(bytes.Repeat([]byte("x"), 1000)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		wal.Sync()
+	}
+	if segments, _ := wal.Segments(); len(segments) < 2 {
+		t.Fatalf("Expected multiple segments, got %d", len(segments))
+	}
+	if err := wal.Prefetch(); err != nil {
+		t.Fatalf("Prefetch failed: %v", err)
+	}
+	if entries, _ := wal.ReadAll(); len(entries) != 10 {
+		t.Errorf("Expected 10 entries after Prefetch, got %d", len(entries))
+	}
+}
+
+func TestSegmentMetaEntries(t *testing.T) {
+	dir := tempWalDir(t)
+	start := time.Now().UnixNano()
+	options := &Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, SegmentMetaEntries: true}
+	wal, _ := Open(options)
+	for i := 0; i < 10; i++ {
+		if err := wal.Write(bytes.Repeat([]byte("x"), 1000)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		wal.Sync()
+	}
+	if wal.currentSegmentNo < 2 {
+		t.Fatalf("Expected the writes to rotate the segment")
+	}
+	wal.Close()
+
+	wal, err := Open(options)
+	if err != nil {
+		t.Fatalf("Reopen failed: %v", err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 10 || entries[0].SeqNo != 1 || entries[9].SeqNo != 10 {
+		t.Fatalf("Expected the 10 entries without the segment descriptions, got %d", len(entries))
+	}
+
+	first, err := wal.ReadSegmentMeta(1)
+	if err != nil {
+		t.Fatalf("ReadSegmentMeta(1) failed: %v", err)
+	}
+	rotated, err := wal.ReadSegmentMeta(2)
+	if err != nil {
+		t.Fatalf("ReadSegmentMeta(2) failed: %v", err)
+	}
+	if first == nil || rotated == nil {
+		t.Fatalf("Expected both segments to be described, got %v and %v", first, rotated)
+	}
+	segmentEntries, _ := wal.ReadSegment(2)
+	if rotated.GetSegmentId() != 2 {
+		t.Errorf("Expected segment ID 2, got %d", rotated.GetSegmentId())
+	}
+	if rotated.GetFirstSeqNo() != segmentEntries[0].SeqNo {
+		t.Errorf("Expected first seq no %d, got %d", segmentEntries[0].SeqNo, rotated.GetFirstSeqNo())
+	}
+	if rotated.GetCreatedUnixNano() < start || rotated.GetCreatedUnixNano() > time.Now().UnixNano() {
+		t.Errorf("Unexpected creation time %d", rotated.GetCreatedUnixNano())
+	}
+	if rotated.GetConfigHash() == 0 || rotated.GetConfigHash() != first.GetConfigHash() {
+		t.Errorf("Expected the same config hash in both segments, got %d and %d", first.GetConfigHash(), rotated.GetConfigHash())
+	}
+
+	plain, _ := Open(&Options{LogDir: tempWalDir(t) + "/"})
+	defer plain.Close()
+	plain.Write([]byte("data"))
+	if segmentMeta, err := plain.ReadSegmentMeta(1); err != nil || segmentMeta != nil {
+		t.Errorf("Expected no description without SegmentMetaEntries, got %v, %v", segmentMeta, err)
+	}
+}
+
+func TestFlushOnlyWithoutFsync(t *testing.T) {
+	unsupported := func(file File) error {
+		return &os.PathError{Op: "sync", Path: file.Name(), Err: syscall.ENOTSUP}
+	}
+
+	strict, _ := Open(&Options{LogDir: tempWalDir(t) + "/", fsync: unsupported})
+	defer strict.Close()
+	strict.Write([]byte("data"))
+	var syncErr *ErrFileSync
+	if err := strict.Sync(); !errors.As(err, &syncErr) {
+		t.Errorf("Expected ErrFileSync without the fallback, got %v", err)
+	}
+
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, FlushOnlyWithoutFsync: true, fsync: unsupported})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if !wal.flushOnly {
+		t.Fatalf("Expected the WAL to fall back to flush-only durability")
+	}
+	for i := 0; i < 10; i++ {
+		if err := wal.Write(bytes.Repeat([]byte("x"), 1000)); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if err := wal.Sync(); err != nil {
+			t.Fatalf("Sync failed: %v", err)
+		}
+	}
+	if err := wal.WriteWithCheckpoint([]byte("checkpoint")); err != nil {
+		t.Fatalf("WriteWithCheckpoint failed: %v", err)
+	}
+	if wal.currentSegmentNo < 2 {
+		t.Errorf("Expected the writes to rotate the segment")
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	wal, _ = Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+	if entries, _ := wal.ReadAll(); len(entries) != 11 {
+		t.Errorf("Expected 11 entries, got %d", len(entries))
+	}
+}
+
+func TestWriteRaw(t *testing.T) {
+	source, _ := Open(&Options{LogDir: tempWalDir(t) + "/", EntryNonces: true})
+	defer source.Close()
+	for i := 0; i < 10; i++ {
+		if err := source.Write([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	source.WriteWithCheckpoint([]byte("checkpoint"))
+	source.Sync()
+	entries, _ := source.ReadAll()
+
+	dir := tempWalDir(t)
+	target, _ := Open(&Options{LogDir: dir + "/", VerifyRawChecksums: true})
+	for _, entry := range entries {
+		if err := target.WriteRaw(entry); err != nil {
+			t.Fatalf("WriteRaw(%d) failed: %v", entry.SeqNo, err)
+		}
+	}
+	if err := target.WriteRaw(entries[3]); err == nil {
+		t.Errorf("Expected an error for a seq no already in the log")
+	}
+	if err := target.WriteRaw(nil); err == nil {
+		t.Errorf("Expected an error for a nil entry")
+	}
+	tampered := *entries[0]
+	tampered.SeqNo = 100
+	tampered.Data = []byte("tampered")
+	if err := target.WriteRaw(&tampered); err == nil {
+		t.Errorf("Expected an error for an entry with an invalid checksum")
+	}
+	// Written entries continue after the forwarded ones
+	if err := target.Write([]byte("local")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	target.Close()
+
+	target, _ = Open(&Options{LogDir: dir + "/"})
+	defer target.Close()
+	forwarded, err := target.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(forwarded) != len(entries)+1 {
+		t.Fatalf("Expected %d entries, got %d", len(entries)+1, len(forwarded))
+	}
+	for i, entry := range entries {
+		if fmt.Sprint(entry) != fmt.Sprint(forwarded[i]) {
+			t.Errorf("Entry %d changed when forwarded: %v != %v", i, forwarded[i], entry)
+		}
+	}
+	if last := forwarded[len(forwarded)-1]; last.SeqNo != uint64(len(entries)+1) {
+		t.Errorf("Expected the local write to get seq no %d, got %d", len(entries)+1, last.SeqNo)
+	}
+}
+
+func TestMaxTotalEntries(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, MaxTotalEntries: 10})
+	data := make([]byte, 1000)
+	for i := 0; i < 30; i++ {
+		if err := wal.Write(data); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		wal.Sync()
+	}
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	// Up to a quarter of the limit waits for the next trim
+	if len(entries) < 10 || len(entries) > 10+10/4 {
+		t.Fatalf("Expected 10 to 12 entries, got %d", len(entries))
+	}
+	first := uint64(31 - len(entries))
+	for i, entry := range entries {
+		if entry.SeqNo != first+uint64(i) {
+			t.Errorf("Expected entry %d to have seq no %d, got %d", i, first+uint64(i), entry.SeqNo)
+		}
+	}
+	wal.Close()
+
+	// The front of a single segment isn't rewritten on every write
+	wal, _ = Open(&Options{LogDir: tempWalDir(t) + "/", MaxTotalEntries: 40})
+	for i := 0; i < 100; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if wal.segmentRewrites > 10 {
+		t.Errorf("Expected at most 10 rewrites of the segment, got %d", wal.segmentRewrites)
+	}
+	wal.Sync()
+	entries, _ = wal.ReadAll()
+	if len(entries) < 40 || len(entries) > 40+40/4 || entries[len(entries)-1].SeqNo != 100 {
+		t.Errorf("Expected 40 to 50 entries ending at seq no 100, got %d", len(entries))
+	}
+	wal.Close()
+
+	// The entries from the last checkpoint on are kept even beyond the limit
+	wal, _ = Open(&Options{LogDir: tempWalDir(t) + "/", MaxTotalEntries: 5})
+	defer wal.Close()
+	for i := 0; i < 5; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+	}
+	wal.WriteWithCheckpoint([]byte("checkpoint"))
+	for i := 0; i < 7; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+	}
+	wal.Sync()
+	entries, err = wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 8 || !entries[0].IsCheckpoint {
+		t.Fatalf("Expected the checkpoint and the 7 entries after it, got %d entries", len(entries))
+	}
+}
+
+func TestEstimateRecovery(t *testing.T) {
+	dir := tempWalDir(t)
+	if _, err := EstimateRecovery(dir); !errors.Is(err, ErrNoSegments) {
+		t.Errorf("Expected ErrNoSegments for an empty directory, got %v", err)
+	}
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024})
+	for i := 0; i < 10; i++ {
+		wal.Write(make([]byte, 1000))
+		wal.Sync()
+	}
+	wal.Close()
+
+	logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	if len(logFiles) < 2 {
+		t.Fatalf("Expected several segments, got %d", len(logFiles))
+	}
+	var total int64
+	for _, logFile := range logFiles {
+		fileInfo, _ := os.Stat(logFile)
+		total += fileInfo.Size()
+	}
+	lastInfo, _ := os.Stat(logFiles[len(logFiles)-1])
+
+	estimate, err := EstimateRecovery(dir)
+	if err != nil {
+		t.Fatalf("EstimateRecovery failed: %v", err)
+	}
+	if estimate.TotalBytes != total || estimate.LastSegmentBytes != lastInfo.Size() {
+		t.Errorf("Expected %d total and %d last segment bytes, got %+v", total, lastInfo.Size(), estimate)
+	}
+	// Recovery scans every segment
+	if estimate.ScanBytes != total {
+		t.Errorf("Expected a full scan of %d bytes, got %+v", total, estimate)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	errTooLong := errors.New("payload too long")
+	wal, _ := Open(&Options{LogDir: tempWalDir(t) + "/", Validate: func(data []byte) error {
+		if len(data) > 8 {
+			return errTooLong
+		}
+		return nil
+	}})
+	defer wal.Close()
+
+	if err := wal.Write([]byte("short")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := wal.Write([]byte("way too long")); !errors.Is(err, errTooLong) {
+		t.Errorf("Expected the validator error, got %v", err)
+	}
+	if err := wal.WriteLarge([]byte("way too long")); !errors.Is(err, errTooLong) {
+		t.Errorf("Expected the validator error from WriteLarge, got %v", err)
+	}
+	if wal.lastSeqNo != 1 {
+		t.Errorf("Expected the seq no to stay at 1, got %d", wal.lastSeqNo)
+	}
+	wal.Write([]byte("next"))
+	wal.Sync()
+	entries, _ := wal.ReadAll()
+	if len(entries) != 2 || entries[1].SeqNo != 2 {
+		t.Errorf("Expected the rejected writes to leave no entry or gap, got %v", entries)
+	}
+}
+
+func TestReadAllDeadline(t *testing.T) {
+	wal, _ := Open(&Options{LogDir: tempWalDir(t) + "/"})
+	defer wal.Close()
+	for i := 0; i < 1000; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+	}
+	wal.Sync()
+
+	entries, complete, err := wal.ReadAllDeadline(time.Nanosecond)
+	if err != nil {
+		t.Fatalf("ReadAllDeadline failed: %v", err)
+	}
+	if complete || len(entries) == 0 || len(entries) >= 1000 {
+		t.Errorf("Expected partial results, got %d entries, complete %v", len(entries), complete)
+	}
+	for i, entry := range entries {
+		if entry.SeqNo != uint64(i+1) {
+			t.Errorf("Expected entry %d to have seq no %d, got %d", i, i+1, entry.SeqNo)
+		}
+	}
+
+	entries, complete, err = wal.ReadAllDeadline(time.Minute)
+	if err != nil || !complete || len(entries) != 1000 {
+		t.Errorf("Expected all 1000 entries, got %d entries, complete %v, error %v", len(entries), complete, err)
+	}
+}
+
+func TestCheckpointDurable(t *testing.T) {
+	wal, _ := Open(&Options{LogDir: tempWalDir(t) + "/"})
+	defer wal.Close()
+	wal.Write([]byte("first"))
+	wal.Write([]byte("second"))
+
+	seqNo, err := wal.CheckpointDurable()
+	if err != nil {
+		t.Fatalf("CheckpointDurable failed: %v", err)
+	}
+	if seqNo != 3 {
+		t.Errorf("Expected the checkpoint seq no 3, got %d", seqNo)
+	}
+	// Read the segment behind the WAL's back, nothing may be left in the buffer
+	content, err := os.ReadFile(wal.file.Name())
+	if err != nil {
+		t.Fatalf("Failed to read the segment: %v", err)
+	}
+	entries, err := DecodeFramed(content[segmentHeaderSize:], ProtobufCodec{}, FramingFixed32)
+	if err != nil {
+		t.Fatalf("DecodeFramed failed: %v", err)
+	}
+	if len(entries) != 3 || !entries[2].IsCheckpoint || entries[2].SeqNo != seqNo {
+		t.Errorf("Expected the checkpoint on disk after the writes, got %v", entries)
+	}
+}
+
+func TestDirRotation(t *testing.T) {
+	dir := tempWalDir(t)
+	nextDir := tempWalDir(t)
+	options := &Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, maxSegments: 9,
+		DirRotation: []string{nextDir}, DirRotationBytes: 6000}
+	wal, _ := Open(options)
+	for i := 0; i < 15; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, make([]byte, 1000)))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		wal.Sync()
+	}
+	wal.Close()
+
+	first, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	second, err := listSegmentFiles(osFS{}, filepath.Join(nextDir, segmentPrefix))
+	if err != nil {
+		t.Fatalf("Expected segments in the second directory: %v", err)
+	}
+	lastInFirst, _ := parseSegmentNo(first[len(first)-1])
+	firstInSecond, _ := parseSegmentNo(second[0])
+	if firstInSecond != lastInFirst+1 {
+		t.Errorf("Expected the second directory to continue at segment %d, got %d", lastInFirst+1, firstInSecond)
+	}
+
+	// Reopened, the reads span both directories and the writes go on in the second one
+	wal, _ = Open(options)
+	defer wal.Close()
+	wal.Write([]byte("after reopen"))
+	wal.Sync()
+	if filepath.Dir(wal.file.Name()) != filepath.Clean(nextDir) {
+		t.Errorf("Expected to append in %s, got %s", nextDir, wal.file.Name())
+	}
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 16 {
+		t.Fatalf("Expected 16 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.SeqNo != uint64(i+1) {
+			t.Errorf("Expected entry %d to have seq no %d, got %d", i, i+1, entry.SeqNo)
+		}
+	}
+
+	// Each directory is filled up to the threshold on its own, not counting the ones before it
+	dirs := []string{tempWalDir(t), tempWalDir(t), tempWalDir(t)}
+	wal3, _ := Open(&Options{LogDir: dirs[0] + "/", MaxLogFileSize: 8 * 1024, maxSegments: 20,
+		DirRotation: dirs[1:], DirRotationBytes: 10000})
+	defer wal3.Close()
+	for i := 0; i < 40; i++ {
+		wal3.Write([]byte(fmt.Sprintf("entry-%d-%s", i, make([]byte, 1000))))
+		wal3.Sync()
+	}
+	for i, d := range dirs {
+		logFiles, err := listSegmentFiles(osFS{}, filepath.Join(d, segmentPrefix))
+		if err != nil {
+			t.Fatalf("Expected segments in directory %d: %v", i, err)
+		}
+		if i == len(dirs)-1 {
+			break
+		}
+		var total int64
+		for _, logFile := range logFiles {
+			fileInfo, _ := os.Stat(logFile)
+			total += fileInfo.Size()
+		}
+		if total <= 10000 {
+			t.Errorf("Expected directory %d to hold over 10000 bytes before rotating, got %d", i, total)
+		}
+	}
+}
+
+func TestVerifyActiveFlushed(t *testing.T) {
+	wal, _ := Open(&Options{LogDir: tempWalDir(t) + "/"})
+	defer wal.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		// Payloads of varying sizes make the buffer flush in the middle of entries
+		for i := 0; i < 2000; i++ {
+			wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, strings.Repeat("x", i%700))))
+		}
+	}()
+	for running := true; running; {
+		select {
+		case <-done:
+			running = false
+		default:
+		}
+		if err := wal.VerifyActiveFlushed(); err != nil {
+			t.Fatalf("VerifyActiveFlushed reported corruption: %v", err)
+		}
+	}
+
+	// A corrupted flushed entry is reported
+	wal.Sync()
+	content, _ := os.ReadFile(wal.file.Name())
+	content[segmentHeaderSize+10] ^= 0xFF
+	os.WriteFile(wal.file.Name(), content, 0644)
+	if err := wal.VerifyActiveFlushed(); err == nil {
+		t.Errorf("Expected VerifyActiveFlushed to report the corrupted entry")
+	}
+}
+
+func TestWriteHooks(t *testing.T) {
+	errRejected := errors.New("rejected")
+	written := []uint64{}
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/",
+		BeforeWrite: func(entry *Entry) error {
+			if string(entry.Data) == "reject" {
+				return errRejected
+			}
+			entry.UserVersion = 7
+			return nil
+		},
+		AfterWrite: func(entry *Entry) {
+			written = append(written, entry.SeqNo)
+		},
+	})
+	wal.Write([]byte("first"))
+	if err := wal.Write([]byte("reject")); !errors.Is(err, errRejected) {
+		t.Errorf("Expected the BeforeWrite error, got %v", err)
+	}
+	wal.Write([]byte("second"))
+	wal.Close()
+
+	if !slices.Equal(written, []uint64{1, 2}) {
+		t.Errorf("Expected AfterWrite to see seq nos [1 2], got %v", written)
+	}
+	// The stamped metadata is covered by the checksum and read back
+	wal, _ = Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.UserVersion != 7 {
+			t.Errorf("Expected entry %d to have user version 7, got %d", entry.SeqNo, entry.UserVersion)
+		}
+	}
+}
+
+func TestOpenRange(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024})
+	for segments, _ := wal.Segments(); len(segments) < 5; segments, _ = wal.Segments() {
+		wal.Write(make([]byte, 1000))
+		wal.Sync()
+	}
+	from, _, _ := wal.segmentFirstSeqNo(filepath.Join(dir, segmentPrefix+"2"))
+	to, _, _ := wal.segmentFirstSeqNo(filepath.Join(dir, segmentPrefix+"4"))
+	wal.Close()
+
+	reader, err := OpenRange(dir, 2, 3, nil)
+	if err != nil {
+		t.Fatalf("OpenRange failed: %v", err)
+	}
+	defer reader.Close()
+	entries, err := reader.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != int(to-from) {
+		t.Fatalf("Expected the %d entries of segments 2 and 3, got %d", to-from, len(entries))
+	}
+	for i, entry := range entries {
+		if entry.SeqNo != from+uint64(i) {
+			t.Errorf("Expected entry %d to have seq no %d, got %d", i, from+uint64(i), entry.SeqNo)
+		}
+	}
+
+	if _, err := OpenRange(dir, 7, 9, nil); !errors.Is(err, ErrSegmentNotFound) {
+		t.Errorf("Expected ErrSegmentNotFound for a range without segments, got %v", err)
+	}
+}
+
+func TestWatermark(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	if watermark, err := wal.Watermark(); err != nil || watermark != 0 {
+		t.Errorf("Expected no watermark yet, got %d, error %v", watermark, err)
+	}
+	if err := wal.SetWatermark(42); err != nil {
+		t.Fatalf("SetWatermark failed: %v", err)
+	}
+	wal.Close()
+
+	wal, _ = Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+	if watermark, err := wal.Watermark(); err != nil || watermark != 42 {
+		t.Errorf("Expected the watermark 42 after reopening, got %d, error %v", watermark, err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, watermarkFileName+".tmp")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected no temporary file left behind, got %v", err)
+	}
+}
+
+func TestCompressEntries(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", CompressEntries: true})
+	payload := []byte(strings.Repeat("compressible payload ", 100))
+	wal.Write(payload)
+	wal.Write([]byte("second"))
+	wal.Sync()
+
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 2 || !bytes.Equal(entries[0].Data, payload) || entries[0].IsCompressed {
+		t.Fatalf("Expected the payloads back decompressed, got %v", entries)
+	}
+	stored, _ := wal.readSegment(wal.file.Name())
+	if !stored[0].IsCompressed || len(stored[0].Data) >= len(payload) ||
+		stored[0].UncompressedLength != uint32(len(payload)) {
+		t.Fatalf("Expected the payload stored compressed with its length, got %d bytes", len(stored[0].Data))
+	}
+
+	// A payload that doesn't decompress to its length is rejected
+	truncated := stored[0].clone()
+	truncated.UncompressedLength = uint32(len(payload) - 1)
+	truncated.Checksum = entryChecksum(CRC32IEEE, truncated, truncated.SeqNo)
+	if _, err := decompressEntry(CRC32IEEE, truncated); !errors.Is(err, ErrUncompressedLengthMismatch) {
+		t.Errorf("Expected ErrUncompressedLengthMismatch, got %v", err)
+	}
+	wal.Close()
+
+	// Corrupted compressed bytes fail the checksum before any decompression
+	content, _ := os.ReadFile(filepath.Join(dir, segmentPrefix+"1"))
+	at := bytes.Index(content, stored[0].Data)
+	content[at+len(stored[0].Data)/2] ^= 0xFF
+	os.WriteFile(filepath.Join(dir, segmentPrefix+"1"), content, 0644)
+	if _, err := Open(&Options{LogDir: dir + "/", CompressEntries: true}); err == nil || !strings.Contains(err.Error(), "invalid checksum") {
+		t.Errorf("Expected a checksum error for the corrupted compressed bytes, got %v", err)
+	}
+}
+
+func TestApplyParallel(t *testing.T) {
+	wal, _ := Open(&Options{LogDir: tempWalDir(t) + "/"})
+	defer wal.Close()
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h"}
+	for i := 0; i < 15; i++ {
+		for _, key := range keys {
+			wal.Write([]byte(fmt.Sprintf("%s:%d", key, i)))
+		}
+	}
+	wal.Sync()
+
+	keyFn := func(entry *Entry) string {
+		return strings.Split(string(entry.Data), ":")[0]
+	}
+	apply := func(workers int) (map[string][]uint64, time.Duration) {
+		var mu sync.Mutex
+		applied := map[string][]uint64{}
+		start := time.Now()
+		err := wal.ApplyParallel(keyFn, func(entry *Entry) error {
+			time.Sleep(time.Millisecond)
+			mu.Lock()
+			defer mu.Unlock()
+			applied[keyFn(entry)] = append(applied[keyFn(entry)], entry.SeqNo)
+			return nil
+		}, workers)
+		if err != nil {
+			t.Fatalf("ApplyParallel failed: %v", err)
+		}
+		return applied, time.Since(start)
+	}
+
+	_, sequential := apply(1)
+	applied, parallel := apply(4)
+	for _, key := range keys {
+		if len(applied[key]) != 15 || !slices.IsSorted(applied[key]) {
+			t.Errorf("Expected the 15 entries of key %s in order, got %v", key, applied[key])
+		}
+	}
+	if parallel >= sequential {
+		t.Errorf("Expected 4 workers to be faster than 1, took %v against %v", parallel, sequential)
+	}
+
+	errApply := errors.New("apply failed")
+	err := wal.ApplyParallel(keyFn, func(entry *Entry) error {
+		if entry.SeqNo == 10 {
+			return errApply
+		}
+		return nil
+	}, 4)
+	if !errors.Is(err, errApply) {
+		t.Errorf("Expected the handler error, got %v", err)
+	}
+}
+
+func TestOldestUncheckpointedSeq(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	if _, ok, err := wal.OldestUncheckpointedSeq(); ok || err != nil {
+		t.Errorf("Expected nothing for an empty log, got %v, error %v", ok, err)
+	}
+	for i := 0; i < 3; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+	}
+	if seqNo, ok, _ := wal.OldestUncheckpointedSeq(); !ok || seqNo != 1 {
+		t.Errorf("Expected the first entry without a checkpoint, got %d, %v", seqNo, ok)
+	}
+	wal.WriteWithCheckpoint([]byte("checkpoint"))
+	if _, ok, _ := wal.OldestUncheckpointedSeq(); ok {
+		t.Errorf("Expected every entry covered right after the checkpoint")
+	}
+	wal.Write([]byte("after"))
+	wal.Write([]byte("after again"))
+	wal.Close()
+
+	// The checkpoint is recovered on Open
+	wal, _ = Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+	if seqNo, ok, err := wal.OldestUncheckpointedSeq(); !ok || seqNo != 5 || err != nil {
+		t.Errorf("Expected seq no 5 just after the checkpoint, got %d, %v, error %v", seqNo, ok, err)
+	}
+}
+
+func TestDoubleBuffer(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", DoubleBuffer: true, MaxLogFileSize: 64 * 1024, maxSegments: 9})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 250; i++ {
+				if err := wal.Write(bytes.Repeat([]byte{byte('a' + i%26)}, 100+i)); err != nil {
+					t.Errorf("Write failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	wal.Close()
+
+	wal, _ = Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 1000 {
+		t.Fatalf("Expected the 1000 entries written across the buffer swaps, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.SeqNo != uint64(i+1) {
+			t.Fatalf("Expected seq no %d at position %d, got %d", i+1, i, entry.SeqNo)
+		}
+	}
+}
+
+// BenchmarkWriteLatency reports the tail latency of the writes, the flushes of the buffer cause the spikes
+func BenchmarkWriteLatency(b *testing.B) {
+	for _, doubleBuffer := range []bool{false, true} {
+		b.Run(fmt.Sprintf("DoubleBuffer=%v", doubleBuffer), func(b *testing.B) {
+			wal, err := Open(&Options{LogDir: b.TempDir() + "/", DoubleBuffer: doubleBuffer})
+			if err != nil {
+				b.Fatalf("Failed to open WAL: %v", err)
+			}
+			defer wal.Close()
+
+			data := bytes.Repeat([]byte("a"), 100)
+			latencies := make([]time.Duration, b.N)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				start := time.Now()
+				if err := wal.Write(data); err != nil {
+					b.Fatalf("Failed to write entry: %v", err)
+				}
+				latencies[i] = time.Since(start)
+			}
+			b.StopTimer()
+			slices.Sort(latencies)
+			b.ReportMetric(float64(latencies[len(latencies)*99/100]), "p99-ns")
+			b.ReportMetric(float64(latencies[len(latencies)-1]), "max-ns")
+		})
+	}
+}
+
+func TestConvertFraming(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, maxSegments: 9, CompressSealedSegments: true})
+	for i := 0; i < 40; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+		if i%10 == 9 {
+			wal.WriteLarge(make([]byte, 5000))
+		}
+	}
+	before, _ := wal.Segments()
+	wal.Close()
+	sizeOf := func() int64 {
+		var total int64
+		logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+		for _, logFile := range logFiles {
+			content, _ := readSegmentFile(logFile)
+			total += int64(len(content))
+		}
+		return total
+	}
+	fixedSize := sizeOf()
+
+	if err := ConvertFraming(dir, FramingVarint); err != nil {
+		t.Fatalf("ConvertFraming failed: %v", err)
+	}
+	if varintSize := sizeOf(); varintSize >= fixedSize {
+		t.Errorf("Expected the varint segments to be smaller than %d bytes, got %d", fixedSize, varintSize)
+	}
+	logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	for _, logFile := range logFiles {
+		content, _ := readSegmentFile(logFile)
+		if framing, _ := contentFraming(content); framing != FramingVarint {
+			t.Errorf("Expected segment %s to record the varint framing", logFile)
+		}
+		if err := checkSegmentFooter(content); err != nil {
+			t.Errorf("Expected segment %s to keep a valid footer: %v", logFile, err)
+		}
+	}
+	// Running it again changes nothing
+	if err := ConvertFraming(dir, FramingVarint); err != nil {
+		t.Fatalf("ConvertFraming failed on a converted log: %v", err)
+	}
+
+	wal, _ = Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, maxSegments: 9})
+	defer wal.Close()
+	if after, _ := wal.Segments(); !slices.Equal(before, after) {
+		t.Errorf("Expected the segments %v, got %v", before, after)
+	}
+	wal.Write([]byte("after conversion"))
+	wal.Sync()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 45 {
+		t.Fatalf("Expected 45 entries, got %d", len(entries))
+	}
+	if len(entries[10].Data) != 5000 || string(entries[44].Data) != "after conversion" {
+		t.Errorf("Expected the entries to read back under the new framing, got %v", entries[44])
+	}
+}
+
+func TestGrep(t *testing.T) {
+	wal, _ := Open(&Options{LogDir: tempWalDir(t) + "/"})
+	defer wal.Close()
+	for _, payload := range []string{"user=alice op=put", "user=bob op=get", "user=alice op=delete", "user=carol op=put"} {
+		wal.Write([]byte(payload))
+	}
+
+	matches, err := wal.Grep([]byte("alice"))
+	if err != nil {
+		t.Fatalf("Grep failed: %v", err)
+	}
+	if len(matches) != 2 || matches[0].SeqNo != 1 || matches[1].SeqNo != 3 {
+		t.Errorf("Expected the entries 1 and 3, got %v", matches)
+	}
+	if matches, _ := wal.Grep([]byte("dave")); len(matches) != 0 {
+		t.Errorf("Expected no match, got %v", matches)
+	}
+}
+
+func TestCheckpointIfNeeded(t *testing.T) {
+	wal, _ := Open(&Options{LogDir: tempWalDir(t) + "/"})
+	defer wal.Close()
+
+	checkpoints := []uint64{}
+	for i := 0; i < 10; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+		checkpointed, seqNo, err := wal.CheckpointIfNeeded(4)
+		if err != nil {
+			t.Fatalf("CheckpointIfNeeded failed: %v", err)
+		}
+		if checkpointed {
+			checkpoints = append(checkpoints, seqNo)
+		}
+	}
+	// A checkpoint after every 4 entries, each one taking the next seq number
+	if !slices.Equal(checkpoints, []uint64{5, 10}) {
+		t.Errorf("Expected checkpoints at seq nos [5 10], got %v", checkpoints)
+	}
+	if since, _ := wal.EntriesSinceCheckpoint(); since != 2 {
+		t.Errorf("Expected 2 entries since the last checkpoint, got %d", since)
+	}
+}
+
+func TestCount(t *testing.T) {
+	dir := tempWalDir(t) + "/"
+	wal, _ := Open(&Options{LogDir: dir, PersistCount: true, MaxEntrySize: 64})
+	for i := 0; i < 5; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+	}
+	// The chunks of a large payload count as a single entry
+	if err := wal.WriteLarge(bytes.Repeat([]byte("x"), 200)); err != nil {
+		t.Fatalf("WriteLarge failed: %v", err)
+	}
+	if count, err := wal.Count(); err != nil || count != 6 {
+		t.Fatalf("Expected 6 entries, got %d, %v", count, err)
+	}
+	wal.Write([]byte("entry-6"))
+	if count, _ := wal.Count(); count != 7 {
+		t.Fatalf("Expected 7 entries, got %d", count)
+	}
+	wal.Close()
+
+	// The count stored on Close is current, the reopened log doesn't scan
+	wal, _ = Open(&Options{LogDir: dir, PersistCount: true})
+	if !wal.countKnown || wal.entryCount != 7 {
+		t.Fatalf("Expected the count 7 loaded from %s, got %d (known %v)", countFileName, wal.entryCount, wal.countKnown)
+	}
+
+	// Simulate a crash, copy the log without closing it, the COUNT file still has the count stored on Close
+	wal.Write([]byte("entry-7"))
+	wal.Write([]byte("entry-8"))
+	wal.Sync()
+	crashDir := tempWalDir(t) + "/"
+	files, _ := os.ReadDir(dir)
+	for _, file := range files {
+		if file.Name() != countFileName && !strings.HasPrefix(file.Name(), segmentPrefix) {
+			continue
+		}
+		data, err := os.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(crashDir, file.Name()), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wal.Close()
+
+	crashed, err := Open(&Options{LogDir: crashDir, PersistCount: true})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer crashed.Close()
+	if crashed.countKnown {
+		t.Fatalf("Expected the stale count to be ignored")
+	}
+	if count, err := crashed.Count(); err != nil || count != 9 {
+		t.Errorf("Expected 9 entries after the rescan, got %d, %v", count, err)
+	}
+}
+
+func TestReadAllAcrossSegments(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 6 * 1024, maxSegments: 20})
+	for i := 0; i < 30; i++ {
+		write := wal.Write
+		if i == 20 {
+			write = wal.WriteWithCheckpoint
+		}
+		if err := write([]byte(fmt.Sprintf("entry-%d-%s", i, make([]byte, 900)))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		wal.Sync()
+	}
+	wal.Close()
+
+	// Past segment-9, lexicographic order would read segment-10 before segment-2
+	logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	if len(logFiles) < 11 {
+		t.Fatalf("Expected over 10 segments, got %d", len(logFiles))
+	}
+	// A segment created right before a crash is left empty
+	lastSegmentNo, _ := parseSegmentNo(logFiles[len(logFiles)-1])
+	if err := os.WriteFile(filepath.Join(dir, segmentPrefix+strconv.Itoa(lastSegmentNo+1)), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 6 * 1024, maxSegments: 20})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 30 {
+		t.Fatalf("Expected 30 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.SeqNo != uint64(i+1) {
+			t.Fatalf("Expected seq no %d at %d, got %d", i+1, i, entry.SeqNo)
+		}
+	}
+
+	entries, err = wal.ReadFromCheckPoint()
+	if err != nil {
+		t.Fatalf("ReadFromCheckPoint failed: %v", err)
+	}
+	if len(entries) != 10 || entries[0].SeqNo != 21 || entries[9].SeqNo != 30 {
+		t.Errorf("Expected the entries 21 to 30 from the checkpoint, got %d entries", len(entries))
+	}
+}
+
+func TestChecksumRoundTrip(t *testing.T) {
+	dir := tempWalDir(t) + "/"
+	wal, _ := Open(&Options{LogDir: dir})
+	wal.Write([]byte("entry-1"))
+	wal.WriteWithCheckpoint([]byte("entry-2"))
+	wal.Write([]byte("entry-3"))
+	wal.Close()
+
+	wal, err := Open(&Options{LogDir: dir})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	lastSeqNo, err := wal.getLastSeqNo()
+	if err != nil || lastSeqNo != 3 {
+		t.Fatalf("Expected the last seq no 3, got %d, %v", lastSeqNo, err)
+	}
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	for _, entry := range entries {
+		if err := validateChecksum(wal.checksum, entry.clone()); err != nil {
+			t.Errorf("Entry %d fails its checksum: %v", entry.SeqNo, err)
+		}
+	}
+
+	// The whole seq number and the checkpoint flag are covered, a change on disk is caught
+	alterations := map[string]func(entry *Entry){
+		"checkpoint flag": func(entry *Entry) { entry.IsCheckpoint = false },
+		"high seq byte":   func(entry *Entry) { entry.SeqNo |= 1 << 56 },
+	}
+	for name, alter := range alterations {
+		altered := entries[1].clone()
+		alter(altered)
+		if err := validateChecksum(wal.checksum, altered); err == nil {
+			t.Errorf("Expected a checksum error for an altered %s", name)
+		}
+	}
+	wal.rewriteSegment(wal.file.Name(), func(entries []*Entry) []*Entry {
+		entries[1].IsCheckpoint = false
+		return entries
+	})
+	if _, err := wal.ReadAll(); err == nil {
+		t.Errorf("Expected ReadAll to fail on a checkpoint flag cleared on disk")
+	}
+	// Clearing the flag that covers them isn't enough either
+	unflagged := entries[1].clone()
+	unflagged.HeaderChecked = false
+	if err := validateChecksum(wal.checksum, unflagged); err == nil {
+		t.Errorf("Expected a checksum error for a cleared HeaderChecked flag")
+	}
+}
+
+func TestReadFromTime(t *testing.T) {
+	dir := tempWalDir(t)
+	base := time.Unix(1700000000, 0)
+	now := base
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 6 * 1024, maxSegments: 20,
+		SegmentMetaEntries: true, Clock: func() time.Time { return now }})
+	defer wal.Close()
+	for i := 0; i < 20; i++ {
+		now = base.Add(time.Duration(i) * time.Second)
+		switch i {
+		case 8:
+			now = base.Add(100 * time.Second) // the clock jumps ahead
+		case 15:
+			now = base.Add(2 * time.Second) // and back
+		}
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, make([]byte, 900)))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		wal.Sync()
+	}
+
+	// The first segment only holds older entries, it isn't read at all
+	logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	file, _ := os.OpenFile(logFiles[0], os.O_WRONLY, 0644)
+	file.WriteAt(bytes.Repeat([]byte{0xff}, 64), segmentHeaderSize)
+	file.Close()
+	if _, err := wal.ReadAll(); err == nil {
+		t.Fatalf("Expected ReadAll to fail on the corrupted first segment")
+	}
+
+	entries, err := wal.ReadFromTime(base.Add(10 * time.Second))
+	if err != nil {
+		t.Fatalf("ReadFromTime failed: %v", err)
+	}
+	seqNos := []uint64{}
+	for _, entry := range entries {
+		seqNos = append(seqNos, entry.SeqNo)
+	}
+	// Entry 9 was stamped ahead and entry 16 behind, the others in order
+	expected := []uint64{9, 11, 12, 13, 14, 15, 17, 18, 19, 20}
+	if !slices.Equal(seqNos, expected) {
+		t.Errorf("Expected the entries %v, got %v", expected, seqNos)
+	}
+}
+
+func TestReopenPastSegmentNine(t *testing.T) {
+	dir := tempWalDir(t)
+	options := &Options{LogDir: dir + "/", MaxLogFileSize: 6 * 1024, maxSegments: 20}
+	wal, _ := Open(options)
+	for i := 0; i < 40; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, make([]byte, 900))))
+		wal.Sync()
+		if logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix)); len(logFiles) == 12 {
+			break
+		}
+	}
+	lastSegmentNo := wal.currentSegmentNo
+	wal.Close()
+
+	logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	if len(logFiles) != 12 {
+		t.Fatalf("Expected 12 segments, got %d", len(logFiles))
+	}
+	wal, err := Open(options)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	if wal.currentSegmentNo != lastSegmentNo || wal.file.Name() != logFiles[len(logFiles)-1] {
+		t.Fatalf("Expected segment %d to be opened for append, got %s", lastSegmentNo, wal.file.Name())
+	}
+	wal.Write([]byte("after-reopen"))
+	wal.Sync()
+	entries, _ := wal.ReadAll()
+	if last := entries[len(entries)-1]; string(last.Data) != "after-reopen" || last.SeqNo != uint64(len(entries)) {
+		t.Errorf("Expected the write after reopen to follow the last entry, got seq no %d of %d", last.SeqNo, len(entries))
+	}
+}
+
+func TestWriteBatch(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 64 * 1024, maxSegments: 20})
+	defer wal.Close()
+	wal.Write([]byte("before"))
+
+	records := make([][]byte, 1000)
+	for i := range records {
+		records[i] = []byte(fmt.Sprintf("record-%d-%s", i, bytes.Repeat([]byte("x"), 100)))
+	}
+	seqNos, err := wal.WriteBatch(records)
+	if err != nil {
+		t.Fatalf("WriteBatch failed: %v", err)
+	}
+	if len(seqNos) != len(records) {
+		t.Fatalf("Expected %d seq nos, got %d", len(records), len(seqNos))
+	}
+	for i, seqNo := range seqNos {
+		if seqNo != uint64(i+2) {
+			t.Fatalf("Expected seq no %d for record %d, got %d", i+2, i, seqNo)
+		}
+	}
+	if logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix)); len(logFiles) < 2 {
+		t.Fatalf("Expected the batch to rotate segments, got %d", len(logFiles))
+	}
+
+	wal.Sync()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != len(records)+1 {
+		t.Fatalf("Expected %d entries, got %d", len(records)+1, len(entries))
+	}
+	for i, record := range records {
+		if entry := entries[i+1]; entry.SeqNo != seqNos[i] || !bytes.Equal(entry.Data, record) {
+			t.Fatalf("Record %d read back as seq no %d %q", i, entry.SeqNo, entry.Data)
+		}
+	}
+}
+
+func TestWriteSync(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/"})
+	defer wal.Close()
+
+	// Write and WriteSync mix under the same lock, a WriteSync makes the entries buffered before it durable too
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				if i%2 == 0 {
+					wal.Write([]byte(fmt.Sprintf("writer-%d-%d", w, i)))
+				} else if _, err := wal.WriteSync([]byte(fmt.Sprintf("writer-%d-%d", w, i))); err != nil {
+					t.Errorf("WriteSync failed: %v", err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	seqNo, err := wal.WriteSync([]byte("durable"))
+	if err != nil || seqNo != 161 {
+		t.Fatalf("Expected seq no 161, got %d, %v", seqNo, err)
+	}
+
+	// A fresh handle reads the entries without a Sync of the writer
+	reader, err := Open(&Options{LogDir: dir + "/"})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer reader.Close()
+	entries, err := reader.ReadAll()
+	if err != nil || len(entries) != 161 {
+		t.Fatalf("Expected 161 entries, got %d, %v", len(entries), err)
+	}
+	if last := entries[160]; string(last.Data) != "durable" || last.IsCheckpoint {
+		t.Errorf("Expected a regular entry written by WriteSync, got %v", last)
+	}
+}
+
+func TestWriteTxn(t *testing.T) {
+	dir := tempWalDir(t) + "/"
+	wal, _ := Open(&Options{LogDir: dir})
+	wal.Write([]byte("before"))
+	txnId, err := wal.WriteTxn([][]byte{[]byte("a-1"), []byte("a-2"), []byte("a-3")})
+	if err != nil || txnId != 2 {
+		t.Fatalf("Expected transaction 2, got %d, %v", txnId, err)
+	}
+	wal.WriteTxn([][]byte{[]byte("b-1"), []byte("b-2"), []byte("b-3")})
+	wal.Sync()
+	logFiles, _ := listSegmentFiles(osFS{}, dir+segmentPrefix)
+	segment, _ := wal.readSegment(logFiles[0])
+	commit, _ := wal.codec.Marshal(segment[len(segment)-1])
+	wal.Close()
+
+	// Simulate a crash in the middle of the second transaction, before its commit record was written
+	info, _ := os.Stat(logFiles[0])
+	commitSize := len(appendFrameSize(nil, FramingFixed32, uint32(len(commit)))) + len(commit)
+	if err := os.Truncate(logFiles[0], info.Size()-int64(commitSize)); err != nil {
+		t.Fatal(err)
+	}
+
+	wal, err = Open(&Options{LogDir: dir})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	payloads := []string{}
+	for _, entry := range entries {
+		payloads = append(payloads, string(entry.Data))
+	}
+	expected := []string{"before", "a-1", "a-2", "a-3"}
+	if !slices.Equal(payloads, expected) {
+		t.Errorf("Expected %v, got %v", expected, payloads)
+	}
+}
+
+func TestReader(t *testing.T) {
+	dir := tempWalDir(t) + "/"
+	wal, _ := Open(&Options{LogDir: dir})
+	defer wal.Close()
+	for i := 0; i < 50000; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+	}
+
+	reader, err := wal.NewReader()
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+	count := 0
+	for reader.Next() {
+		if entry := reader.Entry(); entry.SeqNo != uint64(count+1) {
+			t.Fatalf("Expected seq no %d, got %d", count+1, entry.SeqNo)
+		}
+		count++
+	}
+	reader.Close()
+	if err := reader.Err(); err != nil || count != 50000 {
+		t.Fatalf("Expected 50000 entries, got %d, %v", count, err)
+	}
+
+	// A corrupted entry stops the iteration and is reported by Err
+	logFiles, _ := listSegmentFiles(osFS{}, dir+segmentPrefix)
+	content, _ := os.ReadFile(logFiles[0])
+	offset := bytes.Index(content, []byte("entry-100"))
+	file, _ := os.OpenFile(logFiles[0], os.O_WRONLY, 0644)
+	file.WriteAt([]byte("E"), int64(offset))
+	file.Close()
+	reader, _ = wal.NewReader()
+	defer reader.Close()
+	count = 0
+	for reader.Next() {
+		count++
+	}
+	if reader.Err() == nil || count != 100 {
+		t.Errorf("Expected an error after 100 entries, got %d, %v", count, reader.Err())
+	}
+}
+
+func TestReadFrom(t *testing.T) {
+	for _, segmentMeta := range []bool{false, true} {
+		dir := tempWalDir(t)
+		wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 16 * 1024, maxSegments: 20, SegmentMetaEntries: segmentMeta})
+		for i := 1; i <= 100; i++ {
+			wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, make([]byte, 500))))
+			wal.Sync()
+		}
+		entries, err := wal.ReadFrom(50)
+		wal.Close()
+		if err != nil {
+			t.Fatalf("ReadFrom failed: %v", err)
+		}
+		if len(entries) != 50 {
+			t.Fatalf("Expected 50 entries, got %d", len(entries))
+		}
+		for i, entry := range entries {
+			if entry.SeqNo != uint64(51+i) || !bytes.HasPrefix(entry.Data, []byte(fmt.Sprintf("entry-%d-", 51+i))) {
+				t.Fatalf("Expected entry %d at %d, got seq no %d", 51+i, i, entry.SeqNo)
+			}
+		}
+	}
+}
+
+func TestTruncateAfter(t *testing.T) {
+	for _, boundary := range []bool{false, true} {
+		dir := tempWalDir(t)
+		wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, maxSegments: 20})
+		for i := 1; i <= 30; i++ {
+			wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, make([]byte, 900))))
+			wal.Sync()
+		}
+		logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+		if len(logFiles) < 4 {
+			t.Fatalf("Expected several segments, got %d", len(logFiles))
+		}
+		seqNo := uint64(12)
+		if boundary {
+			// The last entry of the second segment
+			firstSeqNo, _, _ := wal.segmentFirstSeqNo(logFiles[2])
+			seqNo = firstSeqNo - 1
+		}
+		if err := wal.TruncateAfter(seqNo); err != nil {
+			t.Fatalf("TruncateAfter failed: %v", err)
+		}
+		if remaining, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix)); len(remaining) >= len(logFiles) {
+			t.Errorf("Expected the trailing segments to be deleted, %d of %d left", len(remaining), len(logFiles))
+		}
+		wal.Write([]byte("after-truncate"))
+		wal.Sync()
+		entries, err := wal.ReadAll()
+		if err != nil {
+			t.Fatalf("ReadAll failed: %v", err)
+		}
+		if uint64(len(entries)) != seqNo+1 {
+			t.Fatalf("Expected %d entries, got %d", seqNo+1, len(entries))
+		}
+		for i, entry := range entries {
+			if entry.SeqNo != uint64(i+1) {
+				t.Fatalf("Expected seq no %d at %d, got %d", i+1, i, entry.SeqNo)
+			}
+		}
+		if last := entries[len(entries)-1]; string(last.Data) != "after-truncate" {
+			t.Errorf("Expected the write after the truncation to follow seq no %d, got %q", seqNo, last.Data)
+		}
+		wal.Close()
+
+		// The truncation survives a reopen
+		wal, _ = Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, maxSegments: 20})
+		if wal.lastSeqNo != seqNo+1 {
+			t.Errorf("Expected the last seq no %d after reopen, got %d", seqNo+1, wal.lastSeqNo)
+		}
+		wal.Close()
+	}
+}
+
+func TestPurgeBeforeCheckpoint(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, maxSegments: 20})
+	defer wal.Close()
+	if reclaimed, err := wal.PurgeBeforeCheckpoint(); err != nil || reclaimed != 0 {
+		t.Fatalf("Expected nothing to purge without a checkpoint, got %d, %v", reclaimed, err)
+	}
+	for i := 1; i <= 30; i++ {
+		write := wal.Write
+		if i == 20 {
+			write = wal.WriteWithCheckpoint
+		}
+		write([]byte(fmt.Sprintf("entry-%d-%s", i, make([]byte, 900))))
+		wal.Sync()
+	}
+	logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	// The segments before the one holding the checkpoint are obsolete
+	checkpointSegment := 0
+	var obsoleteBytes int64
+	for i, logFile := range logFiles {
+		if firstSeqNo, _, _ := wal.segmentFirstSeqNo(logFile); firstSeqNo > 20 {
+			break
+		}
+		checkpointSegment = i
+	}
+	for _, logFile := range logFiles[:checkpointSegment] {
+		info, _ := os.Stat(logFile)
+		obsoleteBytes += info.Size()
+	}
+
+	reclaimed, err := wal.PurgeBeforeCheckpoint()
+	if err != nil {
+		t.Fatalf("PurgeBeforeCheckpoint failed: %v", err)
+	}
+	if reclaimed != obsoleteBytes || obsoleteBytes == 0 {
+		t.Errorf("Expected %d bytes reclaimed, got %d", obsoleteBytes, reclaimed)
+	}
+	remaining, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	if !slices.Equal(remaining, logFiles[checkpointSegment:]) {
+		t.Errorf("Expected the segments %v to remain, got %v", logFiles[checkpointSegment:], remaining)
+	}
+	entries, err := wal.ReadFromCheckPoint()
+	if err != nil || len(entries) != 11 || entries[0].SeqNo != 20 {
+		t.Errorf("Expected the 11 entries from the checkpoint to remain, got %d, %v", len(entries), err)
+	}
+}
+
+func TestMaxSegments(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, _ := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, maxSegments: 3})
+	defer wal.Close()
+	for i := 1; i <= 20; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, make([]byte, 900))))
+		wal.Sync()
+	}
+	if wal.currentSegmentNo < 5 {
+		t.Fatalf("Expected at least 5 segments to be created, got %d", wal.currentSegmentNo)
+	}
+	logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	if len(logFiles) != 3 {
+		t.Errorf("Expected 3 segments to remain, got %d", len(logFiles))
+	}
+	if lastSegmentNo, _ := parseSegmentNo(logFiles[len(logFiles)-1]); lastSegmentNo != wal.currentSegmentNo {
+		t.Errorf("Expected the active segment %d to remain, got %v", wal.currentSegmentNo, logFiles)
+	}
+
+	// The segment holding the last checkpoint is kept over the maximum
+	checkpointSegmentNo := wal.currentSegmentNo
+	wal.WriteWithCheckpoint([]byte("checkpoint"))
+	for i := 0; i < 20; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%s", make([]byte, 900))))
+		wal.Sync()
+	}
+	logFiles, _ = listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+	if oldestSegmentNo, _ := parseSegmentNo(logFiles[0]); oldestSegmentNo != checkpointSegmentNo {
+		t.Errorf("Expected the checkpoint segment %d to be kept, got %v", checkpointSegmentNo, logFiles)
+	}
+	if len(logFiles) <= 3 {
+		t.Errorf("Expected the segments after the checkpoint to be kept, got %d", len(logFiles))
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	dir := tempWalDir(t) + "/"
+	wal, _ := Open(&Options{LogDir: dir})
+	for i := 1; i <= 5; i++ {
+		wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+	}
+	wal.Close()
+
+	// A crash in the middle of a write leaves a size prefix with only part of its entry
+	segmentPath := dir + segmentPrefix + "1"
+	info, _ := os.Stat(segmentPath)
+	file, _ := os.OpenFile(segmentPath, os.O_WRONLY|os.O_APPEND, 0644)
+	file.Write(binary.LittleEndian.AppendUint32(nil, 100))
+	file.Write([]byte("partial"))
+	file.Close()
+
+	wal, err := Open(&Options{LogDir: dir})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	if truncated, _ := os.Stat(segmentPath); truncated.Size() != info.Size() {
+		t.Errorf("Expected the segment to be truncated to %d bytes, got %d", info.Size(), truncated.Size())
+	}
+	wal.Write([]byte("entry-6"))
+	wal.Sync()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 6 || string(entries[5].Data) != "entry-6" || entries[5].SeqNo != 6 {
+		t.Errorf("Expected the 5 valid entries followed by the new one, got %d entries", len(entries))
+	}
+
+	// Corruption before the end of the log is still reported
+	content, _ := os.ReadFile(segmentPath)
+	file, _ = os.OpenFile(segmentPath, os.O_WRONLY, 0644)
+	file.WriteAt([]byte("E"), int64(bytes.Index(content, []byte("entry-3"))))
+	file.Close()
+	if _, err := wal.ReadAll(); err == nil {
+		t.Errorf("Expected ReadAll to fail on a corrupted entry before the end of the log")
+	}
+}
+
+func TestOnCorruption(t *testing.T) {
+	for _, policy := range []CorruptionPolicy{CorruptError, CorruptSkip, CorruptTruncate} {
+		dir := tempWalDir(t)
+		options := &Options{LogDir: dir + "/", MaxLogFileSize: 8 * 1024, maxSegments: 20, OnCorruption: policy}
+		wal, _ := Open(options)
+		for i := 1; i <= 12; i++ {
+			wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, make([]byte, 900))))
+			wal.Sync()
+		}
+		wal.Close()
+
+		// Corrupt the payload of entry 5, in the middle of the log, and of entry 11, before the end of the active segment
+		logFiles, _ := listSegmentFiles(osFS{}, filepath.Join(dir, segmentPrefix))
+		for _, logFile := range logFiles {
+			content, _ := os.ReadFile(logFile)
+			for _, corrupted := range []string{"entry-5-", "entry-11-"} {
+				if offset := bytes.Index(content, []byte(corrupted)); offset >= 0 {
+					file, _ := os.OpenFile(logFile, os.O_WRONLY, 0644)
+					file.WriteAt([]byte("E"), int64(offset))
+					file.Close()
+				}
+			}
+		}
+
+		// Recovery applies the policy too, the entries after a corrupted one count for the next seq number
+		wal, err := Open(options)
+		if policy == CorruptError {
+			if err == nil || !strings.Contains(err.Error(), "invalid checksum") {
+				t.Errorf("Expected Open to fail on the corrupted entry, got %v", err)
+			}
+			if err == nil {
+				wal.Close()
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Open failed with policy %d: %v", policy, err)
+		}
+		entries, err := wal.ReadAll()
+		seqNos := []uint64{}
+		for _, entry := range entries {
+			seqNos = append(seqNos, entry.SeqNo)
+		}
+		switch policy {
+		case CorruptSkip:
+			expected := []uint64{1, 2, 3, 4, 6, 7, 8, 9, 10, 12}
+			if err != nil || !slices.Equal(seqNos, expected) {
+				t.Errorf("Expected the entries %v without the corrupted ones, got %v, %v", expected, seqNos, err)
+			}
+			// The next write doesn't reuse the seq number of an entry after the corrupted ones
+			wal.Write([]byte("after"))
+			wal.Sync()
+			entries, err := wal.ReadAll()
+			if err != nil || len(entries) != 11 || entries[10].SeqNo != 13 {
+				t.Errorf("Expected the write to get seq no 13, got %d entries, %v", len(entries), err)
+			}
+		case CorruptTruncate:
+			if err != nil || !slices.Equal(seqNos, []uint64{1, 2, 3, 4}) {
+				t.Errorf("Expected the entries before the corrupted one, got %v, %v", seqNos, err)
+			}
+			// The log was truncated, writes continue after the last valid entry
+			wal.Write([]byte("after"))
+			wal.Sync()
+			entries, err := wal.ReadAll()
+			if err != nil || len(entries) != 5 || entries[4].SeqNo != 5 || string(entries[4].Data) != "after" {
+				t.Errorf("Expected the write to follow the truncated log, got %d entries, %v", len(entries), err)
+			}
+		}
+		wal.Close()
+	}
+}
+
+func TestChecksumType(t *testing.T) {
+	for _, checksumType := range []ChecksumType{ChecksumCRC32IEEE, ChecksumCRC32Castagnoli, ChecksumCRC64ECMA} {
+		dir := tempWalDir(t) + "/"
+		wal, _ := Open(&Options{LogDir: dir, ChecksumType: checksumType})
+		for i := 1; i <= 5; i++ {
+			wal.Write([]byte(fmt.Sprintf("entry-%d", i)))
+		}
+		wal.Close()
+
+		// The entries record their algorithm, a WAL configured with the default one reads them
+		wal, _ = Open(&Options{LogDir: dir})
+		entries, err := wal.ReadAll()
+		if err != nil || len(entries) != 5 {
+			t.Fatalf("Expected 5 entries with checksum type %d, got %d, %v", checksumType, len(entries), err)
+		}
+		for _, entry := range entries {
+			if ChecksumType(entry.ChecksumType) != checksumType {
+				t.Errorf("Expected checksum type %d, got %d", checksumType, entry.ChecksumType)
+			}
+			if (entry.ChecksumHigh != 0) != (checksumType == ChecksumCRC64ECMA) {
+				t.Errorf("Unexpected high checksum bits %x with checksum type %d", entry.ChecksumHigh, checksumType)
+			}
+		}
+		wal.Close()
+
+		content, _ := os.ReadFile(dir + segmentPrefix + "1")
+		content[bytes.Index(content, []byte("entry-3"))] = 'E'
+		os.WriteFile(dir+segmentPrefix+"1", content, 0644)
+		if _, err := Open(&Options{LogDir: dir}); err == nil {
+			t.Errorf("Expected the corruption to be detected with checksum type %d", checksumType)
+		}
+	}
+
+	// A default log records its algorithm too, it reads the same reopened with another Checksum
+	dir := tempWalDir(t) + "/"
+	wal, _ := Open(&Options{LogDir: dir})
+	wal.Write([]byte("default"))
+	wal.Close()
+	wal, err := Open(&Options{LogDir: dir, Checksum: CRC32C})
+	if err != nil {
+		t.Fatalf("Reopen with CRC32C failed: %v", err)
+	}
+	wal.Write([]byte("custom"))
+	entries, err := wal.ReadAll()
+	wal.Close()
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d, %v", len(entries), err)
+	}
+	// The entries of a custom Checksum leave it to the configured one
+	for i, expected := range []ChecksumType{ChecksumCRC32IEEE, ChecksumConfigured} {
+		if ChecksumType(entries[i].ChecksumType) != expected {
+			t.Errorf("Expected checksum type %d for %s, got %d", expected, entries[i].Data, entries[i].ChecksumType)
+		}
+	}
+}
+
+func TestGroupCommit(t *testing.T) {
+	dir := tempWalDir(t) + "/"
+	var syncs atomic.Int64
+	wal, _ := Open(&Options{LogDir: dir, GroupCommitWindow: 2 * time.Millisecond,
+		fsync: func(file File) error {
+			syncs.Add(1)
+			return file.Sync()
+		}})
+	defer wal.Close()
+	syncs.Store(0)
+
+	var wg sync.WaitGroup
+	for w := 0; w < 64; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 10; i++ {
+				if _, err := wal.WriteSync([]byte(fmt.Sprintf("writer-%d-%d", w, i))); err != nil {
+					t.Errorf("WriteSync failed: %v", err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := syncs.Load(); n == 0 || n >= 640 {
+		t.Errorf("Expected the writes to share syncs, got %d syncs for 640 writes", n)
+	}
+
+	// Every entry reached the segment file, without flushing the buffer
+	content, _ := os.ReadFile(dir + segmentPrefix + "1")
+	entries, err := decodeSegment(content, wal.codec, wal.checksum)
+	if err != nil || len(entries) != 640 {
+		t.Fatalf("Expected 640 entries in the segment file, got %d, %v", len(entries), err)
+	}
+	next := map[string]int{}
+	for i, entry := range entries {
+		if entry.SeqNo != uint64(i+1) {
+			t.Fatalf("Expected seq no %d, got %d", i+1, entry.SeqNo)
+		}
+		var w, n int
+		fmt.Sscanf(string(entry.Data), "writer-%d-%d", &w, &n)
+		writer := strconv.Itoa(w)
+		if n != next[writer] {
+			t.Fatalf("Expected entry %d of writer %d, got %d", next[writer], w, n)
+		}
+		next[writer]++
+	}
+
+	// A failed sync is returned to the whole group
+	wal.locker.Lock()
+	wal.fsync = func(File) error { return errors.New("disk failure") }
+	wal.locker.Unlock()
+	errs := make(chan error, 8)
+	for w := 0; w < 8; w++ {
+		go func() {
+			_, err := wal.WriteSync([]byte("failing"))
+			errs <- err
+		}()
+	}
+	for w := 0; w < 8; w++ {
+		if err := <-errs; err == nil {
+			t.Errorf("Expected the sync error to be returned")
+		}
+	}
+}
+
+func TestGroupCommitClose(t *testing.T) {
+	dir := tempWalDir(t) + "/"
+	wal, _ := Open(&Options{LogDir: dir, GroupCommitWindow: time.Second})
+	errs := make(chan error, 4)
+	for w := 0; w < 4; w++ {
+		go func() {
+			_, err := wal.WriteSync([]byte(fmt.Sprintf("writer-%d", w)))
+			errs <- err
+		}()
+	}
+	// Close once every call joined the group, while its leader waits for the window
+	for wal.LastSeqNo() < 4 {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	// The sync of Close made the entries durable, the group gets its result without waiting for the window
+	for w := 0; w < 4; w++ {
+		if err := <-errs; err != nil {
+			t.Errorf("Expected WriteSync to succeed once Close synced, got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected Close to wake up the group, it waited %v", elapsed)
+	}
+
+	wal, _ = Open(&Options{LogDir: dir})
+	defer wal.Close()
+	if entries, err := wal.ReadAll(); err != nil || len(entries) != 4 {
+		t.Errorf("Expected the 4 entries of the group, got %d, %v", len(entries), err)
+	}
+}
+
+func TestFunctionalOptions(t *testing.T) {
+	dir := tempWalDir(t) + "/"
+	wal, err := Open(WithLogDir(dir), WithMaxLogFileSize(8*1024), WithMaxSegments(3), WithSyncInterval(time.Second), WithSync(true))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if wal.logDir != dir || wal.maxLogFileSize != 8*1024 || wal.maxSegments != 3 || wal.syncInterval != time.Second {
+		t.Errorf("Expected the functional options to be applied, got dir %s, size %d, segments %d, interval %v",
+			wal.logDir, wal.maxLogFileSize, wal.maxSegments, wal.syncInterval)
+	}
+	wal.Close()
+
+	// A false boolean overrides an earlier true one
+	if config := initConfig(&Options{LogDir: dir, EnableSync: true}, WithSync(false)); config.EnableSync {
+		t.Errorf("Expected WithSync(false) to disable syncing")
+	}
+	// The fields left to their zero value in Options don't override an earlier functional option
+	if config := initConfig(WithSync(true), &Options{LogDir: dir}); !config.EnableSync || config.LogDir != dir {
+		t.Errorf("Expected WithSync(true) to be kept, got %v", config.EnableSync)
+	}
+	// Each Options merges into what the earlier options set
+	config := initConfig(&Options{LogDir: dir, OnCorruption: CorruptSkip, ChecksumType: ChecksumCRC64ECMA, EntryNonces: true},
+		WithMaxSegments(3), &Options{OrderingMode: OrderingLenient, MaxLogFileSize: 8 * 1024})
+	if config.LogDir != dir || config.OnCorruption != CorruptSkip || config.ChecksumType != ChecksumCRC64ECMA ||
+		!config.EntryNonces || config.maxSegments != 3 || config.OrderingMode != OrderingLenient || config.MaxLogFileSize != 8*1024 {
+		t.Errorf("Expected every option to be kept, got %+v", config)
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	dir := tempWalDir(t) + "/"
+	tests := []struct {
+		name  string
+		opts  []Option
+		valid bool
+	}{
+		{"defaults", []Option{WithLogDir(dir)}, true},
+		{"empty log dir", []Option{WithLogDir("")}, false},
+		{"zero max log file size", []Option{WithLogDir(dir), WithMaxLogFileSize(0)}, false},
+		{"negative max log file size", []Option{&Options{LogDir: dir, MaxLogFileSize: -1}}, false},
+		{"zero max segments", []Option{WithLogDir(dir), WithMaxSegments(0)}, false},
+		{"negative max segments", []Option{&Options{LogDir: dir, maxSegments: -2}}, false},
+		{"zero sync interval with sync", []Option{WithLogDir(dir), WithSync(true), WithSyncInterval(0)}, false},
+		{"negative sync interval with sync", []Option{&Options{LogDir: dir, EnableSync: true, SyncInterval: -time.Second}}, false},
+		{"zero sync interval without sync", []Option{WithLogDir(dir), WithSync(false), WithSyncInterval(0)}, true},
+	}
+	for _, test := range tests {
+		err := checkConfig(initConfig(test.opts...))
+		if test.valid && err != nil {
+			t.Errorf("%s: expected a valid configuration, got %v", test.name, err)
+		}
+		if !test.valid {
+			if !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("%s: expected ErrInvalidConfig, got %v", test.name, err)
+			}
+			if _, err := Open(test.opts...); !errors.Is(err, ErrInvalidConfig) {
+				t.Errorf("%s: expected Open to fail with ErrInvalidConfig, got %v", test.name, err)
+			}
+		}
+	}
+}
+
+func TestSyncDisabled(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/", EnableSync: false, SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if wal.syncDelay != nil {
+		t.Errorf("Expected no sync ticker without EnableSync")
+	}
+	if err := wal.Write([]byte("entry")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	wal, err = Open(&Options{LogDir: dir + "/", EnableSync: true, SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if wal.syncDelay == nil {
+		t.Errorf("Expected a sync ticker with EnableSync")
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestCloseTwice(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/", EnableSync: true, SyncInterval: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := wal.Write([]byte("entry")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Errorf("Expected the second Close to return nil, got %v", err)
+	}
+	if err := wal.Sync(); err != nil {
+		t.Errorf("Expected Sync after Close to return nil, got %v", err)
+	}
+}
+
+func TestReadAllAfterClose(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 6 * 1024, maxSegments: 20})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, strings.Repeat("x", 100)))); err != nil {
+			t.Fatalf("Write failed at entry %d: %v", i, err)
+		}
+		wal.Sync()
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll after Close failed: %v", err)
+	}
+	if len(entries) != 100 {
+		t.Fatalf("Expected 100 entries after Close, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if entry.SeqNo != uint64(i+1) {
+			t.Errorf("Entry %d has seq no %d", i, entry.SeqNo)
+		}
+	}
+	if files, _ := wal.listSegments(); len(files) < 2 {
+		t.Errorf("Expected the entries to span several segments, got %d", len(files))
+	}
+}
+
+// captureLogger records the messages logged by the WAL
+type captureLogger struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+func (l *captureLogger) Printf(format string, v ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.messages = append(l.messages, fmt.Sprintf(format, v...))
+}
+
+func (l *captureLogger) contains(substr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, message := range l.messages {
+		if strings.Contains(message, substr) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLogger(t *testing.T) {
+	dir := tempWalDir(t)
+	logger := &captureLogger{}
+	var failing atomic.Bool
+	failing.Store(true)
+	wal, err := Open(&Options{LogDir: dir + "/", EnableSync: true, SyncInterval: 5 * time.Millisecond, Logger: logger,
+		fsync: func(file File) error {
+			if failing.Load() {
+				return errors.New("disk failure")
+			}
+			return file.Sync()
+		}})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := wal.Write([]byte("entry")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for !logger.contains("failed to sync WAL") && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !logger.contains("disk failure") {
+		t.Errorf("Expected the background sync error to be routed to the logger, got %v", logger.messages)
+	}
+	failing.Store(false)
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+}
+
+func TestErrorHandler(t *testing.T) {
+	dir := tempWalDir(t)
+	errs := make(chan error, 16)
+	wal, err := Open(&Options{LogDir: dir + "/", EnableSync: true, SyncInterval: 5 * time.Millisecond,
+		ErrorHandler: func(err error) {
+			select {
+			case errs <- err:
+			default:
+			}
+		}})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	if err := wal.Write([]byte("entry")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	// Close the segment file behind the WAL, the next background sync fails on it
+	wal.locker.Lock()
+	file := wal.file
+	file.Close()
+	wal.locker.Unlock()
+
+	select {
+	case err := <-errs:
+		if !errors.Is(err, os.ErrClosed) {
+			t.Errorf("Expected the error of the closed file, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the background sync error to reach the error handler")
+	}
+	// Close would fail the same way, only stop the sync goroutine
+	wal.cancel()
+}
+
+func TestRotate(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/"})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	for i := 0; i < 3; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("before-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := wal.Rotate(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("after-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	segments, err := wal.Segments()
+	if err != nil {
+		t.Fatalf("Segments failed: %v", err)
+	}
+	if !slices.Equal(segments, []int{1, 2}) {
+		t.Fatalf("Expected segments [1 2], got %v", segments)
+	}
+	first, err := wal.ReadSegment(1)
+	if err != nil {
+		t.Fatalf("ReadSegment failed: %v", err)
+	}
+	second, err := wal.ReadSegment(2)
+	if err != nil {
+		t.Fatalf("ReadSegment failed: %v", err)
+	}
+	if len(first) != 3 || len(second) != 2 {
+		t.Fatalf("Expected 3 and 2 entries in the segments, got %d and %d", len(first), len(second))
+	}
+	for i, entry := range append(first, second...) {
+		if entry.SeqNo != uint64(i+1) {
+			t.Errorf("Entry %d has seq no %d, expected %d", i, entry.SeqNo, i+1)
+		}
+	}
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/"})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	var cp uint64
+	for i := 0; i < 6; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+		if i%2 == 1 {
+			if cp, err = wal.Checkpoint(); err != nil {
+				t.Fatalf("Checkpoint failed: %v", err)
+			}
+		}
+	}
+	if cp != 9 {
+		t.Errorf("Expected the last checkpoint to have seq no 9, got %d", cp)
+	}
+	if err := wal.Write([]byte("after")); err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+	wal.Sync()
+
+	entries, err := wal.ReadFromCheckPoint()
+	if err != nil {
+		t.Fatalf("ReadFromCheckPoint failed: %v", err)
+	}
+	if len(entries) != 2 {
+		t.Fatalf("Expected the checkpoint and the entry after it, got %d entries", len(entries))
+	}
+	if entries[0].SeqNo != cp || !entries[0].IsCheckpoint || len(entries[0].Data) != 0 {
+		t.Errorf("Expected the empty checkpoint %d first, got %v", cp, entries[0])
+	}
+	if string(entries[1].Data) != "after" {
+		t.Errorf("Expected the entry after the checkpoint, got %q", entries[1].Data)
+	}
+}
+
+func TestFirstAndLastSeqNo(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/"})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	if first, err := wal.FirstSeqNo(); err != nil || first != 0 || wal.LastSeqNo() != 0 {
+		t.Errorf("Expected 0 and 0 for an empty log, got %d, %d, %v", first, wal.LastSeqNo(), err)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if first, err := wal.FirstSeqNo(); err != nil || first != 1 || wal.LastSeqNo() != 5 {
+		t.Errorf("Expected 1 and 5 after the writes, got %d, %d, %v", first, wal.LastSeqNo(), err)
+	}
+
+	if err := wal.Rotate(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if _, err := wal.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("after-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if first, err := wal.FirstSeqNo(); err != nil || first != 1 || wal.LastSeqNo() != 9 {
+		t.Errorf("Expected 1 and 9 after the rotation, got %d, %d, %v", first, wal.LastSeqNo(), err)
+	}
+
+	// The first segment precedes the checkpoint
+	if _, err := wal.PurgeBeforeCheckpoint(); err != nil {
+		t.Fatalf("PurgeBeforeCheckpoint failed: %v", err)
+	}
+	if first, err := wal.FirstSeqNo(); err != nil || first != 6 || wal.LastSeqNo() != 9 {
+		t.Errorf("Expected 6 and 9 after the purge, got %d, %d, %v", first, wal.LastSeqNo(), err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 6 * 1024, maxSegments: 20})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	for i := 0; i < 120; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, strings.Repeat("x", 100)))); err != nil {
+			t.Fatalf("Write failed at entry %d: %v", i, err)
+		}
+		wal.Sync()
+	}
+
+	stats, err := wal.Stats()
+	if err != nil {
+		t.Fatalf("Stats failed: %v", err)
+	}
+	if stats.Entries != 120 || stats.LastSeqNo != 120 {
+		t.Errorf("Expected 120 entries up to seq no 120, got %d up to %d", stats.Entries, stats.LastSeqNo)
+	}
+	segments, _ := wal.Segments()
+	if stats.Segments != len(segments) || stats.Segments < 2 || stats.CurrentSegment != segments[len(segments)-1] {
+		t.Errorf("Expected %d segments up to %v, got %d up to %d", len(segments), segments, stats.Segments, stats.CurrentSegment)
+	}
+	var bytes int64
+	files, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+	for _, file := range files {
+		fileInfo, _ := os.Stat(file)
+		bytes += fileInfo.Size()
+	}
+	if stats.Bytes != bytes || stats.Bytes < 120*100 {
+		t.Errorf("Expected %d bytes of segments, got %d", bytes, stats.Bytes)
+	}
+}
+
+func TestCompression(t *testing.T) {
+	dir := tempWalDir(t)
+	large := []byte(strings.Repeat(`{"key":"value","count":12345}`, 2000))
+	tiny := []byte{0x8f, 0x13, 0xc2}
+	compressions := []Compression{CompressionNone, CompressionGzip, CompressionZstd}
+	for _, compression := range compressions {
+		wal, err := Open(&Options{LogDir: dir + "/", Compression: compression})
+		if err != nil {
+			t.Fatalf("Open failed: %v", err)
+		}
+		wal.Write(large)
+		wal.Write(tiny)
+		wal.Sync()
+		stored, _ := wal.readSegment(wal.file.Name())
+		last := stored[len(stored)-2:]
+		if compression == CompressionNone {
+			if last[0].IsCompressed || !bytes.Equal(last[0].Data, large) {
+				t.Errorf("Expected the payload stored as is without compression")
+			}
+		} else if !last[0].IsCompressed || last[0].Compression != uint32(compression) ||
+			len(last[0].Data) >= len(large)/10 || !last[1].IsCompressed {
+			t.Errorf("Expected the payloads stored compressed with %d, got %d with %d bytes",
+				compression, last[0].Compression, len(last[0].Data))
+		}
+		if err := wal.Close(); err != nil {
+			t.Fatalf("Close failed: %v", err)
+		}
+	}
+
+	// Every entry records its algorithm, a log mixing them reads back with any option
+	wal, err := Open(&Options{LogDir: dir + "/", Compression: CompressionGzip})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 2*len(compressions) {
+		t.Fatalf("Expected %d entries, got %d", 2*len(compressions), len(entries))
+	}
+	for i, entry := range entries {
+		want := large
+		if i%2 == 1 {
+			want = tiny
+		}
+		if !bytes.Equal(entry.Data, want) || entry.IsCompressed || entry.Compression != 0 {
+			t.Errorf("Entry %d didn't read back decompressed, got %d bytes", i, len(entry.Data))
+		}
+	}
+
+	// The checksum covers the recorded algorithm
+	stored, _ := wal.readSegment(wal.file.Name())
+	swapped := stored[len(stored)-2].clone()
+	swapped.Compression = uint32(CompressionGzip)
+	if err := validateChecksum(CRC32IEEE, swapped); err == nil {
+		t.Errorf("Expected a checksum error once the algorithm is altered")
+	}
+}
+
+func newTestCipher(t *testing.T, key byte) cipher.AEAD {
+	block, err := aes.NewCipher(bytes.Repeat([]byte{key}, 32))
+	if err != nil {
+		t.Fatalf("NewCipher failed: %v", err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatalf("NewGCM failed: %v", err)
+	}
+	return aead
+}
+
+func TestCipher(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/", Cipher: newTestCipher(t, 1), Compression: CompressionGzip})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	secret := []byte(strings.Repeat("secret payload ", 20))
+	for i := 0; i < 3; i++ {
+		if err := wal.Write(secret); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	if err := wal.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	content, _ := os.ReadFile(filepath.Join(dir, segmentPrefix+"1"))
+	if bytes.Contains(content, []byte("secret payload")) {
+		t.Errorf("Expected the payload to be encrypted on disk")
+	}
+
+	wal, err = Open(&Options{LogDir: dir + "/", Cipher: newTestCipher(t, 1)})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll with the right key failed: %v", err)
+	}
+	if len(entries) != 3 {
+		t.Fatalf("Expected 3 entries, got %d", len(entries))
+	}
+	for i, entry := range entries {
+		if !bytes.Equal(entry.Data, secret) || len(entry.CipherNonce) != 0 {
+			t.Errorf("Entry %d didn't read back decrypted", i)
+		}
+	}
+
+	// A payload is bound to its entry, moved to another one with a valid checksum it fails to decrypt
+	tamper := func(transform func(entries []*Entry)) {
+		wal.rewriteSegment(wal.file.Name(), func(entries []*Entry) []*Entry {
+			transform(entries)
+			for _, entry := range entries {
+				stampChecksum(wal.checksum, entry, entry.SeqNo)
+			}
+			return entries
+		})
+	}
+	tamper(func(entries []*Entry) {
+		entries[0].Data, entries[1].Data = entries[1].Data, entries[0].Data
+		entries[0].CipherNonce, entries[1].CipherNonce = entries[1].CipherNonce, entries[0].CipherNonce
+	})
+	if _, err := wal.ReadAll(); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected ErrDecryptionFailed for a payload moved to another entry, got %v", err)
+	}
+	// An entry stored in clear doesn't pass for a decrypted one
+	tamper(func(entries []*Entry) {
+		entries[0].Data, entries[1].Data = entries[1].Data, entries[0].Data
+		entries[0].CipherNonce, entries[1].CipherNonce = entries[1].CipherNonce, entries[0].CipherNonce
+		entries[2].Data = []byte("forged")
+		entries[2].CipherNonce = nil
+		entries[2].IsCompressed = false
+		entries[2].UncompressedLength = 0
+		entries[2].Compression = 0
+	})
+	if _, err := wal.ReadAll(); !errors.Is(err, ErrDecryptionFailed) || !strings.Contains(err.Error(), "seq no 3 is not encrypted") {
+		t.Errorf("Expected ErrDecryptionFailed for the entry stored in clear, got %v", err)
+	}
+	wal.Close()
+
+	wal, err = Open(&Options{LogDir: dir + "/", Cipher: newTestCipher(t, 2)})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	if _, err := wal.ReadAll(); !errors.Is(err, ErrDecryptionFailed) {
+		t.Errorf("Expected ErrDecryptionFailed with the wrong key, got %v", err)
+	}
+}
+
+func TestEntryTimestamps(t *testing.T) {
+	dir := tempWalDir(t)
+	wal, err := Open(&Options{LogDir: dir + "/"})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := 0; i < 20; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d", i))); err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+	wal.Sync()
+	written, _ := wal.ReadAll()
+	wal.Close()
+
+	wal, err = Open(&Options{LogDir: dir + "/"})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	entries, err := wal.ReadAll()
+	if err != nil || len(entries) != 20 {
+		t.Fatalf("Expected 20 entries after reopen, got %d (%v)", len(entries), err)
+	}
+	for i, entry := range entries {
+		if entry.TimestampUnixNano == 0 || entry.TimestampUnixNano != written[i].TimestampUnixNano {
+			t.Errorf("Entry %d has timestamp %d, written with %d", i, entry.TimestampUnixNano, written[i].TimestampUnixNano)
+		}
+		if i > 0 && entry.TimestampUnixNano < entries[i-1].TimestampUnixNano {
+			t.Errorf("Entry %d has timestamp %d before the previous %d", i, entry.TimestampUnixNano, entries[i-1].TimestampUnixNano)
+		}
+	}
+
+	// The checksum covers the timestamp, and the flag saying so
+	altered := entries[0].clone()
+	altered.TimestampUnixNano++
+	if err := validateChecksum(CRC32IEEE, altered); err == nil {
+		t.Errorf("Expected a checksum error for an altered timestamp")
+	}
+	unflagged := entries[0].clone()
+	unflagged.TimestampChecked = false
+	if err := validateChecksum(CRC32IEEE, unflagged); err == nil {
+		t.Errorf("Expected a checksum error once the timestamp flag is cleared")
+	}
+	// Entries written before keep a checksum without the timestamp
+	stampChecksum(CRC32IEEE, unflagged, unflagged.SeqNo)
+	unflagged.TimestampUnixNano++
+	if err := validateChecksum(CRC32IEEE, unflagged); err != nil {
+		t.Errorf("Expected an entry without the flag to keep its checksum, got %v", err)
+	}
+}
+
+func TestPurgeExpired(t *testing.T) {
+	dir := tempWalDir(t)
+	now := time.Now()
+	clock := now.Add(-3 * time.Hour)
+	wal, err := Open(&Options{LogDir: dir + "/", RetentionAge: time.Hour, maxSegments: 20,
+		Clock: func() time.Time { return clock }})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+
+	// Segments 1, 2 and 4 are backdated, 3 holds the last checkpoint, 5 is the active one
+	for segment := 1; segment <= 5; segment++ {
+		if segment == 5 {
+			clock = now
+		}
+		for i := 0; i < 3; i++ {
+			if err := wal.Write([]byte(fmt.Sprintf("segment-%d-%d", segment, i))); err != nil {
+				t.Fatalf("Write failed: %v", err)
+			}
+		}
+		if segment == 3 {
+			if _, err := wal.Checkpoint(); err != nil {
+				t.Fatalf("Checkpoint failed: %v", err)
+			}
+		}
+		if segment < 5 {
+			if err := wal.Rotate(); err != nil {
+				t.Fatalf("Rotate failed: %v", err)
+			}
+		}
+	}
+
+	if err := wal.PurgeExpired(); err != nil {
+		t.Fatalf("PurgeExpired failed: %v", err)
+	}
+	segments, _ := wal.Segments()
+	if !slices.Equal(segments, []int{3, 4, 5}) {
+		t.Fatalf("Expected only the expired segments before the checkpoint to be purged, got %v", segments)
+	}
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if len(entries) != 10 || string(entries[0].Data) != "segment-3-0" {
+		t.Errorf("Expected the entries from segment 3 on, got %d entries", len(entries))
+	}
+	if count, _ := wal.Count(); count != 10 {
+		t.Errorf("Expected the count to follow the purge, got %d", count)
+	}
+
+	// Past the checkpoint the expired segments go on rotation, the active segment is kept however old
+	clock = now.Add(2 * time.Hour)
+	if _, err := wal.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if err := wal.Rotate(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	if segments, _ := wal.Segments(); !slices.Equal(segments, []int{5, 6}) {
+		t.Errorf("Expected the segments before the new checkpoint to be purged on rotation, got %v", segments)
+	}
+}
+
+func TestMaxTotalSize(t *testing.T) {
+	dir := tempWalDir(t)
+	const maxTotalSize = 30 * 1024
+	wal, err := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 6 * 1024, maxSegments: 100, MaxTotalSize: maxTotalSize})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+
+	diskSize := func() int64 {
+		var total int64
+		files, _ := filepath.Glob(filepath.Join(dir, segmentPrefix+"*"))
+		for _, file := range files {
+			fileInfo, _ := os.Stat(file)
+			total += fileInfo.Size()
+		}
+		return total
+	}
+	for i := 0; i < 300; i++ {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, strings.Repeat("x", 500)))); err != nil {
+			t.Fatalf("Write failed at entry %d: %v", i, err)
+		}
+		wal.Sync()
+		if size := diskSize(); size > maxTotalSize {
+			t.Fatalf("Segments take %d bytes after entry %d, over the maximum of %d", size, i, maxTotalSize)
+		}
+	}
+	segments, _ := wal.Segments()
+	if segments[0] <= 2 {
+		t.Errorf("Expected the oldest segments to be purged, got %v", segments)
+	}
+	entries, err := wal.ReadAll()
+	if err != nil {
+		t.Fatalf("ReadAll failed: %v", err)
+	}
+	if last := entries[len(entries)-1].SeqNo; last != 300 || entries[0].SeqNo != 300-uint64(len(entries))+1 {
+		t.Errorf("Expected the most recent entries to be kept contiguous, got %d to %d", entries[0].SeqNo, last)
+	}
+
+	// A lower cap purges more, the segments are reported, down to the one holding the last checkpoint
+	if _, err := wal.Checkpoint(); err != nil {
+		t.Fatalf("Checkpoint failed: %v", err)
+	}
+	if err := wal.Rotate(); err != nil {
+		t.Fatalf("Rotate failed: %v", err)
+	}
+	segments, _ = wal.Segments()
+	wal.maxTotalSize = 1
+	removed, err := wal.PurgeOverSize()
+	if err != nil {
+		t.Fatalf("PurgeOverSize failed: %v", err)
+	}
+	if !slices.Equal(removed, segments[:len(segments)-2]) {
+		t.Errorf("Expected segments %v to be purged, got %v", segments[:len(segments)-2], removed)
+	}
+	if left, _ := wal.Segments(); !slices.Equal(left, segments[len(segments)-2:]) {
+		t.Errorf("Expected the segment holding the checkpoint and the active one to be kept, got %v", left)
+	}
+}
+
+// memFS is an in-memory FileSystem, its files fail Sync with syncErr and Remove fails with removeErr when they are set
+type memFS struct {
+	mu        sync.Mutex
+	files     map[string]*memData
+	syncErr   error
+	removeErr error
+}
+
+// memData is the content of a memFS file, shared by its open handles
+type memData struct {
+	name string
+	data []byte
+}
+
+func newMemFS() *memFS {
+	return &memFS{files: map[string]*memData{}}
+}
+
+func (m *memFS) Open(name string) (File, error) {
+	return m.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (m *memFS) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	name = filepath.Clean(name)
+	data, ok := m.files[name]
+	if !ok {
+		if flag&os.O_CREATE == 0 {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		data = &memData{name: name}
+		m.files[name] = data
+	}
+	if flag&os.O_TRUNC != 0 {
+		data.data = nil
+	}
+	return &memFile{fs: m, content: data, appendOnly: flag&os.O_APPEND != 0}, nil
+}
+
+func (m *memFS) ReadFile(name string) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	}
+	return slices.Clone(data.data), nil
+}
+
+func (m *memFS) ReadDir(name string) ([]os.DirEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	entries := []os.DirEntry{}
+	for path, data := range m.files {
+		if filepath.Dir(path) == filepath.Clean(name) {
+			entries = append(entries, fs.FileInfoToDirEntry(memFileInfo{data}))
+		}
+	}
+	slices.SortFunc(entries, func(a, b os.DirEntry) int { return strings.Compare(a.Name(), b.Name()) })
+	return entries, nil
+}
+
+func (m *memFS) Remove(name string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.removeErr != nil {
+		return m.removeErr
+	}
+	if _, ok := m.files[filepath.Clean(name)]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	delete(m.files, filepath.Clean(name))
+	return nil
+}
+
+// Rename moves a file, or all the files under a directory as directories only exist through their files
+func (m *memFS) Rename(oldpath, newpath string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	oldpath, newpath = filepath.Clean(oldpath), filepath.Clean(newpath)
+	moved := false
+	for path, data := range m.files {
+		rel, err := filepath.Rel(oldpath, path)
+		if err != nil || strings.HasPrefix(rel, "..") {
+			continue
+		}
+		delete(m.files, path)
+		data.name = filepath.Join(newpath, rel)
+		m.files[data.name] = data
+		moved = true
+	}
+	if !moved {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	return nil
+}
+
+func (m *memFS) RemoveAll(path string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for name := range m.files {
+		if rel, err := filepath.Rel(filepath.Clean(path), name); err == nil && !strings.HasPrefix(rel, "..") {
+			delete(m.files, name)
+		}
+	}
+	return nil
+}
+
+func (m *memFS) MkdirAll(path string, perm os.FileMode) error {
+	return nil
+}
+
+func (m *memFS) Stat(name string) (os.FileInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, ok := m.files[filepath.Clean(name)]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return memFileInfo{data}, nil
+}
+
+// memFile is an open memFS file
+type memFile struct {
+	fs         *memFS
+	content    *memData
+	offset     int64
+	appendOnly bool
+}
+
+func (f *memFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) ReadAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if off >= int64(len(f.content.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.content.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	if f.appendOnly {
+		f.offset = int64(len(f.content.data))
+	}
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *memFile) WriteAt(p []byte, off int64) (int, error) {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(f.content.data)) {
+		f.content.data = append(f.content.data, make([]byte, end-int64(len(f.content.data)))...)
+	}
+	return copy(f.content.data[off:], p), nil
+}
+
+func (f *memFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += int64(len(f.content.data))
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *memFile) Truncate(size int64) error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	f.content.data = f.content.data[:size]
+	return nil
+}
+
+func (f *memFile) Sync() error {
+	f.fs.mu.Lock()
+	defer f.fs.mu.Unlock()
+	return f.fs.syncErr
+}
+
+func (f *memFile) Name() string               { return f.content.name }
+func (f *memFile) Stat() (os.FileInfo, error) { return memFileInfo{f.content}, nil }
+func (f *memFile) Close() error               { return nil }
+
+// memFileInfo describes a memFS file
+type memFileInfo struct {
+	content *memData
+}
+
+func (fi memFileInfo) Name() string       { return filepath.Base(fi.content.name) }
+func (fi memFileInfo) Size() int64        { return int64(len(fi.content.data)) }
+func (fi memFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi memFileInfo) ModTime() time.Time { return time.Time{} }
+func (fi memFileInfo) IsDir() bool        { return false }
+func (fi memFileInfo) Sys() any           { return nil }
+
+func TestFileSystem(t *testing.T) {
+	memfs := newMemFS()
+	dir := filepath.Join(t.TempDir(), "missing")
+	wal, err := Open(&Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024, FS: memfs})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	for i := range 60 {
+		if err := wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, strings.Repeat("x", 50)))); err != nil {
+			t.Fatalf("Write failed at entry %d: %v", i, err)
+		}
+	}
+	if err := wal.Sync(); err != nil {
+		t.Fatalf("Sync failed: %v", err)
+	}
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected nothing to be written to the disk, got %v", err)
+	}
+	if segments, _ := wal.Segments(); len(segments) < 2 {
+		t.Errorf("Expected the segments to rotate in the file system, got %v", segments)
+	}
+	entries, err := wal.ReadAll()
+	if err != nil || len(entries) != 60 {
+		t.Fatalf("Expected 60 entries read back from the file system, got %d, %v", len(entries), err)
+	}
+
+	// The errors of the file system reach the caller
+	injected := errors.New("injected I/O error")
+	memfs.mu.Lock()
+	memfs.syncErr = injected
+	memfs.mu.Unlock()
+	wal.Write([]byte("unsynced"))
+	err = wal.Sync()
+	var syncErr *ErrFileSync
+	if !errors.As(err, &syncErr) || !errors.Is(err, injected) {
+		t.Errorf("Expected ErrFileSync wrapping the injected error, got %v", err)
+	}
+}
+
+func TestFileSystemRewrites(t *testing.T) {
+	memfs := newMemFS()
+	dir := filepath.Join(t.TempDir(), "missing")
+	options := &Options{LogDir: dir + "/", MaxLogFileSize: 5 * 1024, FS: memfs,
+		CompressSealedSegments: true, PersistCount: true}
+	wal, err := Open(options)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := range 60 {
+		if i%10 == 0 {
+			wal.WriteWithCheckpoint([]byte(fmt.Sprintf("checkpoint-%d", i)))
+		} else {
+			wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, strings.Repeat("x", 50))))
+		}
+	}
+	wal.background.Wait()
+	if segments, _ := listSegmentFiles(memfs, filepath.Join(dir, segmentPrefix)); !isCompressedSegment(segments[0]) {
+		t.Errorf("Expected the sealed segments to be compressed in the file system, got %v", segments)
+	}
+	if err := wal.CompactCheckpoints(1); err != nil {
+		t.Errorf("CompactCheckpoints failed: %v", err)
+	}
+	if err := wal.TruncateAfter(50); err != nil {
+		t.Errorf("TruncateAfter failed: %v", err)
+	}
+	if err := wal.SetWatermark(42); err != nil {
+		t.Errorf("SetWatermark failed: %v", err)
+	}
+	entries, err := wal.ReadAll()
+	if err != nil || len(entries) != 50 {
+		t.Fatalf("Expected 50 entries, got %d, %v", len(entries), err)
+	}
+	if err := wal.ReplaceAll(entries[:20]); err != nil {
+		t.Errorf("ReplaceAll failed: %v", err)
+	}
+	wal.Close()
+	if _, err := os.Stat(dir); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected nothing to be written to the disk, got %v", err)
+	}
+
+	// Everything was kept in the file system
+	wal, err = Open(options)
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	defer wal.Close()
+	if count, err := wal.Count(); err != nil || count != 20 {
+		t.Errorf("Expected a count of 20, got %d, %v", count, err)
+	}
+	if watermark, err := wal.Watermark(); err != nil || watermark != 42 {
+		t.Errorf("Expected the watermark 42, got %d, %v", watermark, err)
+	}
+}
+
+func TestTruncateAfterFailure(t *testing.T) {
+	memfs := newMemFS()
+	wal, err := Open(&Options{LogDir: t.TempDir() + "/", MaxLogFileSize: 5 * 1024, FS: memfs})
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+	for i := range 60 {
+		wal.Write([]byte(fmt.Sprintf("entry-%d-%s", i, strings.Repeat("x", 50))))
+	}
+
+	// The segments after the one holding seq no 5 can't be deleted once the active one is closed
+	injected := errors.New("injected I/O error")
+	memfs.mu.Lock()
+	memfs.removeErr = injected
+	memfs.mu.Unlock()
+	if err := wal.TruncateAfter(5); !errors.Is(err, injected) {
+		t.Fatalf("Expected TruncateAfter to fail with the injected error, got %v", err)
+	}
+	// The WAL is left closed rather than open without an active segment
+	if err := wal.Write([]byte("after failure")); err == nil {
+		t.Errorf("Expected Write to fail after the failed truncation")
+	}
+	if err := wal.Sync(); err != nil {
+		t.Errorf("Expected Sync to have nothing left to sync, got %v", err)
+	}
+	if err := wal.Close(); err != nil {
+		t.Errorf("Expected Close to release the WAL, got %v", err)
+	}
+}